@@ -0,0 +1,69 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// Errors returned by CAS implementations.
+// Implementations wrap them (or return typed errors that match them), so that callers can use errors.Is
+// regardless of the backend, including backends behind a network protocol.
+var (
+	// ErrNotFound is returned if a blob does not exist.
+	// It is fs.ErrNotExist, so existing checks for fs.ErrNotExist keep working.
+	ErrNotFound = fs.ErrNotExist
+	// ErrIntegrityMismatch is returned if data does not match its SRI or expected size.
+	// It is sri.ErrIntegrityMismatch, which sri.ErrHashMismatch and sri.ErrSizeMismatch match.
+	ErrIntegrityMismatch = sri.ErrIntegrityMismatch
+	// ErrTooLarge is returned if a blob exceeds a size limit.
+	ErrTooLarge = errors.New("blob too large")
+	// ErrUnauthorized is returned if the caller lacks valid credentials or permissions.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrUnavailable is returned if a backend is temporarily unavailable.
+	// Operations failing with it may succeed when retried.
+	ErrUnavailable = errors.New("unavailable")
+	// ErrInvalidSRI is returned if a string is not a valid SRI.
+	// It is sri.ErrInvalidSRI.
+	ErrInvalidSRI = sri.ErrInvalidSRI
+)
+
+// TooLargeError describes a blob that exceeds a size limit.
+// It matches ErrTooLarge.
+type TooLargeError struct {
+	// Size is the size of the blob, or -1 if it is unknown.
+	Size int64
+	// Limit is the maximum size.
+	Limit int64
+}
+
+func (e *TooLargeError) Error() string {
+	if e.Size < 0 {
+		return fmt.Sprintf("%v: exceeds limit of %d bytes", ErrTooLarge, e.Limit)
+	}
+	return fmt.Sprintf("%v: size %d exceeds limit of %d bytes", ErrTooLarge, e.Size, e.Limit)
+}
+
+func (e *TooLargeError) Is(target error) bool {
+	return target == ErrTooLarge
+}
+
+// UnavailableError describes a backend that could not be reached.
+// It matches ErrUnavailable and wraps the underlying error.
+type UnavailableError struct {
+	Err error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrUnavailable, e.Err)
+}
+
+func (e *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"io"
 	"io/fs"
+	"time"
 )
 
 type Source interface {
@@ -34,8 +35,96 @@ type CASReader interface {
 }
 
 type CASWriter interface {
+	// Write writes the contents of r to the CAS under the given SRI.
+	// If reading from r fails, the blob must not be committed.
 	Write(sri string, r io.Reader) error
 }
 
+// CASStater is an optional interface for CAS implementations
+// that can query the existence and size of a blob without reading it.
+type CASStater interface {
+	// Stat returns the size of the blob with the given SRI.
+	// If the SRI does not exist, it returns fs.ErrNotExist.
+	Stat(sri string) (int64, error)
+}
+
+// CASRangeReader is an optional interface for CAS implementations
+// that can read parts of a blob without reading it from the start.
+type CASRangeReader interface {
+	// OpenRange returns a reader for length bytes of the blob with the given SRI, starting at offset.
+	// A negative length reads until the end of the blob.
+	// If the SRI does not exist, it returns fs.ErrNotExist.
+	OpenRange(sri string, offset, length int64) (io.ReadCloser, error)
+}
+
+// CASMissingFinder is an optional interface for CAS implementations
+// that can efficiently query the existence of many blobs at once.
+type CASMissingFinder interface {
+	// FindMissing returns the subset of the given SRIs that are not present in the CAS.
+	FindMissing(sris []string) ([]string, error)
+}
+
+// CASLister is an optional interface for CAS implementations
+// that can enumerate the blobs they store.
+type CASLister interface {
+	// List calls fn for every blob in the CAS that uses the given algorithm.
+	// An empty algorithm lists blobs of all algorithms.
+	// Blobs are visited in a stable order as long as the CAS is not modified.
+	// If fn returns fs.SkipAll, List stops and returns nil.
+	// If fn returns any other error, List stops and returns that error.
+	List(algorithm string, fn func(BlobInfo) error) error
+}
+
+// CASCursorLister is an optional interface for CAS implementations
+// that can resume a listing after a given blob.
+type CASCursorLister interface {
+	CASLister
+	// ListAfter is like List, but only visits the blobs that List visits after the blob with the SRI after.
+	// The position is derived from the SRI itself, so the blob does not need to exist
+	// and blobs written or deleted concurrently do not cause other blobs to be skipped.
+	// An empty after lists all blobs.
+	ListAfter(algorithm, after string, fn func(BlobInfo) error) error
+}
+
+// CASDeleter is an optional interface for CAS implementations
+// that can remove blobs.
+type CASDeleter interface {
+	// Delete removes the blob with the given SRI.
+	// If the SRI does not exist, it returns fs.ErrNotExist.
+	Delete(sri string) error
+}
+
+// CASConditionalDeleter is an optional interface for CAS implementations
+// that can atomically remove blobs that were not written recently.
+type CASConditionalDeleter interface {
+	// DeleteIfOlder removes the blob with the given SRI if it was last modified before cutoff.
+	// It reports whether the blob was removed.
+	// If the SRI does not exist, it returns fs.ErrNotExist.
+	DeleteIfOlder(sri string, cutoff time.Time) (bool, error)
+}
+
+// KeyValueStore is a mutable key-value store for data that is not content addressed.
+// CAS wrappers that transform blobs use it as index, to map the SRI of a blob
+// to the SRI of the representation they store (see package cas).
+// Keys are lowercase hex strings of 32 to 128 characters.
+type KeyValueStore interface {
+	// Get returns the value stored under key.
+	// If the key does not exist, it returns fs.ErrNotExist.
+	Get(key string) ([]byte, error)
+	// Put stores value under key, replacing any previous value.
+	Put(key string, value []byte) error
+}
+
+// BlobInfo describes a blob stored in a CAS.
+type BlobInfo struct {
+	// SRI is the SRI of the blob.
+	SRI string
+	// Size is the size of the blob in bytes.
+	Size int64
+	// ModTime is the time the blob was written.
+	// It is the zero time if the CAS does not track it.
+	ModTime time.Time
+}
+
 // CloseWaitFunc is a function that closes a resource and waits for it to be closed.
 type CloseWaitFunc func() error
@@ -0,0 +1,164 @@
+// Package actioncache implements key-value stores for the action cache
+// namespace of the Bazel HTTP remote cache protocol.
+//
+// Unlike blobs in a CAS, action cache entries are not content addressed:
+// the key is the digest of an action, the value is the serialized result of the action.
+// Entries can be overwritten.
+// The stores implement api.KeyValueStore, so they can also serve as index
+// of CAS wrappers that transform blobs.
+package actioncache
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/malt3/abstractfs-core/api"
+)
+
+// Memory is an in-memory action cache.
+type Memory struct {
+	mux     sync.RWMutex
+	entries map[string][]byte
+}
+
+// NewMemory creates a new, empty in-memory action cache.
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string][]byte)}
+}
+
+// Get returns the value stored under key.
+// If the key does not exist, it returns an error wrapping fs.ErrNotExist.
+// The returned value is a copy that the caller may modify.
+func (m *Memory) Get(key string) ([]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	value, ok := m.entries[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: key, Err: fs.ErrNotExist}
+	}
+	got := make([]byte, len(value))
+	copy(got, value)
+	return got, nil
+}
+
+// Put stores value under key, replacing any previous value.
+func (m *Memory) Put(key string, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	stored := make([]byte, len(value))
+	copy(stored, value)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.entries[key] = stored
+	return nil
+}
+
+// Dir is an action cache that stores entries in a directory.
+// Entries are stored in a sharded layout:
+// <root>/<first-two-hex-chars>/<remaining-hex-chars>
+// Writes go to a temporary file that is renamed into place,
+// so readers never observe partially written entries.
+type Dir struct {
+	root string
+}
+
+// NewDir creates a new directory action cache rooted at root.
+// The directory is created if it does not exist.
+func NewDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(filepath.Join(root, tmpDir), 0o755); err != nil {
+		return nil, fmt.Errorf("creating action cache directory: %w", err)
+	}
+	return &Dir{root: root}, nil
+}
+
+// Get returns the value stored under key.
+// If the key does not exist, it returns an error wrapping fs.ErrNotExist.
+func (d *Dir) Get(key string) ([]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(d.entryPath(key))
+}
+
+// Put stores value under key, replacing any previous value.
+func (d *Dir) Put(key string, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(d.root, tmpDir), "entry-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.Write(value); err != nil {
+		return fmt.Errorf("writing entry: %w", err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		return fmt.Errorf("writing entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing entry: %w", err)
+	}
+	target := d.entryPath(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("creating shard directory: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("committing entry: %w", err)
+	}
+	committed = true
+	return nil
+}
+
+func (d *Dir) entryPath(key string) string {
+	return filepath.Join(d.root, key[:2], key[2:])
+}
+
+// validateKey checks that the key is a lowercase hex encoded digest.
+func validateKey(key string) error {
+	if len(key) < minKeyLen {
+		return errors.New("invalid action cache key: too short")
+	}
+	if len(key) > maxKeyLen {
+		return errors.New("invalid action cache key: too long")
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		return fmt.Errorf("invalid action cache key: %w", err)
+	}
+	for _, c := range key {
+		if c >= 'A' && c <= 'F' {
+			return errors.New("invalid action cache key: must be lowercase hex")
+		}
+	}
+	return nil
+}
+
+var (
+	_ api.KeyValueStore = (*Memory)(nil)
+	_ api.KeyValueStore = (*Dir)(nil)
+)
+
+const (
+	// tmpDir is the directory (relative to the root) used for uncommitted writes.
+	tmpDir = "tmp"
+	// minKeyLen is the minimum length of a key (a hex encoded 128 bit digest).
+	minKeyLen = 32
+	// maxKeyLen is the maximum length of a key (a hex encoded 512 bit digest).
+	// It keeps the file names of Dir within the limits of common file systems.
+	maxKeyLen = 128
+)
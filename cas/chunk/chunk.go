@@ -0,0 +1,601 @@
+// Package chunk implements a CAS wrapper that splits large blobs into content-defined chunks.
+//
+// Blobs larger than a threshold are split into chunks using FastCDC.
+// Every chunk is stored individually under its own SRI, and an index blob
+// listing the chunks is stored under its own SRI and found through an index,
+// as described in the package documentation of cas.
+// Smaller blobs are stored whole under their own SRI and have no index entry.
+// Since chunk boundaries only depend on the content, similar blobs
+// (e.g. two versions of a disk image) share most of their chunks.
+// Open reassembles chunked blobs transparently, so TreeFS and the recorder protocol
+// work unchanged on top of a chunking CAS.
+// The wrapper verifies the SRI of the whole blob on Write.
+package chunk
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/bits"
+	"sync"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// Options are the options of a chunking CAS.
+type Options struct {
+	// MinSize is the minimum size of a chunk.
+	// Zero means DefaultMinSize.
+	MinSize int
+	// AvgSize is the targeted average size of a chunk. It must be a power of two.
+	// Zero means DefaultAvgSize.
+	AvgSize int
+	// MaxSize is the maximum size of a chunk.
+	// Zero means DefaultMaxSize.
+	MaxSize int
+	// Threshold is the maximum size of a blob that is stored whole.
+	// Larger blobs are chunked.
+	// Zero means MaxSize.
+	Threshold int64
+	// Index maps the SRIs of chunked blobs to the SRIs of their index blobs. Required.
+	Index api.KeyValueStore
+	// IndexCacheSize is the number of decoded index blobs kept in memory.
+	// Zero means DefaultIndexCacheSize. A negative size disables the cache.
+	IndexCacheSize int
+}
+
+// CAS is a CAS that stores large blobs as content-defined chunks.
+type CAS struct {
+	backend api.CAS
+	opts    Options
+	cache   *indexCache
+}
+
+// New creates a new chunking CAS on top of backend.
+func New(backend api.CAS, opts Options) (*CAS, error) {
+	if opts.Index == nil {
+		return nil, errors.New("creating chunking cas: no index")
+	}
+	if opts.MinSize == 0 {
+		opts.MinSize = DefaultMinSize
+	}
+	if opts.AvgSize == 0 {
+		opts.AvgSize = DefaultAvgSize
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.Threshold == 0 {
+		opts.Threshold = int64(opts.MaxSize)
+	}
+	if opts.IndexCacheSize == 0 {
+		opts.IndexCacheSize = DefaultIndexCacheSize
+	}
+	if opts.MinSize <= 0 || opts.MinSize >= opts.AvgSize || opts.AvgSize >= opts.MaxSize {
+		return nil, fmt.Errorf("creating chunking cas: invalid chunk sizes (min %d, avg %d, max %d)", opts.MinSize, opts.AvgSize, opts.MaxSize)
+	}
+	if bits.OnesCount(uint(opts.AvgSize)) != 1 || opts.AvgSize < 4 {
+		return nil, fmt.Errorf("creating chunking cas: average chunk size %d is not a power of two", opts.AvgSize)
+	}
+	if opts.Threshold < 0 {
+		return nil, fmt.Errorf("creating chunking cas: invalid threshold %d", opts.Threshold)
+	}
+	return &CAS{backend: backend, opts: opts, cache: newIndexCache(opts.IndexCacheSize)}, nil
+}
+
+// Open returns a reader for the blob with the given SRI.
+// Chunked blobs are reassembled while reading.
+func (c *CAS) Open(sriString string) (io.ReadCloser, error) {
+	entry, chunked, err := c.lookup(sriString)
+	if err != nil {
+		return nil, err
+	}
+	if !chunked {
+		return c.backend.Open(sriString)
+	}
+	idx, err := c.loadIndex(sriString, entry)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkReader(c.backend, idx, 0, idx.size), nil
+}
+
+// OpenRange returns a reader for length bytes of the blob with the given SRI, starting at offset.
+// A negative length reads until the end of the blob.
+// For chunked blobs, only the chunks overlapping the range are read.
+func (c *CAS) OpenRange(sriString string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("opening range: negative offset")
+	}
+	entry, chunked, err := c.lookup(sriString)
+	if err != nil {
+		return nil, err
+	}
+	if !chunked {
+		return cas.OpenRange(c.backend, sriString, offset, length)
+	}
+	idx, err := c.loadIndex(sriString, entry)
+	if err != nil {
+		return nil, err
+	}
+	if offset > idx.size {
+		offset = idx.size
+	}
+	if length < 0 || length > idx.size-offset {
+		length = idx.size - offset
+	}
+	return newChunkReader(c.backend, idx, offset, length), nil
+}
+
+// Stat returns the size of the blob with the given SRI.
+// For chunked blobs, it only queries the existence of the index blob.
+func (c *CAS) Stat(sriString string) (int64, error) {
+	entry, chunked, err := c.lookup(sriString)
+	if err != nil {
+		return 0, err
+	}
+	if !chunked {
+		return cas.Stat(c.backend, sriString)
+	}
+	if has, err := cas.Has(c.backend, entry.SRI); err != nil || !has {
+		return 0, notExist("stat", sriString, err)
+	}
+	return entry.Size, nil
+}
+
+// Write writes the blob to the backend.
+// Blobs larger than the threshold are split into chunks.
+// Chunks that already exist are written again, so that the backend
+// refreshes their modification time (see gc.Collector.GracePeriod).
+// If the content does not match the SRI, the blob is not committed.
+// Chunks written before the mismatch was detected are left for garbage collection.
+func (c *CAS) Write(sriString string, r io.Reader) error {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return err
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, -1, r)
+	if err != nil {
+		return err
+	}
+
+	// read a prefix of the blob to decide whether to chunk it
+	var prefix bytes.Buffer
+	switch _, err := io.CopyN(&prefix, verifier, c.opts.Threshold+1); err {
+	case nil:
+	case io.EOF:
+		// the whole blob fits into the prefix (and was verified)
+		if err := c.backend.Write(sriString, &prefix); err != nil {
+			return fmt.Errorf("writing %s: %w", sriString, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+
+	idx, err := c.writeChunks(integrity.Algorithm, io.MultiReader(&prefix, verifier))
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	data := idx.marshal()
+	indexSRI, err := sri.FromReader(integrity.Algorithm, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	entry := indexEntry{SRI: indexSRI.String(), Size: idx.size}
+	if err := c.backend.Write(entry.SRI, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("writing %s: writing index blob: %w", sriString, err)
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	if err := c.opts.Index.Put(indexKey(sriString), value); err != nil {
+		return fmt.Errorf("writing %s: updating index: %w", sriString, err)
+	}
+	c.cache.add(entry.SRI, idx)
+	return nil
+}
+
+// Delete removes the blob with the given SRI from the backend.
+// For chunked blobs, only the index blob is removed.
+// The chunks are not removed, since they may be shared with other blobs.
+func (c *CAS) Delete(sriString string) error {
+	deleter, ok := c.backend.(api.CASDeleter)
+	if !ok {
+		return errors.New("deleting: backend does not support deletion")
+	}
+	entry, chunked, err := c.lookup(sriString)
+	if err != nil {
+		return err
+	}
+	if !chunked {
+		return deleter.Delete(sriString)
+	}
+	c.cache.remove(entry.SRI)
+	return deleter.Delete(entry.SRI)
+}
+
+// References returns the SRIs of the index blob and the chunks of the blob with the given SRI.
+// Blobs that are stored whole have no references.
+// It is meant to be used as gc.Collector.References when collecting garbage in the backend.
+func (c *CAS) References(sriString string) ([]string, error) {
+	entry, chunked, err := c.lookup(sriString)
+	if err != nil || !chunked {
+		return nil, err
+	}
+	idx, err := c.loadIndex(sriString, entry)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]string, 0, len(idx.chunks)+1)
+	refs = append(refs, entry.SRI)
+	for _, ref := range idx.chunks {
+		refs = append(refs, ref.sri)
+	}
+	return refs, nil
+}
+
+// writeChunks splits r into chunks, writes them to the backend and returns the index.
+func (c *CAS) writeChunks(algorithm sri.Algorithm, r io.Reader) (*index, error) {
+	hasher, err := algorithm.Hasher()
+	if err != nil {
+		return nil, err
+	}
+	idx := &index{}
+	chunker := newChunker(r, c.opts.MinSize, c.opts.AvgSize, c.opts.MaxSize)
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			return idx, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hasher.Reset()
+		hasher.Write(data)
+		chunkSRI := sri.Integrity{Algorithm: algorithm, Hash: hasher.Sum(nil)}.String()
+		if err := c.backend.Write(chunkSRI, bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("writing chunk %s: %w", chunkSRI, err)
+		}
+		idx.append(chunkSRI, int64(len(data)))
+	}
+}
+
+// lookup returns the index entry of the blob with the given SRI.
+// chunked is false if the blob is stored whole.
+func (c *CAS) lookup(sriString string) (entry indexEntry, chunked bool, err error) {
+	if _, err := sri.FromString(sriString); err != nil {
+		return indexEntry{}, false, err
+	}
+	value, err := c.opts.Index.Get(indexKey(sriString))
+	if errors.Is(err, fs.ErrNotExist) {
+		return indexEntry{}, false, nil
+	}
+	if err != nil {
+		return indexEntry{}, false, fmt.Errorf("reading index entry of %s: %w", sriString, err)
+	}
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return indexEntry{}, false, fmt.Errorf("reading index entry of %s: %w", sriString, err)
+	}
+	return entry, true, nil
+}
+
+// loadIndex returns the decoded index blob of a chunked blob.
+func (c *CAS) loadIndex(sriString string, entry indexEntry) (*index, error) {
+	if idx, ok := c.cache.get(entry.SRI); ok {
+		return idx, nil
+	}
+	body, err := c.backend.Open(entry.SRI)
+	if err != nil {
+		return nil, notExist("open", sriString, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxIndexSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: reading chunk index: %w", sriString, err)
+	}
+	if len(data) > maxIndexSize {
+		return nil, fmt.Errorf("opening %s: chunk index exceeds %d bytes", sriString, maxIndexSize)
+	}
+	idx, err := unmarshalIndex(data)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: reading chunk index: %w", sriString, err)
+	}
+	if idx.size != entry.Size {
+		return nil, fmt.Errorf("opening %s: chunk index describes %d bytes, expected %d", sriString, idx.size, entry.Size)
+	}
+	c.cache.add(entry.SRI, idx)
+	return idx, nil
+}
+
+// indexEntry points to the index blob of a chunked blob.
+type indexEntry struct {
+	// SRI is the SRI of the index blob.
+	SRI string `json:"sri"`
+	// Size is the size of the chunked blob.
+	Size int64 `json:"size"`
+}
+
+// indexKey returns the index key of the blob with the given SRI.
+func indexKey(sri string) string {
+	key := sha256.Sum256([]byte(indexKeyLabel + sri))
+	return hex.EncodeToString(key[:])
+}
+
+// notExist returns an error wrapping fs.ErrNotExist, keeping err if it already matches it.
+func notExist(op, sri string, err error) error {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: sri, Err: fs.ErrNotExist}
+}
+
+// indexCache holds recently used decoded index blobs, keyed by their SRI.
+// Index blobs are content addressed, so cached entries never become stale.
+type indexCache struct {
+	capacity int
+
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	// lru holds *cachedIndex values, ordered from most to least recently used.
+	lru *list.List
+}
+
+type cachedIndex struct {
+	sri string
+	idx *index
+}
+
+func newIndexCache(capacity int) *indexCache {
+	return &indexCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (c *indexCache) get(sri string) (*index, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.entries[sri]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedIndex).idx, true
+}
+
+func (c *indexCache) add(sri string, idx *index) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if element, ok := c.entries[sri]; ok {
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[sri] = c.lru.PushFront(&cachedIndex{sri: sri, idx: idx})
+	for c.lru.Len() > c.capacity {
+		evicted := c.lru.Remove(c.lru.Back()).(*cachedIndex)
+		delete(c.entries, evicted.sri)
+	}
+}
+
+func (c *indexCache) remove(sri string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if element, ok := c.entries[sri]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, sri)
+	}
+}
+
+// index lists the chunks of a chunked blob.
+//
+// Encoding (big endian):
+// magic (8 bytes), version (1 byte), size of the blob (8 bytes), number of chunks (4 bytes),
+// followed by every chunk as size (8 bytes), length of the SRI (2 bytes) and SRI.
+type index struct {
+	size   int64
+	chunks []chunkRef
+}
+
+// chunkRef is a chunk of a chunked blob.
+type chunkRef struct {
+	sri    string
+	offset int64
+	size   int64
+}
+
+func (idx *index) append(sri string, size int64) {
+	idx.chunks = append(idx.chunks, chunkRef{sri: sri, offset: idx.size, size: size})
+	idx.size += size
+}
+
+func (idx *index) marshal() []byte {
+	buf := make([]byte, 0, indexHeaderSize+len(idx.chunks)*(10+64))
+	buf = append(buf, magic...)
+	buf = append(buf, version)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(idx.size))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(idx.chunks)))
+	for _, ref := range idx.chunks {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(ref.size))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(ref.sri)))
+		buf = append(buf, ref.sri...)
+	}
+	return buf
+}
+
+func unmarshalIndex(data []byte) (*index, error) {
+	if len(data) < indexHeaderSize {
+		return nil, errors.New("truncated header")
+	}
+	if string(data[:len(magic)]) != magic {
+		return nil, errors.New("not a chunk index")
+	}
+	if data[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported version %d", data[len(magic)])
+	}
+	size := int64(binary.BigEndian.Uint64(data[len(magic)+1:]))
+	count := binary.BigEndian.Uint32(data[len(magic)+9:])
+	data = data[indexHeaderSize:]
+	idx := &index{}
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 10 {
+			return nil, fmt.Errorf("truncated chunk %d", i)
+		}
+		chunkSize := int64(binary.BigEndian.Uint64(data))
+		sriLen := int(binary.BigEndian.Uint16(data[8:]))
+		data = data[10:]
+		if len(data) < sriLen {
+			return nil, fmt.Errorf("truncated chunk %d", i)
+		}
+		chunkSRI := string(data[:sriLen])
+		data = data[sriLen:]
+		if chunkSize <= 0 {
+			return nil, fmt.Errorf("chunk %d has invalid size %d", i, chunkSize)
+		}
+		if _, err := sri.FromString(chunkSRI); err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", i, err)
+		}
+		idx.append(chunkSRI, chunkSize)
+	}
+	if len(data) != 0 {
+		return nil, errors.New("trailing data")
+	}
+	if idx.size != size {
+		return nil, fmt.Errorf("chunks add up to %d bytes, expected %d", idx.size, size)
+	}
+	return idx, nil
+}
+
+// chunkReader reads a range of a chunked blob, opening one chunk at a time.
+type chunkReader struct {
+	backend   api.CASReader
+	chunks    []chunkRef
+	skip      int64
+	remaining int64
+	current   io.ReadCloser
+	left      int64
+}
+
+// newChunkReader returns a reader for length bytes of the chunked blob, starting at offset.
+func newChunkReader(backend api.CASReader, idx *index, offset, length int64) *chunkReader {
+	chunks := idx.chunks
+	for len(chunks) > 0 && chunks[0].offset+chunks[0].size <= offset {
+		chunks = chunks[1:]
+	}
+	var skip int64
+	if len(chunks) > 0 {
+		skip = offset - chunks[0].offset
+	}
+	return &chunkReader{
+		backend:   backend,
+		chunks:    chunks,
+		skip:      skip,
+		remaining: length,
+	}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if c.current == nil {
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.current.Read(p)
+	c.remaining -= int64(n)
+	c.left -= int64(n)
+	if c.left == 0 {
+		closeErr := c.current.Close()
+		c.current = nil
+		if closeErr != nil {
+			return n, closeErr
+		}
+		return n, nil
+	}
+	if err == io.EOF {
+		return n, fmt.Errorf("reading chunk: %w", io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// next opens the next chunk.
+func (c *chunkReader) next() error {
+	if len(c.chunks) == 0 {
+		return fmt.Errorf("reading chunks: %w", io.ErrUnexpectedEOF)
+	}
+	ref := c.chunks[0]
+	c.chunks = c.chunks[1:]
+	var body io.ReadCloser
+	var err error
+	if c.skip > 0 {
+		body, err = cas.OpenRange(c.backend, ref.sri, c.skip, -1)
+	} else {
+		body, err = c.backend.Open(ref.sri)
+	}
+	if err != nil {
+		return fmt.Errorf("opening chunk %s: %w", ref.sri, err)
+	}
+	c.current = body
+	c.left = ref.size - c.skip
+	c.skip = 0
+	return nil
+}
+
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	err := c.current.Close()
+	c.current = nil
+	return err
+}
+
+const (
+	// DefaultMinSize is the default minimum size of a chunk.
+	DefaultMinSize = 256 << 10
+	// DefaultAvgSize is the default average size of a chunk.
+	DefaultAvgSize = 1 << 20
+	// DefaultMaxSize is the default maximum size of a chunk.
+	DefaultMaxSize = 4 << 20
+	// DefaultIndexCacheSize is the default number of decoded index blobs kept in memory.
+	DefaultIndexCacheSize = 64
+	// magic identifies index blobs.
+	magic = "AFSCHUNK"
+	// version is the version of the index format.
+	version = 1
+	// indexHeaderSize is the size of magic, version, blob size and number of chunks.
+	indexHeaderSize = len(magic) + 1 + 8 + 4
+	// maxIndexSize is the maximum size of an index blob.
+	maxIndexSize = 64 << 20
+	// indexKeyLabel separates the index keys of chunked blobs from those of other wrappers.
+	indexKeyLabel = "abstractfs chunk\x00"
+)
+
+var (
+	_ api.CAS            = (*CAS)(nil)
+	_ api.CASStater      = (*CAS)(nil)
+	_ api.CASRangeReader = (*CAS)(nil)
+	_ api.CASDeleter     = (*CAS)(nil)
+)
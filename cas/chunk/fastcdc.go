@@ -0,0 +1,137 @@
+package chunk
+
+import (
+	"io"
+	"math/bits"
+)
+
+// chunker splits a stream into content-defined chunks using the FastCDC algorithm.
+// Cut points only depend on the content, so inserting or removing bytes
+// only affects the chunks around the modification.
+type chunker struct {
+	r        io.Reader
+	min      int
+	avg      int
+	max      int
+	maskS    uint64
+	maskL    uint64
+	buf      []byte
+	start    int
+	end      int
+	eof      bool
+	readErr  error
+	finished bool
+}
+
+func newChunker(r io.Reader, min, avg, max int) *chunker {
+	avgBits := bits.Len(uint(avg)) - 1
+	return &chunker{
+		r:   r,
+		min: min,
+		avg: avg,
+		max: max,
+		// normalized chunking: a stricter mask before the average size
+		// and a looser mask after it narrow the chunk size distribution
+		maskS: highMask(avgBits + 1),
+		maskL: highMask(avgBits - 1),
+		buf:   make([]byte, max),
+	}
+}
+
+// Next returns the next chunk.
+// The returned slice is only valid until the next call to Next.
+// After the last chunk, Next returns io.EOF.
+func (c *chunker) Next() ([]byte, error) {
+	if c.finished {
+		return nil, io.EOF
+	}
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		c.finished = true
+		return nil, io.EOF
+	}
+	cut := c.cutPoint(data)
+	c.start += cut
+	return data[:cut], nil
+}
+
+// fill moves the unconsumed data to the front of the buffer and fills it up to max bytes.
+func (c *chunker) fill() error {
+	if c.readErr != nil {
+		return c.readErr
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for !c.eof && c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			c.readErr = err
+			return err
+		}
+	}
+	return nil
+}
+
+// cutPoint returns the length of the first chunk of data.
+func (c *chunker) cutPoint(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+	var hash uint64
+	i := c.min
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// highMask returns a mask with the n most significant bits set.
+// The most significant bits of the gear hash depend on the most bytes.
+func highMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// gear is the table of random values used by the rolling hash.
+// It must never change, since chunk boundaries (and therefore deduplication) depend on it.
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64 with a fixed seed
+	state := uint64(0x6162737472616374) // "abstract"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
@@ -0,0 +1,388 @@
+// Package compress implements a CAS wrapper that transparently compresses blobs.
+//
+// Trees and TreeFS keep referring to blobs by the SRI of their uncompressed content.
+// The compressed representation is stored in the backend under its own SRI
+// and found through an index, as described in the package documentation of cas.
+// Blobs that are stored raw are stored under their own SRI and shared with the backend.
+// The wrapper verifies the SRI of the uncompressed content on Write.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// Encoding is the encoding of a stored blob.
+type Encoding byte
+
+const (
+	// Raw stores the blob uncompressed.
+	Raw Encoding = 0x00
+	// Gzip compresses the blob using gzip.
+	Gzip Encoding = 0x01
+	// Flate compresses the blob using raw deflate.
+	Flate Encoding = 0x02
+)
+
+// Options are the options of a compressing CAS.
+type Options struct {
+	// Encoding is the compression used for new blobs.
+	// Raw is treated as Gzip.
+	Encoding Encoding
+	// Level is the compression level, as defined by compress/flate.
+	// Zero means flate.DefaultCompression.
+	Level int
+	// MinSize is the minimum size of a blob to be compressed.
+	// Smaller blobs are stored raw.
+	MinSize int64
+	// MaxRatio is the maximum ratio of compressed to uncompressed size
+	// of a sample of the blob for the blob to be compressed.
+	// Blobs that do not compress well (e.g. already compressed data) are stored raw.
+	// Zero means DefaultMaxRatio.
+	MaxRatio float64
+	// Index maps the SRIs of blobs to their compressed representation. Required.
+	Index api.KeyValueStore
+	// TempDir is the directory used to stage compressed blobs before they are written to the backend.
+	// If empty, the default directory for temporary files is used.
+	TempDir string
+}
+
+// CAS is a CAS that compresses blobs on Write and decompresses them on Open.
+type CAS struct {
+	backend api.CAS
+	opts    Options
+}
+
+// New creates a new compressing CAS on top of backend.
+func New(backend api.CAS, opts Options) (*CAS, error) {
+	if opts.Index == nil {
+		return nil, errors.New("creating compressing cas: no index")
+	}
+	if opts.Encoding == Raw {
+		opts.Encoding = Gzip
+	}
+	if opts.Encoding != Gzip && opts.Encoding != Flate {
+		return nil, fmt.Errorf("creating compressing cas: unknown encoding %d", opts.Encoding)
+	}
+	if opts.Level == 0 {
+		opts.Level = flate.DefaultCompression
+	}
+	if opts.Level < flate.HuffmanOnly || opts.Level > flate.BestCompression {
+		return nil, fmt.Errorf("creating compressing cas: invalid level %d", opts.Level)
+	}
+	if opts.MaxRatio == 0 {
+		opts.MaxRatio = DefaultMaxRatio
+	}
+	return &CAS{backend: backend, opts: opts}, nil
+}
+
+// Open returns a reader for the uncompressed content of the blob with the given SRI.
+func (c *CAS) Open(sri string) (io.ReadCloser, error) {
+	entry, err := c.lookup(sri)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.backend.Open(entry.SRI)
+	if err != nil {
+		return nil, notExist("open", sri, err)
+	}
+	switch entry.Encoding {
+	case Raw:
+		return body, nil
+	case Gzip:
+		decompressor, err := gzip.NewReader(bufio.NewReader(body))
+		if err != nil {
+			body.Close()
+			return nil, fmt.Errorf("opening %s: %w", sri, err)
+		}
+		return &readCloser{Reader: decompressor, closers: []io.Closer{decompressor, body}}, nil
+	case Flate:
+		decompressor := flate.NewReader(bufio.NewReader(body))
+		return &readCloser{Reader: decompressor, closers: []io.Closer{decompressor, body}}, nil
+	}
+	body.Close()
+	return nil, fmt.Errorf("opening %s: unknown encoding %d", sri, entry.Encoding)
+}
+
+// OpenRange returns a reader for length bytes of the uncompressed content of the blob
+// with the given SRI, starting at offset. A negative length reads until the end of the blob.
+// Ranges of raw blobs are read from the backend directly.
+// Compressed blobs are decompressed from the start.
+func (c *CAS) OpenRange(sri string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("opening range: negative offset")
+	}
+	entry, err := c.lookup(sri)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Encoding == Raw {
+		body, err := cas.OpenRange(c.backend, entry.SRI, offset, length)
+		if err != nil {
+			return nil, notExist("open", sri, err)
+		}
+		return body, nil
+	}
+	body, err := c.Open(sri)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil && err != io.EOF {
+		body.Close()
+		return nil, fmt.Errorf("opening range: %w", err)
+	}
+	return cas.LimitReadCloser(body, length), nil
+}
+
+// Stat returns the size of the uncompressed content of the blob with the given SRI.
+// It only queries the existence of the compressed representation.
+func (c *CAS) Stat(sri string) (int64, error) {
+	entry, err := c.lookup(sri)
+	if err != nil {
+		return 0, err
+	}
+	if has, err := cas.Has(c.backend, entry.SRI); err != nil || !has {
+		return 0, notExist("stat", sri, err)
+	}
+	return entry.Size, nil
+}
+
+// Write compresses the blob and writes it to the backend.
+// If the content does not match the SRI, the blob is not committed.
+// Blobs that already exist are written again, so that the backend
+// refreshes their modification time (see gc.Collector.GracePeriod).
+func (c *CAS) Write(sriString string, r io.Reader) error {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return err
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, -1, r)
+	if err != nil {
+		return err
+	}
+
+	// read a prefix of the blob to decide whether to compress it
+	prefix := make([]byte, c.prefixSize())
+	n, err := io.ReadFull(verifier, prefix)
+	prefix = prefix[:n]
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		// the whole blob fits into the prefix (and was verified)
+	default:
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	entry := indexEntry{SRI: sriString, Encoding: c.opts.Encoding}
+	if int64(n) < c.opts.MinSize || !c.compressible(prefix) {
+		entry.Encoding = Raw
+	}
+	content := &countingReader{Reader: io.MultiReader(bytes.NewReader(prefix), verifier)}
+
+	if entry.Encoding == Raw {
+		// the content is its own representation
+		if err := c.backend.Write(sriString, content); err != nil {
+			return fmt.Errorf("writing %s: %w", sriString, err)
+		}
+		// the backend may skip reading blobs it already has
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			return fmt.Errorf("writing %s: %w", sriString, err)
+		}
+	} else {
+		spool, err := cas.NewSpool(c.opts.TempDir, integrity.Algorithm)
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", sriString, err)
+		}
+		defer spool.Close()
+		if err := c.encode(spool, entry.Encoding, content); err != nil {
+			return fmt.Errorf("writing %s: %w", sriString, err)
+		}
+		if entry.SRI, err = spool.Commit(c.backend); err != nil {
+			return fmt.Errorf("writing %s: %w", sriString, err)
+		}
+	}
+	entry.Size = content.n
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	if err := c.opts.Index.Put(indexKey(sriString), value); err != nil {
+		return fmt.Errorf("writing %s: updating index: %w", sriString, err)
+	}
+	return nil
+}
+
+// Delete removes the representation of the blob with the given SRI from the backend.
+// The index entry is left in place: reads treat an entry without representation as missing,
+// and writing the blob again replaces it.
+func (c *CAS) Delete(sri string) error {
+	deleter, ok := c.backend.(api.CASDeleter)
+	if !ok {
+		return errors.New("deleting: backend does not support deletion")
+	}
+	entry, err := c.lookup(sri)
+	if err != nil {
+		return err
+	}
+	return deleter.Delete(entry.SRI)
+}
+
+// References returns the SRI of the compressed representation of the blob with the given SRI.
+// Blobs that are stored raw have no references.
+// It is meant to be used as gc.Collector.References when collecting garbage in the backend.
+func (c *CAS) References(sri string) ([]string, error) {
+	entry, err := c.lookup(sri)
+	if err != nil {
+		return nil, err
+	}
+	if entry.SRI == sri {
+		return nil, nil
+	}
+	return []string{entry.SRI}, nil
+}
+
+// lookup returns the index entry of the blob with the given SRI.
+func (c *CAS) lookup(sri string) (indexEntry, error) {
+	value, err := c.opts.Index.Get(indexKey(sri))
+	if err != nil {
+		return indexEntry{}, notExist("open", sri, err)
+	}
+	var entry indexEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return indexEntry{}, fmt.Errorf("reading index entry of %s: %w", sri, err)
+	}
+	return entry, nil
+}
+
+// encode writes the encoded content to w.
+func (c *CAS) encode(w io.Writer, encoding Encoding, content io.Reader) error {
+	var compressor io.WriteCloser
+	var err error
+	switch encoding {
+	case Raw:
+		_, err := io.Copy(w, content)
+		return err
+	case Gzip:
+		compressor, err = gzip.NewWriterLevel(w, c.opts.Level)
+	case Flate:
+		compressor, err = flate.NewWriter(w, c.opts.Level)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(compressor, content); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// compressible compresses a sample and compares the compression ratio to the maximum ratio.
+func (c *CAS) compressible(sample []byte) bool {
+	if len(sample) > sampleSize {
+		sample = sample[:sampleSize]
+	}
+	if len(sample) == 0 {
+		return false
+	}
+	var counter countingWriter
+	compressor, err := flate.NewWriter(&counter, c.opts.Level)
+	if err != nil {
+		return false
+	}
+	compressor.Write(sample)
+	compressor.Close()
+	return float64(counter) <= float64(len(sample))*c.opts.MaxRatio
+}
+
+func (c *CAS) prefixSize() int64 {
+	if c.opts.MinSize > sampleSize {
+		return c.opts.MinSize
+	}
+	return sampleSize
+}
+
+// readCloser closes all closers in order.
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var errs []error
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// indexEntry describes the representation of a blob.
+type indexEntry struct {
+	// SRI is the SRI of the representation.
+	SRI string `json:"sri"`
+	// Size is the size of the uncompressed content.
+	Size int64 `json:"size"`
+	// Encoding is the encoding of the representation.
+	Encoding Encoding `json:"encoding"`
+}
+
+// indexKey returns the index key of the blob with the given SRI.
+func indexKey(sri string) string {
+	key := sha256.Sum256([]byte(indexKeyLabel + sri))
+	return hex.EncodeToString(key[:])
+}
+
+// notExist returns an error wrapping fs.ErrNotExist, keeping err if it already matches it.
+func notExist(op, sri string, err error) error {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: sri, Err: fs.ErrNotExist}
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+const (
+	// DefaultMaxRatio is the default maximum compression ratio of a sample for a blob to be compressed.
+	DefaultMaxRatio = 0.9
+	// sampleSize is the size of the sample used to detect incompressible data.
+	sampleSize = 64 << 10
+	// indexKeyLabel separates the index keys of compressed blobs from those of other wrappers.
+	indexKeyLabel = "abstractfs compress\x00"
+)
+
+var (
+	_ api.CAS            = (*CAS)(nil)
+	_ api.CASStater      = (*CAS)(nil)
+	_ api.CASRangeReader = (*CAS)(nil)
+	_ api.CASDeleter     = (*CAS)(nil)
+)
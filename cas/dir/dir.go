@@ -0,0 +1,320 @@
+// Package dir implements a persistent CAS that stores blobs in a directory.
+package dir
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// CAS is a CAS implementation backed by a directory.
+// Blobs are stored in a sharded layout:
+// <root>/<hash-function>/<first-two-hex-chars>/<remaining-hex-chars>
+// Writes go to a temporary file that is only renamed into place
+// after the hash was verified. This makes it safe for concurrent writers
+// of the same SRI, both within one process and across processes sharing the directory.
+type CAS struct {
+	root string
+}
+
+// New creates a new directory CAS rooted at root.
+// The directory is created if it does not exist.
+func New(root string) (*CAS, error) {
+	if err := os.MkdirAll(filepath.Join(root, tmpDir), 0o755); err != nil {
+		return nil, fmt.Errorf("creating cas directory: %w", err)
+	}
+	return &CAS{root: root}, nil
+}
+
+// Open returns a reader for the given SRI.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) Open(sriString string) (io.ReadCloser, error) {
+	file, err := c.openFile(sriString)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// OpenRange returns a reader for length bytes of the blob with the given SRI, starting at offset.
+// A negative length reads until the end of the blob.
+func (c *CAS) OpenRange(sriString string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("opening range: negative offset")
+	}
+	file, err := c.openFile(sriString)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("opening range: %w", err)
+	}
+	return cas.LimitReadCloser(file, length), nil
+}
+
+// Stat returns the size of the blob with the given SRI.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) Stat(sriString string) (int64, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(c.blobPath(integrity))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Write writes the blob to the CAS.
+// The blob is only committed if its contents match the SRI.
+// Writing a blob that already exists updates its modification time.
+func (c *CAS) Write(sriString string, r io.Reader) error {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return err
+	}
+	target := c.blobPath(integrity)
+	if _, err := os.Stat(target); err == nil {
+		// content addressed: the blob is already present.
+		// Refresh its modification time, so that a garbage collection grace period
+		// also protects existing blobs that are referenced again.
+		now := time.Now()
+		err := os.Chtimes(target, now, now)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("refreshing blob: %w", err)
+		}
+		// deleted concurrently: write it again
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(c.root, tmpDir), "blob-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	hasher, err := integrity.Algorithm.Hasher()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), r); err != nil {
+		return fmt.Errorf("writing blob: %w", err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), integrity.Hash) {
+		return fmt.Errorf("writing blob %s: %w", sriString, sri.ErrHashMismatch)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		return fmt.Errorf("writing blob: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("writing blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing blob: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return fmt.Errorf("creating shard directory: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return fmt.Errorf("committing blob: %w", err)
+	}
+	committed = true
+	return nil
+}
+
+// List calls fn for every blob in the CAS that uses the given algorithm.
+// An empty algorithm lists blobs of all algorithms.
+// Blobs are visited in lexical order of their algorithm and hex encoded hash.
+func (c *CAS) List(algorithm string, fn func(api.BlobInfo) error) error {
+	return c.ListAfter(algorithm, "", fn)
+}
+
+// ListAfter is like List, but only visits blobs that are listed after the blob with the SRI after.
+// Directories that only contain earlier blobs are not read.
+func (c *CAS) ListAfter(algorithm, after string, fn func(api.BlobInfo) error) error {
+	listed := algorithms
+	if algorithm != "" {
+		parsed, err := sri.AlgorithmFromString(algorithm)
+		if err != nil {
+			return err
+		}
+		listed = []sri.Algorithm{parsed}
+	}
+	var cursor sri.Integrity
+	if after != "" {
+		var err error
+		if cursor, err = sri.FromString(after); err != nil {
+			return err
+		}
+	}
+	for _, algorithm := range listed {
+		afterHex := ""
+		switch {
+		case after == "":
+		case algorithmIndex(algorithm) < algorithmIndex(cursor.Algorithm):
+			continue
+		case algorithm == cursor.Algorithm:
+			afterHex = cursor.Hex()
+		}
+		if err := c.listAlgorithm(algorithm, afterHex, fn); err != nil {
+			if err == fs.SkipAll {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// listAlgorithm lists the blobs of an algorithm whose hex encoded hash sorts after afterHex.
+func (c *CAS) listAlgorithm(algorithm sri.Algorithm, afterHex string, fn func(api.BlobInfo) error) error {
+	algorithmDir := filepath.Join(c.root, string(algorithm))
+	shards, err := os.ReadDir(algorithmDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("listing blobs: %w", err)
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() || afterHex != "" && shard.Name() < afterHex[:2] {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(algorithmDir, shard.Name()))
+		if err != nil {
+			return fmt.Errorf("listing blobs: %w", err)
+		}
+		for _, entry := range entries {
+			hexHash := shard.Name() + entry.Name()
+			if hexHash <= afterHex {
+				continue
+			}
+			hash, err := hex.DecodeString(hexHash)
+			if err != nil || len(hash) != algorithm.ByteLen() || !entry.Type().IsRegular() {
+				// not a blob
+				continue
+			}
+			info, err := entry.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				// deleted concurrently
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("listing blobs: %w", err)
+			}
+			blob := api.BlobInfo{
+				SRI:     sri.Integrity{Algorithm: algorithm, Hash: hash}.String(),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			}
+			if err := fn(blob); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete removes the blob with the given SRI.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) Delete(sriString string) error {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return err
+	}
+	return os.Remove(c.blobPath(integrity))
+}
+
+// DeleteIfOlder removes the blob with the given SRI if it was last modified before cutoff.
+// The blob is moved out of place before its modification time is checked,
+// so a concurrent Write either refreshes it before the check or writes it again.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) DeleteIfOlder(sriString string, cutoff time.Time) (bool, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return false, err
+	}
+	target := c.blobPath(integrity)
+	tmp, err := os.CreateTemp(filepath.Join(c.root, tmpDir), "delete-*")
+	if err != nil {
+		return false, fmt.Errorf("creating temporary file: %w", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := os.Rename(target, tmp.Name()); err != nil {
+		return false, err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return false, fmt.Errorf("deleting blob: %w", err)
+	}
+	if info.ModTime().Before(cutoff) {
+		return true, nil
+	}
+	// written recently: put it back.
+	// If it was written again in the meantime, the contents are identical.
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return false, fmt.Errorf("restoring blob: %w", err)
+	}
+	return false, nil
+}
+
+func (c *CAS) openFile(sriString string) (*os.File, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(c.blobPath(integrity))
+}
+
+// blobPath returns the path of the blob with the given SRI.
+func (c *CAS) blobPath(integrity sri.Integrity) string {
+	hexHash := integrity.Hex()
+	return filepath.Join(c.root, string(integrity.Algorithm), hexHash[:2], hexHash[2:])
+}
+
+// algorithms are the algorithms in the order they are listed.
+var algorithms = []sri.Algorithm{sri.SHA256, sri.SHA384, sri.SHA512}
+
+// algorithmIndex returns the position of an algorithm in the listing order.
+func algorithmIndex(algorithm sri.Algorithm) int {
+	for i, listed := range algorithms {
+		if listed == algorithm {
+			return i
+		}
+	}
+	return len(algorithms)
+}
+
+// tmpDir is the directory (relative to the root) used for uncommitted writes.
+const tmpDir = "tmp"
+
+var (
+	_ api.CAS                   = (*CAS)(nil)
+	_ api.CASStater             = (*CAS)(nil)
+	_ api.CASRangeReader        = (*CAS)(nil)
+	_ api.CASLister             = (*CAS)(nil)
+	_ api.CASCursorLister       = (*CAS)(nil)
+	_ api.CASDeleter            = (*CAS)(nil)
+	_ api.CASConditionalDeleter = (*CAS)(nil)
+)
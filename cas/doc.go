@@ -0,0 +1,7 @@
+// Package cas provides helpers for working with CAS implementations,
+// such as fallbacks for the optional interfaces of the api package.
+//
+// Wrappers that store a representation of a blob (compress, encrypt and chunk)
+// record its SRI in an index and expose References, which gc.Collector needs
+// to keep the representations of live blobs.
+package cas
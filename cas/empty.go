@@ -14,4 +14,31 @@ func (c *EmptyCAS) Open(_ string) (io.ReadCloser, error) {
 	return nil, os.ErrNotExist
 }
 
-var _ api.CASReader = (*EmptyCAS)(nil)
+func (c *EmptyCAS) Stat(_ string) (int64, error) {
+	return 0, os.ErrNotExist
+}
+
+func (c *EmptyCAS) OpenRange(_ string, _, _ int64) (io.ReadCloser, error) {
+	return nil, os.ErrNotExist
+}
+
+func (c *EmptyCAS) List(_ string, _ func(api.BlobInfo) error) error {
+	return nil
+}
+
+func (c *EmptyCAS) ListAfter(_, _ string, _ func(api.BlobInfo) error) error {
+	return nil
+}
+
+func (c *EmptyCAS) Delete(_ string) error {
+	return os.ErrNotExist
+}
+
+var (
+	_ api.CASReader       = (*EmptyCAS)(nil)
+	_ api.CASStater       = (*EmptyCAS)(nil)
+	_ api.CASRangeReader  = (*EmptyCAS)(nil)
+	_ api.CASLister       = (*EmptyCAS)(nil)
+	_ api.CASCursorLister = (*EmptyCAS)(nil)
+	_ api.CASDeleter      = (*EmptyCAS)(nil)
+)
@@ -0,0 +1,435 @@
+// Package encrypt implements a CAS wrapper that encrypts blobs using convergent encryption.
+//
+// Every blob is encrypted with AES-GCM under a key derived from a master secret and the SRI of the blob.
+// Identical blobs therefore result in identical ciphertexts, so deduplication in the backend still works.
+// The ciphertext is stored in the backend under its own SRI and found through an index,
+// as described in the package documentation of cas.
+// Index keys are derived from the master secret and the SRI, and index entries are encrypted,
+// so neither the backend nor the index learn the SRIs of the stored blobs.
+//
+// Blobs are encrypted in segments, so that they can be streamed.
+// Every segment is authenticated and bound to its position, and the last segment is marked,
+// so reordering, truncation and modification of the ciphertext are detected on Open.
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// Options are the options of an encrypting CAS.
+type Options struct {
+	// Index maps the SRIs of blobs to the SRIs of their ciphertexts. Required.
+	Index api.KeyValueStore
+	// TempDir is the directory used to stage ciphertexts before they are written to the backend.
+	// If empty, the default directory for temporary files is used.
+	TempDir string
+}
+
+// CAS is a CAS that encrypts blobs on Write and decrypts and authenticates them on Open.
+type CAS struct {
+	backend   api.CAS
+	masterKey []byte
+	opts      Options
+}
+
+// New creates a new encrypting CAS on top of backend.
+// The master key must be at least 32 bytes long and should be chosen uniformly at random.
+func New(backend api.CAS, masterKey []byte, opts Options) (*CAS, error) {
+	if len(masterKey) < minMasterKeySize {
+		return nil, fmt.Errorf("creating encrypting cas: master key must be at least %d bytes", minMasterKeySize)
+	}
+	if opts.Index == nil {
+		return nil, errors.New("creating encrypting cas: no index")
+	}
+	return &CAS{
+		backend:   backend,
+		masterKey: bytes.Clone(masterKey),
+		opts:      opts,
+	}, nil
+}
+
+// Open returns a reader for the decrypted blob with the given SRI.
+// If the stored blob or its index entry was modified, reading fails with an error wrapping ErrTampered.
+func (c *CAS) Open(sriString string) (io.ReadCloser, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := c.lookup(integrity)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.backend.Open(stored)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(integrity)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	buffered := bufio.NewReader(body)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(buffered, header); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("opening %s: reading header: %w", sriString, tamperedIfEOF(err))
+	}
+	if !bytes.Equal(header, newHeader()) {
+		body.Close()
+		return nil, fmt.Errorf("opening %s: invalid header: %w", sriString, ErrTampered)
+	}
+	return &decryptingReader{
+		aead:   aead,
+		ad:     associatedData(header, integrity),
+		r:      buffered,
+		closer: body,
+		sealed: make([]byte, segmentSize+aead.Overhead()),
+	}, nil
+}
+
+// Stat returns the size of the decrypted blob with the given SRI.
+func (c *CAS) Stat(sriString string) (int64, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return 0, err
+	}
+	stored, err := c.lookup(integrity)
+	if err != nil {
+		return 0, err
+	}
+	storedSize, err := cas.Stat(c.backend, stored)
+	if err != nil {
+		return 0, err
+	}
+	return plaintextSize(storedSize)
+}
+
+// Write encrypts the blob and writes it to the backend.
+// If the content does not match the SRI, the blob is not committed.
+// Blobs that already exist are written again, so that the backend
+// refreshes their modification time (see gc.Collector.GracePeriod).
+func (c *CAS) Write(sriString string, r io.Reader) error {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return err
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, -1, r)
+	if err != nil {
+		return err
+	}
+	aead, err := c.aead(integrity)
+	if err != nil {
+		return err
+	}
+
+	spool, err := cas.NewSpool(c.opts.TempDir, sri.SHA256)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	defer spool.Close()
+	if err := encrypt(spool, aead, integrity, verifier); err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	stored, err := spool.Commit(c.backend)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	entry, err := c.sealIndexEntry(integrity, stored)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	if err := c.opts.Index.Put(c.indexKey(integrity), entry); err != nil {
+		return fmt.Errorf("writing %s: updating index: %w", sriString, err)
+	}
+	return nil
+}
+
+// Delete removes the ciphertext of the blob with the given SRI from the backend.
+func (c *CAS) Delete(sriString string) error {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return err
+	}
+	deleter, ok := c.backend.(api.CASDeleter)
+	if !ok {
+		return errors.New("deleting: backend does not support deletion")
+	}
+	stored, err := c.lookup(integrity)
+	if err != nil {
+		return err
+	}
+	return deleter.Delete(stored)
+}
+
+// References returns the SRI of the ciphertext of the blob with the given SRI.
+// It is meant to be used as gc.Collector.References when collecting garbage in the backend.
+func (c *CAS) References(sriString string) ([]string, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := c.lookup(integrity)
+	if err != nil {
+		return nil, err
+	}
+	return []string{stored}, nil
+}
+
+// lookup returns the SRI of the ciphertext of a blob.
+func (c *CAS) lookup(integrity sri.Integrity) (string, error) {
+	entry, err := c.opts.Index.Get(c.indexKey(integrity))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", &fs.PathError{Op: "open", Path: integrity.String(), Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return "", err
+	}
+	return c.openIndexEntry(integrity, entry)
+}
+
+// encrypt writes the header and the encrypted segments of r to w.
+// The last segment is only sealed once r returned io.EOF,
+// so a failing read (e.g. a hash mismatch) never results in a complete ciphertext.
+func encrypt(w io.Writer, aead cipher.AEAD, integrity sri.Integrity, r io.Reader) error {
+	header := newHeader()
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	ad := associatedData(header, integrity)
+	current := make([]byte, segmentSize)
+	next := make([]byte, segmentSize)
+	n, err := readSegment(r, current)
+	if err != nil {
+		return err
+	}
+	sealed := make([]byte, 0, segmentSize+aead.Overhead())
+	for counter := uint64(0); ; counter++ {
+		var nextN int
+		if n == segmentSize {
+			if nextN, err = readSegment(r, next); err != nil {
+				return err
+			}
+		}
+		last := nextN == 0
+		sealed = aead.Seal(sealed[:0], nonce(counter, last), current[:n], ad)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		current, next = next, current
+		n = nextN
+	}
+}
+
+// readSegment reads up to len(buf) bytes. It only returns fewer bytes at the end of r.
+func readSegment(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	return n, err
+}
+
+// decryptingReader decrypts and authenticates segments while reading.
+type decryptingReader struct {
+	aead    cipher.AEAD
+	ad      []byte
+	r       *bufio.Reader
+	closer  io.Closer
+	sealed  []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.nextSegment()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) nextSegment() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch err {
+	case nil, io.ErrUnexpectedEOF:
+	case io.EOF:
+		// the stream ended before the last segment
+		return fmt.Errorf("decrypting: truncated ciphertext: %w", ErrTampered)
+	default:
+		return fmt.Errorf("decrypting: %w", err)
+	}
+	last := false
+	if n < len(d.sealed) {
+		last = true
+	} else if _, err := d.r.Peek(1); err == io.EOF {
+		last = true
+	}
+	plain, err := d.aead.Open(d.sealed[:0], nonce(d.counter, last), d.sealed[:n], d.ad)
+	if err != nil {
+		return fmt.Errorf("decrypting segment %d: %w", d.counter, ErrTampered)
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.closer.Close()
+}
+
+// aead returns the AES-GCM instance for the blob.
+func (c *CAS) aead(integrity sri.Integrity) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.derive(labelContentKey, integrity))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// indexKey returns the opaque index key of the blob.
+func (c *CAS) indexKey(integrity sri.Integrity) string {
+	return hex.EncodeToString(c.derive(labelIndexKey, integrity))
+}
+
+// sealIndexEntry encrypts the SRI of the ciphertext of a blob.
+// Every key only seals a single value, so a constant nonce is sufficient.
+func (c *CAS) sealIndexEntry(integrity sri.Integrity, stored string) ([]byte, error) {
+	aead, err := c.indexAEAD(integrity)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, nonceSize), []byte(stored), []byte(c.indexKey(integrity))), nil
+}
+
+// openIndexEntry decrypts and authenticates the SRI of the ciphertext of a blob.
+func (c *CAS) openIndexEntry(integrity sri.Integrity, entry []byte) (string, error) {
+	aead, err := c.indexAEAD(integrity)
+	if err != nil {
+		return "", err
+	}
+	stored, err := aead.Open(nil, make([]byte, nonceSize), entry, []byte(c.indexKey(integrity)))
+	if err != nil {
+		return "", fmt.Errorf("opening index entry of %s: %w", integrity, ErrTampered)
+	}
+	return string(stored), nil
+}
+
+// indexAEAD returns the AES-GCM instance for the index entry of the blob.
+func (c *CAS) indexAEAD(integrity sri.Integrity) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.derive(labelIndexEntryKey, integrity))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// derive derives a 32 byte value from the master key, a label and the SRI.
+func (c *CAS) derive(label string, integrity sri.Integrity) []byte {
+	mac := hmac.New(sha256.New, c.masterKey)
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write([]byte(integrity.String()))
+	return mac.Sum(nil)
+}
+
+// nonce returns the nonce of a segment.
+// Every key is only used for a single plaintext, so a counter is sufficient.
+// The last byte marks the final segment to detect truncation.
+func nonce(counter uint64, last bool) []byte {
+	n := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(n, counter)
+	if last {
+		n[nonceSize-1] = 1
+	}
+	return n
+}
+
+func newHeader() []byte {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	header[len(magic)] = version
+	binary.BigEndian.PutUint32(header[len(magic)+1:], segmentSize)
+	return header
+}
+
+func associatedData(header []byte, integrity sri.Integrity) []byte {
+	return append(bytes.Clone(header), integrity.String()...)
+}
+
+// plaintextSize computes the size of the plaintext from the size of the stored blob.
+func plaintextSize(storedSize int64) (int64, error) {
+	sealedSegmentSize := int64(segmentSize + tagSize)
+	payload := storedSize - int64(headerSize)
+	if payload < tagSize {
+		return 0, fmt.Errorf("stored blob too small: %w", ErrTampered)
+	}
+	segments := (payload + sealedSegmentSize - 1) / sealedSegmentSize
+	return payload - segments*tagSize, nil
+}
+
+func tamperedIfEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTampered
+	}
+	return err
+}
+
+// ErrTampered is returned when a stored blob fails authentication.
+var ErrTampered = errors.New("blob authentication failed")
+
+const (
+	// magic identifies encrypted blobs.
+	magic = "AFSE"
+	// version is the version of the format.
+	version = 1
+	// headerSize is the size of magic, version and segment size.
+	headerSize = len(magic) + 1 + 4
+	// segmentSize is the size of a plaintext segment.
+	segmentSize = 64 << 10
+	// nonceSize is the size of the AES-GCM nonce.
+	nonceSize = 12
+	// tagSize is the size of the AES-GCM authentication tag.
+	tagSize = 16
+	// minMasterKeySize is the minimum size of the master key.
+	minMasterKeySize = 32
+	// labelContentKey is used to derive the encryption key of a blob.
+	labelContentKey = "abstractfs cas encryption key"
+	// labelIndexKey is used to derive the index key of a blob.
+	labelIndexKey = "abstractfs cas index key"
+	// labelIndexEntryKey is used to derive the encryption key of the index entry of a blob.
+	labelIndexEntryKey = "abstractfs cas index entry key"
+)
+
+var (
+	_ api.CAS        = (*CAS)(nil)
+	_ api.CASStater  = (*CAS)(nil)
+	_ api.CASDeleter = (*CAS)(nil)
+)
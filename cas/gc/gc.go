@@ -0,0 +1,189 @@
+// Package gc implements mark-and-sweep garbage collection for CAS implementations.
+//
+// The payloads of all regular files in the live trees are marked,
+// together with the blobs they reference (e.g. the chunks of a chunked blob).
+// All blobs in the CAS that are not marked are swept (deleted).
+package gc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/traverse"
+)
+
+// CAS is a CAS that can enumerate and delete blobs.
+type CAS interface {
+	api.CASLister
+	api.CASDeleter
+}
+
+// Collector removes blobs that are not referenced by any live tree.
+type Collector struct {
+	// DryRun reports the blobs that would be deleted without deleting them.
+	DryRun bool
+	// GracePeriod protects recently written blobs from being deleted,
+	// even if they are unreferenced. This avoids deleting blobs of trees
+	// that are being uploaded concurrently and are not yet marked as live.
+	// It relies on the CAS refreshing the modification time when an existing blob
+	// is written again (as dir.CAS and memory.CAS do), so that an upload reusing an old,
+	// unreferenced blob protects it as well.
+	// Blobs without a modification time are always retained if a grace period is set.
+	// If the CAS implements api.CASConditionalDeleter, the modification time is checked again
+	// when the blob is deleted, so that blobs written again after they were listed are retained.
+	// Otherwise, such blobs may be deleted.
+	GracePeriod time.Duration
+	// References returns the SRIs of the blobs referenced by the blob with the given SRI,
+	// such as the chunks of a blob stored by chunk.CAS (see chunk.CAS.References).
+	// Blobs referenced by live blobs are live as well.
+	// If nil, blobs are assumed to not reference other blobs.
+	References func(sri string) ([]string, error)
+
+	cas  CAS
+	live map[string]struct{}
+}
+
+// New creates a new Collector for the given CAS.
+func New(cas CAS) *Collector {
+	return &Collector{
+		cas:  cas,
+		live: make(map[string]struct{}),
+	}
+}
+
+// MarkTree marks the payloads of all regular files in the tree as live.
+func (c *Collector) MarkTree(tree api.Tree) {
+	if tree.Root == nil {
+		return
+	}
+	visit := func(_ string, node *api.Node) {
+		c.markStat(node.Stat)
+	}
+	traverse.BFS(tree.Root, visit)
+}
+
+// MarkFlat marks the payloads of all regular files in the flat tree as live.
+func (c *Collector) MarkFlat(flat api.Flat) {
+	for _, stat := range flat.Files {
+		c.markStat(stat)
+	}
+}
+
+// Mark marks a single SRI as live.
+func (c *Collector) Mark(sri string) {
+	c.live[sri] = struct{}{}
+}
+
+func (c *Collector) markStat(stat api.Stat) {
+	if stat.Kind != api.KindRegular || stat.Payload == "" {
+		return
+	}
+	c.Mark(stat.Payload)
+}
+
+// Sweep deletes all blobs that were not marked as live.
+// Deletion errors do not stop the sweep. They are collected and returned together.
+func (c *Collector) Sweep() (Report, error) {
+	var report Report
+	if err := c.markReferences(); err != nil {
+		return report, err
+	}
+	var candidates []api.BlobInfo
+	cutoff := time.Now().Add(-c.GracePeriod)
+	err := c.cas.List("", func(blob api.BlobInfo) error {
+		report.Scanned++
+		if _, ok := c.live[blob.SRI]; ok {
+			report.Live++
+			return nil
+		}
+		if c.GracePeriod > 0 && (blob.ModTime.IsZero() || blob.ModTime.After(cutoff)) {
+			report.Retained++
+			return nil
+		}
+		candidates = append(candidates, blob)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("listing blobs: %w", err)
+	}
+
+	var deleteErrs []error
+	for _, blob := range candidates {
+		if !c.DryRun {
+			deleted, err := c.delete(blob.SRI, cutoff)
+			if errors.Is(err, fs.ErrNotExist) {
+				// deleted concurrently
+				continue
+			}
+			if err != nil {
+				deleteErrs = append(deleteErrs, fmt.Errorf("deleting %s: %w", blob.SRI, err))
+				continue
+			}
+			if !deleted {
+				// written again since it was listed
+				report.Retained++
+				continue
+			}
+		}
+		report.Deleted = append(report.Deleted, blob)
+		report.BytesReclaimed += blob.Size
+	}
+	return report, errors.Join(deleteErrs...)
+}
+
+// delete removes the blob with the given SRI.
+// With a grace period, blobs modified after cutoff are kept if the CAS can check this atomically.
+func (c *Collector) delete(sri string, cutoff time.Time) (bool, error) {
+	if deleter, ok := c.cas.(api.CASConditionalDeleter); ok && c.GracePeriod > 0 {
+		return deleter.DeleteIfOlder(sri, cutoff)
+	}
+	return true, c.cas.Delete(sri)
+}
+
+// markReferences marks all blobs that are transitively referenced by live blobs.
+func (c *Collector) markReferences() error {
+	if c.References == nil {
+		return nil
+	}
+	pending := make([]string, 0, len(c.live))
+	for sri := range c.live {
+		pending = append(pending, sri)
+	}
+	for len(pending) > 0 {
+		sri := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		refs, err := c.References(sri)
+		if errors.Is(err, fs.ErrNotExist) {
+			// live, but not stored
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("resolving references of %s: %w", sri, err)
+		}
+		for _, ref := range refs {
+			if _, ok := c.live[ref]; ok {
+				continue
+			}
+			c.Mark(ref)
+			pending = append(pending, ref)
+		}
+	}
+	return nil
+}
+
+// Report is the result of a sweep.
+type Report struct {
+	// Scanned is the number of blobs in the CAS.
+	Scanned int
+	// Live is the number of blobs that are referenced by a live tree.
+	Live int
+	// Retained is the number of unreferenced blobs that were kept because of the grace period.
+	Retained int
+	// Deleted are the blobs that were deleted (or would have been deleted in a dry run).
+	Deleted []api.BlobInfo
+	// BytesReclaimed is the total size of the deleted blobs.
+	BytesReclaimed int64
+}
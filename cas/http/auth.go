@@ -0,0 +1,407 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+)
+
+// Permission is a set of operations a caller may perform.
+type Permission uint8
+
+const (
+	// PermissionRead allows downloading blobs and querying their existence.
+	PermissionRead Permission = 1 << iota
+	// PermissionWrite allows uploading and deleting blobs.
+	PermissionWrite
+	// PermissionReadWrite allows all operations.
+	PermissionReadWrite = PermissionRead | PermissionWrite
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// ID identifies the caller. Quotas are tracked per ID.
+	ID string
+	// Permissions are the operations the caller may perform.
+	Permissions Permission
+	// Quota limits the usage of the caller.
+	// The zero value means no limit.
+	Quota Quota
+}
+
+// Quota limits the number of requests and transferred bytes of a principal within a time window.
+type Quota struct {
+	// Requests is the maximum number of requests. Zero means no limit.
+	Requests int64
+	// Bytes is the maximum number of request and response body bytes. Zero means no limit.
+	// It is enforced while bodies are transferred: uploads exceeding it fail
+	// and downloads exceeding it are cut off.
+	Bytes int64
+	// Window is the duration after which the usage is reset.
+	// Zero means the usage is never reset.
+	Window time.Duration
+}
+
+// Authorizer authenticates requests.
+type Authorizer interface {
+	// Authorize returns the principal that sent the request.
+	// If the request does not carry credentials for this Authorizer, it returns ErrNoCredentials,
+	// so that the next Authorizer is tried.
+	// Any other error rejects the request.
+	Authorize(req *http.Request) (Principal, error)
+}
+
+// AuthOptions are the options of an authenticating handler.
+type AuthOptions struct {
+	// Authorizers are tried in order until one of them authenticates the request.
+	Authorizers []Authorizer
+	// Anonymous are the permissions of requests without credentials.
+	// The zero value rejects such requests.
+	Anonymous Permission
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// NewAuthHandler wraps a handler (e.g. a Handler, OCIHandler or BazelHandler) with authentication and authorization.
+// GET and HEAD requests as well as existence queries require PermissionRead.
+// All other requests, and all requests concerning upload sessions, require PermissionWrite.
+// Requests without valid credentials are rejected with 401 Unauthorized,
+// requests lacking the required permission with 403 Forbidden
+// and requests exceeding the quota of their principal with 429 Too Many Requests.
+func NewAuthHandler(next http.Handler, opts AuthOptions) http.Handler {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &authHandler{
+		next:  next,
+		opts:  opts,
+		usage: make(map[string]*usage),
+	}
+}
+
+type authHandler struct {
+	next http.Handler
+	opts AuthOptions
+
+	mux   sync.Mutex
+	usage map[string]*usage
+}
+
+func (a *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	principal, err := a.authorize(req)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="abstractfs"`)
+		writeErrorWithStatus(w, http.StatusUnauthorized, fmt.Errorf("%w: %w", api.ErrUnauthorized, err))
+		return
+	}
+	required := requiredPermission(req)
+	if principal.Permissions&required != required {
+		writeErrorWithStatus(w, http.StatusForbidden, fmt.Errorf("%w: permission denied", api.ErrUnauthorized))
+		return
+	}
+	u, ok := a.acquire(principal, req.ContentLength)
+	if !ok {
+		writeError(w, errQuotaExceeded)
+		return
+	}
+	if u == nil || principal.Quota.Bytes == 0 {
+		a.next.ServeHTTP(w, req)
+		return
+	}
+	m := &meter{mux: &a.mux, usage: u, limit: principal.Quota.Bytes}
+	req.Body = &meteredBody{ReadCloser: req.Body, meter: m}
+	a.next.ServeHTTP(&meteredResponseWriter{ResponseWriter: w, meter: m}, req)
+}
+
+// authorize returns the principal of the request.
+func (a *authHandler) authorize(req *http.Request) (Principal, error) {
+	for _, authorizer := range a.opts.Authorizers {
+		principal, err := authorizer.Authorize(req)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return Principal{}, err
+		}
+		return principal, nil
+	}
+	if a.opts.Anonymous == 0 {
+		return Principal{}, ErrNoCredentials
+	}
+	return Principal{Permissions: a.opts.Anonymous}, nil
+}
+
+// acquire counts a request against the quota of the principal.
+// It returns false if the quota is exhausted,
+// and nil usage if the principal has no quota.
+func (a *authHandler) acquire(principal Principal, contentLength int64) (*usage, bool) {
+	quota := principal.Quota
+	if quota.Requests == 0 && quota.Bytes == 0 {
+		return nil, true
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	now := a.opts.Now()
+	u, ok := a.usage[principal.ID]
+	if !ok || (quota.Window > 0 && now.Sub(u.start) >= quota.Window) {
+		u = &usage{start: now}
+		a.usage[principal.ID] = u
+	}
+	if quota.Requests > 0 && u.requests >= quota.Requests {
+		return nil, false
+	}
+	if quota.Bytes > 0 && (u.bytes >= quota.Bytes || (contentLength > 0 && u.bytes+contentLength > quota.Bytes)) {
+		return nil, false
+	}
+	u.requests++
+	return u, true
+}
+
+// usage is the usage of a principal in the current quota window.
+type usage struct {
+	start    time.Time
+	requests int64
+	bytes    int64
+}
+
+// meter charges transferred bytes against the byte quota of a principal while they are transferred,
+// so that streamed and concurrent requests cannot exceed the quota together.
+type meter struct {
+	// mux guards usage.
+	mux   *sync.Mutex
+	usage *usage
+	limit int64
+}
+
+// reserve charges up to n bytes and returns the number of bytes charged.
+func (m *meter) reserve(n int64) int64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if remaining := m.limit - m.usage.bytes; n > remaining {
+		n = remaining
+	}
+	if n < 0 {
+		n = 0
+	}
+	m.usage.bytes += n
+	return n
+}
+
+// release refunds n reserved bytes that were not transferred.
+func (m *meter) release(n int64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.usage.bytes -= n
+}
+
+// meteredBody is a request body that fails with errQuotaExceeded once the byte quota is exhausted.
+type meteredBody struct {
+	io.ReadCloser
+	meter *meter
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	allowed := b.meter.reserve(int64(len(p)))
+	if allowed == 0 && len(p) > 0 {
+		return 0, errQuotaExceeded
+	}
+	n, err := b.ReadCloser.Read(p[:allowed])
+	b.meter.release(allowed - int64(n))
+	return n, err
+}
+
+// meteredResponseWriter is a response writer that truncates the response
+// and fails with errQuotaExceeded once the byte quota is exhausted.
+type meteredResponseWriter struct {
+	http.ResponseWriter
+	meter *meter
+}
+
+func (w *meteredResponseWriter) Write(p []byte) (int, error) {
+	allowed := w.meter.reserve(int64(len(p)))
+	n, err := w.ResponseWriter.Write(p[:allowed])
+	w.meter.release(allowed - int64(n))
+	if err == nil && n < len(p) {
+		err = errQuotaExceeded
+	}
+	return n, err
+}
+
+// requiredPermission returns the permission required for the request.
+// Upload sessions belong to writers, so all requests concerning them require write permission.
+func requiredPermission(req *http.Request) Permission {
+	if strings.Contains(req.URL.Path, uploadsPath) || strings.Contains(req.URL.Path, ociUploadsPath) {
+		return PermissionWrite
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return PermissionRead
+	case http.MethodPost:
+		if strings.HasSuffix(req.URL.Path, missingPath) {
+			// existence queries do not modify the CAS
+			return PermissionRead
+		}
+	}
+	return PermissionWrite
+}
+
+// TokenAuthorizer authenticates requests using static bearer tokens.
+type TokenAuthorizer struct {
+	// tokens maps the SHA-256 hashes of the tokens to their principals,
+	// so that lookups do not leak the tokens through timing.
+	tokens map[[sha256.Size]byte]Principal
+}
+
+// NewTokenAuthorizer creates a new TokenAuthorizer for the given tokens and their principals.
+// Principals without an ID are identified by a hash of their token.
+func NewTokenAuthorizer(tokens map[string]Principal) *TokenAuthorizer {
+	hashed := make(map[[sha256.Size]byte]Principal, len(tokens))
+	for token, principal := range tokens {
+		sum := sha256.Sum256([]byte(token))
+		if principal.ID == "" {
+			principal.ID = "token:" + hex.EncodeToString(sum[:8])
+		}
+		hashed[sum] = principal
+	}
+	return &TokenAuthorizer{tokens: hashed}
+}
+
+// Authorize authenticates the bearer token in the Authorization header.
+func (t *TokenAuthorizer) Authorize(req *http.Request) (Principal, error) {
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return Principal{}, ErrNoCredentials
+	}
+	principal, ok := t.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Principal{}, fmt.Errorf("invalid token: %w", ErrInvalidCredentials)
+	}
+	return principal, nil
+}
+
+// URLSigner creates and verifies HMAC-signed URLs that grant temporary access to a single path.
+// A URL signed for GET also allows HEAD. Other methods must match exactly.
+// The signature covers the method, the path and all query parameters,
+// so that parameters cannot be added to or changed in a signed URL.
+// The same URLSigner (or one with the same key) is used by clients to sign URLs
+// and as an Authorizer by the server.
+type URLSigner struct {
+	// Key is the secret key used to sign URLs.
+	Key []byte
+	// Prefix is the escaped path prefix under which the handler is mounted, e.g. with http.StripPrefix.
+	// Signatures cover the path without Prefix, so that a URL signed for the public path
+	// is accepted whether the Authorizer sees the request before or after the prefix was stripped.
+	// Sign rejects URLs whose path does not start with Prefix.
+	Prefix string
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Sign returns rawURL with an expiry time and a signature for the given method added to its query.
+func (s *URLSigner) Sign(rawURL, method string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("signing url: %w", err)
+	}
+	if !strings.HasPrefix(u.EscapedPath(), s.Prefix) {
+		return "", fmt.Errorf("signing url: path %q is not under prefix %q", u.EscapedPath(), s.Prefix)
+	}
+	query := u.Query()
+	query.Del(signatureParam)
+	query.Set(expiresParam, strconv.FormatInt(expires.Unix(), 10))
+	signature := s.signature(signedMethod(method), s.relativePath(u.EscapedPath()), query)
+	query.Set(signatureParam, signature)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Authorize verifies the signature and expiry time of a signed URL.
+// The principal only has the permission required for the signed method.
+func (s *URLSigner) Authorize(req *http.Request) (Principal, error) {
+	query := req.URL.Query()
+	signature := query.Get(signatureParam)
+	if signature == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	query.Del(signatureParam)
+	expires, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid expiry time: %w", ErrInvalidCredentials)
+	}
+	want := s.signature(signedMethod(req.Method), s.relativePath(req.URL.EscapedPath()), query)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return Principal{}, fmt.Errorf("invalid signature: %w", ErrInvalidCredentials)
+	}
+	if s.now().Unix() > expires {
+		return Principal{}, fmt.Errorf("signed url expired: %w", ErrInvalidCredentials)
+	}
+	return Principal{
+		ID:          "signed:" + req.URL.Path,
+		Permissions: requiredPermission(req),
+	}, nil
+}
+
+// signature returns the signature of a request.
+// The query (without the signature) is encoded canonically, sorted by key.
+func (s *URLSigner) signature(method, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(method + "\n" + path + "\n" + query.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// relativePath returns the escaped path without Prefix.
+func (s *URLSigner) relativePath(path string) string {
+	return strings.TrimPrefix(path, s.Prefix)
+}
+
+func (s *URLSigner) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// signedMethod returns the method a signature is bound to.
+func signedMethod(method string) string {
+	if method == http.MethodHead {
+		return http.MethodGet
+	}
+	return strings.ToUpper(method)
+}
+
+var (
+	// ErrNoCredentials is returned by an Authorizer if the request does not carry credentials for it.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned by an Authorizer if the credentials of the request are invalid or expired.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// errQuotaExceeded is returned if a request exceeds the quota of its principal.
+	errQuotaExceeded = fmt.Errorf("%w: quota exceeded", api.ErrUnavailable)
+)
+
+const (
+	// expiresParam is the query parameter of a signed URL holding the expiry time as unix timestamp.
+	expiresParam = "expires"
+	// signatureParam is the query parameter of a signed URL holding the signature.
+	signatureParam = "signature"
+)
+
+var (
+	_ Authorizer = (*TokenAuthorizer)(nil)
+	_ Authorizer = (*URLSigner)(nil)
+)
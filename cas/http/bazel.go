@@ -0,0 +1,162 @@
+package http
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// ActionCache is a key-value store for the action cache namespace (/ac/) of the Bazel HTTP remote cache.
+// Implementations are provided by the actioncache package.
+type ActionCache interface {
+	// Get returns the value stored under key.
+	// If the key does not exist, it returns an error wrapping fs.ErrNotExist.
+	Get(key string) ([]byte, error)
+	// Put stores value under key, replacing any previous value.
+	Put(key string, value []byte) error
+}
+
+// BazelHandler serves the Bazel HTTP remote cache protocol on top of a CAS and an action cache.
+//
+// It implements the following endpoints:
+//
+//	GET/HEAD/PUT /cas/<sha256-hex>  blobs, stored in the CAS
+//	GET/HEAD/PUT /ac/<sha256-hex>   action results, stored in the action cache
+//
+// To serve the cache below a path prefix, use http.StripPrefix.
+type BazelHandler struct {
+	blobs    *Handler
+	actions  ActionCache
+	observer *observer
+}
+
+// NewBazelHandler creates a new BazelHandler.
+// Uploads of blobs are verified against their digest before they are committed to the CAS.
+func NewBazelHandler(cas api.CAS, actions ActionCache, opts HandlerOptions) *BazelHandler {
+	return &BazelHandler{
+		blobs:    &Handler{cas: cas, opts: opts},
+		actions:  actions,
+		observer: newObserver("bazel", opts),
+	}
+}
+
+func (h *BazelHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.observer.serve(w, req, h.serve)
+}
+
+func (h *BazelHandler) serve(w http.ResponseWriter, req *http.Request) {
+	namespace, key, err := parseBazelPath(req.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	switch namespace {
+	case bazelCAS:
+		h.serveCAS(w, req, key)
+	case bazelAC:
+		h.serveAC(w, req, key)
+	}
+}
+
+func (h *BazelHandler) serveCAS(w http.ResponseWriter, req *http.Request, hash []byte) {
+	integrity := sri.Integrity{Algorithm: sri.SHA256, Hash: hash}
+	switch req.Method {
+	case http.MethodGet:
+		h.blobs.serveBlob(w, req, integrity)
+	case http.MethodHead:
+		size, err := cas.Stat(h.blobs.cas, integrity.String())
+		if errors.Is(err, fs.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			recordError(w, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		h.blobs.putBlob(w, req, integrity)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *BazelHandler) serveAC(w http.ResponseWriter, req *http.Request, hash []byte) {
+	key := hex.EncodeToString(hash)
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		value, err := h.actions.Get(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writePlainError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(value)
+		}
+	case http.MethodPut:
+		if req.ContentLength > maxActionResultSize {
+			http.Error(w, "action result too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		value, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxActionResultSize))
+		if err != nil {
+			writePlainError(w, errorStatus(err), err)
+			return
+		}
+		if err := h.actions.Put(key, value); err != nil {
+			writePlainError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// bazelNamespace is a namespace of the Bazel HTTP remote cache.
+type bazelNamespace int
+
+const (
+	bazelCAS bazelNamespace = iota
+	bazelAC
+)
+
+// parseBazelPath parses a path of the form /cas/<sha256-hex> or /ac/<sha256-hex>.
+func parseBazelPath(path string) (bazelNamespace, []byte, error) {
+	var namespace bazelNamespace
+	var encoded string
+	switch {
+	case strings.HasPrefix(path, "/cas/"):
+		namespace, encoded = bazelCAS, path[len("/cas/"):]
+	case strings.HasPrefix(path, "/ac/"):
+		namespace, encoded = bazelAC, path[len("/ac/"):]
+	default:
+		return 0, nil, errors.New("invalid path: must have format /cas/<sha256-hex> or /ac/<sha256-hex>")
+	}
+	hash, err := hex.DecodeString(encoded)
+	if err != nil || len(hash) != sri.SHA256.ByteLen() {
+		return 0, nil, fmt.Errorf("invalid path: %q is not a sha256 hex digest", encoded)
+	}
+	return namespace, hash, nil
+}
+
+// maxActionResultSize is the maximum size of an action result.
+const maxActionResultSize = 16 << 20
@@ -0,0 +1,659 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// Client is a CAS http client.
+// It implements the client side of the CAS http protocol
+// and can be used with any server that uses Handler.
+// Errors reported by the server are mapped back to the errors of the api package,
+// so callers can check them with errors.Is.
+type Client struct {
+	// HTTPClient is the http client used to send requests.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// Retries is the number of times a request is retried
+	// after a network error or a 5xx / 429 response.
+	Retries int
+	// Backoff is the delay before the first retry.
+	// It is doubled after every retry.
+	Backoff time.Duration
+	// Timeout is the timeout for a single request,
+	// including reading the response body.
+	// Zero means no timeout.
+	Timeout time.Duration
+	// Token is sent as bearer token in the Authorization header of every request.
+	// If empty, requests are sent without credentials.
+	Token string
+	// UploadChunkSize enables resumable uploads.
+	// If greater than zero, Write uploads blobs in an upload session in chunks of at most UploadChunkSize bytes.
+	// If sending a chunk fails, the client queries how many bytes the server received and resumes from there,
+	// up to Retries times per chunk. Chunks are buffered in memory, so uploads from any reader can be resumed.
+	UploadChunkSize int64
+
+	baseURL *url.URL
+}
+
+// NewClient creates a new CAS http client for the server at baseURL.
+func NewClient(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("parsing base url: unsupported scheme %q", u.Scheme)
+	}
+	return &Client{
+		Retries: defaultRetries,
+		Backoff: defaultBackoff,
+		baseURL: u,
+	}, nil
+}
+
+// Open returns a reader for the given SRI.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *Client) Open(sriString string) (io.ReadCloser, error) {
+	blobURL, err := c.blobURL(sriString)
+	if err != nil {
+		return nil, err
+	}
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", sriString, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		cancel()
+		return nil, &fs.PathError{Op: "open", Path: sriString, Err: fs.ErrNotExist}
+	default:
+		defer cancel()
+		return nil, fmt.Errorf("opening %s: %w", sriString, newStatusError(resp))
+	}
+}
+
+// OpenRange returns a reader for length bytes of the blob with the given SRI, starting at offset.
+// A negative length reads until the end of the blob.
+// It uses a http Range request.
+func (c *Client) OpenRange(sriString string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("opening range: negative offset")
+	}
+	if length == 0 {
+		if _, err := c.Stat(sriString); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	blobURL, err := c.blobURL(sriString)
+	if err != nil {
+		return nil, err
+	}
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", byteRange)
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", sriString, err)
+	}
+	body := &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return body, nil
+	case http.StatusOK:
+		// the server ignored the range
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil && err != io.EOF {
+			body.Close()
+			return nil, fmt.Errorf("opening %s: %w", sriString, err)
+		}
+		return cas.LimitReadCloser(body, length), nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the offset is at or beyond the end of the blob
+		body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	case http.StatusNotFound:
+		body.Close()
+		return nil, &fs.PathError{Op: "open", Path: sriString, Err: fs.ErrNotExist}
+	default:
+		defer cancel()
+		return nil, fmt.Errorf("opening %s: %w", sriString, newStatusError(resp))
+	}
+}
+
+// Stat returns the size of the blob with the given SRI using a HEAD request.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *Client) Stat(sriString string) (int64, error) {
+	blobURL, err := c.blobURL(sriString)
+	if err != nil {
+		return 0, err
+	}
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, blobURL, nil)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("stat %s: %w", sriString, err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			return 0, fmt.Errorf("stat %s: missing content length", sriString)
+		}
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, &fs.PathError{Op: "stat", Path: sriString, Err: fs.ErrNotExist}
+	default:
+		return 0, fmt.Errorf("stat %s: %w", sriString, newStatusError(resp))
+	}
+}
+
+// FindMissing returns the subset of the given SRIs that are not present on the server.
+// Large queries are split into multiple requests.
+func (c *Client) FindMissing(sris []string) ([]string, error) {
+	var missing []string
+	for len(sris) > 0 {
+		batch := sris
+		if len(batch) > maxMissingBatch {
+			batch = batch[:maxMissingBatch]
+		}
+		sris = sris[len(batch):]
+		batchMissing, err := c.findMissing(batch)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, batchMissing...)
+	}
+	return missing, nil
+}
+
+func (c *Client) findMissing(sris []string) ([]string, error) {
+	body, err := json.Marshal(missingRequest{SRIs: sris})
+	if err != nil {
+		return nil, err
+	}
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint(missingPath), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("finding missing blobs: %w", err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("finding missing blobs: %w", newStatusError(resp))
+	}
+	var missingResp missingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&missingResp); err != nil {
+		return nil, fmt.Errorf("finding missing blobs: decoding response: %w", err)
+	}
+	return missingResp.Missing, nil
+}
+
+// List calls fn for every blob on the server that uses the given algorithm.
+// An empty algorithm lists blobs of all algorithms.
+// The listing is fetched page by page.
+func (c *Client) List(algorithm string, fn func(api.BlobInfo) error) error {
+	return c.ListAfter(algorithm, "", fn)
+}
+
+// ListAfter is like List, but only visits blobs that the server lists after the blob with the SRI after.
+func (c *Client) ListAfter(algorithm, after string, fn func(api.BlobInfo) error) error {
+	pageToken := after
+	for {
+		page, err := c.listPage(algorithm, pageToken)
+		if err != nil {
+			return err
+		}
+		for _, listed := range page.Blobs {
+			blob, err := listed.blobInfo()
+			if err != nil {
+				return fmt.Errorf("listing blobs: decoding response: %w", err)
+			}
+			if err := fn(blob); err != nil {
+				if err == fs.SkipAll {
+					return nil
+				}
+				return err
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (c *Client) listPage(algorithm, pageToken string) (listResponse, error) {
+	query := url.Values{}
+	if algorithm != "" {
+		query.Set("algorithm", algorithm)
+	}
+	if pageToken != "" {
+		query.Set("page_token", pageToken)
+	}
+	listURL := c.endpoint(listPath)
+	if len(query) > 0 {
+		listURL += "?" + query.Encode()
+	}
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+	})
+	if err != nil {
+		return listResponse{}, fmt.Errorf("listing blobs: %w", err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return listResponse{}, fmt.Errorf("listing blobs: %w", newStatusError(resp))
+	}
+	var page listResponse
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return listResponse{}, fmt.Errorf("listing blobs: decoding response: %w", err)
+	}
+	return page, nil
+}
+
+// Delete removes the blob with the given SRI from the server.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *Client) Delete(sriString string) error {
+	blobURL, err := c.blobURL(sriString)
+	if err != nil {
+		return err
+	}
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodDelete, blobURL, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("deleting %s: %w", sriString, err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return &fs.PathError{Op: "delete", Path: sriString, Err: fs.ErrNotExist}
+	default:
+		return fmt.Errorf("deleting %s: %w", sriString, newStatusError(resp))
+	}
+}
+
+// Write uploads the blob to the server.
+// Requests are only retried if r implements io.Seeker,
+// unless resumable uploads are enabled with UploadChunkSize.
+func (c *Client) Write(sriString string, r io.Reader) error {
+	blobURL, err := c.blobURL(sriString)
+	if err != nil {
+		return err
+	}
+	if c.UploadChunkSize > 0 {
+		return c.writeResumable(sriString, r)
+	}
+	retries := 0
+	var start int64
+	seeker, seekable := r.(io.Seeker)
+	if seekable {
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return fmt.Errorf("writing %s: %w", sriString, err)
+		}
+		retries = c.Retries
+	}
+	attempt := 0
+	resp, cancel, err := c.do(retries, func(ctx context.Context) (*http.Request, error) {
+		if attempt > 0 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		attempt++
+		// hide the concrete type of r so the http client does not close it
+		return http.NewRequestWithContext(ctx, http.MethodPut, blobURL, io.NopCloser(r))
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("writing %s: %w", sriString, newStatusError(resp))
+	}
+	return nil
+}
+
+// writeResumable uploads the blob in an upload session.
+func (c *Client) writeResumable(sriString string, r io.Reader) error {
+	session, err := c.createUpload()
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	sessionURL := c.endpoint(uploadsPath + "/" + url.PathEscape(session.ID))
+	offset := session.Offset
+	chunk := make([]byte, c.UploadChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			c.cancelUpload(sessionURL)
+			return fmt.Errorf("writing %s: %w", sriString, readErr)
+		}
+		if n > 0 {
+			if offset, err = c.sendChunk(sessionURL, offset, chunk[:n]); err != nil {
+				c.cancelUpload(sessionURL)
+				return fmt.Errorf("writing %s: %w", sriString, err)
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if err := c.commitUpload(sessionURL, sriString); err != nil {
+		// the server keeps a session that failed to commit until it expires
+		c.cancelUpload(sessionURL)
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	return nil
+}
+
+// createUpload creates an upload session.
+func (c *Client) createUpload() (uploadSession, error) {
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint(uploadsPath), nil)
+	})
+	if err != nil {
+		return uploadSession{}, fmt.Errorf("creating upload session: %w", err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return uploadSession{}, fmt.Errorf("creating upload session: %w", newStatusError(resp))
+	}
+	var session uploadSession
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return uploadSession{}, fmt.Errorf("creating upload session: decoding response: %w", err)
+	}
+	if session.ID == "" {
+		return uploadSession{}, errors.New("creating upload session: missing session id")
+	}
+	return session, nil
+}
+
+// sendChunk appends chunk to the upload session, which received offset bytes so far.
+// If a request fails, it asks the server how much of the chunk was received and sends the rest.
+// It returns the offset after the chunk.
+func (c *Client) sendChunk(sessionURL string, offset int64, chunk []byte) (int64, error) {
+	start := offset
+	end := start + int64(len(chunk))
+	backoff := c.Backoff
+	var lastErr error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			received, err := c.uploadOffset(sessionURL)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if received < start || received > end {
+				return 0, fmt.Errorf("resuming upload: server received %d bytes, expected between %d and %d", received, start, end)
+			}
+			offset = received
+		}
+		if offset == end {
+			return end, nil
+		}
+		remaining := chunk[offset-start:]
+		resp, cancel, err := c.do(0, func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPatch, sessionURL, bytes.NewReader(remaining))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+			return req, nil
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusNoContent {
+			resp.Body.Close()
+			cancel()
+			return end, nil
+		}
+		status := resp.StatusCode
+		lastErr = newStatusError(resp)
+		cancel()
+		if !isRetryable(status) && status != http.StatusConflict {
+			return 0, lastErr
+		}
+	}
+	return 0, lastErr
+}
+
+// uploadOffset returns the number of bytes received by the upload session.
+func (c *Client) uploadOffset(sessionURL string) (int64, error) {
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, sessionURL, nil)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("querying upload offset: %w", err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("querying upload offset: %w", newStatusError(resp))
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("querying upload offset: invalid %s header: %w", uploadOffsetHeader, err)
+	}
+	return offset, nil
+}
+
+// commitUpload asks the server to verify the content of the upload session and commit it.
+func (c *Client) commitUpload(sessionURL, sriString string) error {
+	commitURL := sessionURL + "?" + url.Values{"sri": {sriString}}.Encode()
+	resp, cancel, err := c.do(c.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPut, commitURL, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("committing upload: %w", err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		// a retried request does not find the session if the response to a previous attempt was lost
+		if _, err := c.Stat(sriString); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("committing upload: %w", newStatusError(resp))
+}
+
+// cancelUpload removes an upload session on a best-effort basis.
+// Sessions that are not removed expire on the server.
+func (c *Client) cancelUpload(sessionURL string) {
+	resp, cancel, err := c.do(0, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodDelete, sessionURL, nil)
+	})
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	cancel()
+}
+
+// do sends the request created by newRequest and retries on transient failures.
+// On success, the caller must call the returned cancel func after closing the response body.
+func (c *Client) do(retries int, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, context.CancelFunc, error) {
+	backoff := c.Backoff
+	var lastErr error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		ctx, cancel := c.context()
+		req, err := newRequest(ctx)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			cancel()
+			lastErr = &api.UnavailableError{Err: err}
+			continue
+		}
+		if isRetryable(resp.StatusCode) && attempt < retries {
+			lastErr = newStatusError(resp)
+			cancel()
+			continue
+		}
+		return resp, cancel, nil
+	}
+	return nil, nil, lastErr
+}
+
+func (c *Client) context() (context.Context, context.CancelFunc) {
+	if c.Timeout > 0 {
+		return context.WithTimeout(context.Background(), c.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// blobURL returns the url of the blob with the given SRI.
+func (c *Client) blobURL(sriString string) (string, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return "", err
+	}
+	return c.endpoint(formatPath(integrity)), nil
+}
+
+// endpoint returns the url of the given path relative to the base url.
+func (c *Client) endpoint(path string) string {
+	u := *c.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	return u.String()
+}
+
+func isRetryable(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// statusError is returned when the server responds with an unexpected status code.
+// It wraps the matching error of the api package, if any,
+// which is taken from the JSON error body or derived from the status code.
+type statusError struct {
+	code    int
+	message string
+	err     error
+}
+
+func newStatusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	statusErr := &statusError{
+		code:    resp.StatusCode,
+		message: strings.TrimSpace(string(body)),
+		err:     errorForStatus(resp.StatusCode),
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType == "application/json" {
+		var errResp errorResponse
+		if err := json.Unmarshal(body, &errResp); err == nil && errResp.Code != "" {
+			statusErr.message = errResp.Message
+			if codeErr, ok := codeErrors[errResp.Code]; ok {
+				statusErr.err = codeErr
+			}
+		}
+	}
+	return statusErr
+}
+
+func (e *statusError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("unexpected status %d %s", e.code, http.StatusText(e.code))
+	}
+	return fmt.Sprintf("unexpected status %d %s: %s", e.code, http.StatusText(e.code), e.message)
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// cancelReadCloser cancels the request context when the body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+const (
+	defaultRetries   = 3
+	defaultBackoff   = 100 * time.Millisecond
+	maxErrorBodySize = 4096
+)
+
+var (
+	_ api.CAS              = (*Client)(nil)
+	_ api.CASStater        = (*Client)(nil)
+	_ api.CASRangeReader   = (*Client)(nil)
+	_ api.CASMissingFinder = (*Client)(nil)
+	_ api.CASLister        = (*Client)(nil)
+	_ api.CASCursorLister  = (*Client)(nil)
+	_ api.CASDeleter       = (*Client)(nil)
+)
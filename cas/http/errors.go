@@ -0,0 +1,144 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// errorResponse is the JSON body of an error response.
+// Clients map the code back to the errors of the api package.
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError writes err as JSON error response with the status code derived from err.
+func writeError(w http.ResponseWriter, err error) {
+	writeErrorWithStatus(w, errorStatus(err), err)
+}
+
+// writeErrorWithStatus writes err as JSON error response with the given status code.
+// Server errors only carry a generic message, since their details (e.g. file system paths)
+// are not meant for clients. The error is passed to the EventHook instead.
+func writeErrorWithStatus(w http.ResponseWriter, status int, err error) {
+	recordError(w, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Code: errorCode(err, status), Message: errorMessage(status, err)})
+}
+
+// writePlainError writes err as plain text error response, for protocols without JSON errors.
+// Like writeErrorWithStatus, it only sends a generic message for server errors.
+func writePlainError(w http.ResponseWriter, status int, err error) {
+	recordError(w, err)
+	http.Error(w, errorMessage(status, err), status)
+}
+
+// errorMessage returns the message of an error response.
+func errorMessage(status int, err error) string {
+	if status >= http.StatusInternalServerError {
+		return http.StatusText(status)
+	}
+	return err.Error()
+}
+
+// recordError passes err to the observer of the request, if any.
+func recordError(w http.ResponseWriter, err error) {
+	if recorder, ok := w.(interface{ recordError(error) }); ok {
+		recorder.recordError(err)
+	}
+}
+
+// errorStatus returns the http status code for an error.
+func errorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, api.ErrNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &maxBytesErr), errors.Is(err, api.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, sri.ErrSizeMismatch):
+		// the body does not match its Content-Length
+		return http.StatusBadRequest
+	case errors.Is(err, api.ErrIntegrityMismatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, api.ErrInvalidSRI):
+		return http.StatusBadRequest
+	case errors.Is(err, api.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, errQuotaExceeded), errors.Is(err, errTooManyUploads), errors.Is(err, errUploadsFull):
+		return http.StatusTooManyRequests
+	case errors.Is(err, api.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// errorCode returns the wire code of an error.
+// Errors that do not match an error of the api package are classified by their status code.
+func errorCode(err error, status int) string {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, api.ErrNotFound):
+		return errorCodeNotFound
+	case errors.As(err, &maxBytesErr), errors.Is(err, api.ErrTooLarge):
+		return errorCodeTooLarge
+	case errors.Is(err, api.ErrIntegrityMismatch):
+		return errorCodeIntegrityMismatch
+	case errors.Is(err, api.ErrInvalidSRI):
+		return errorCodeInvalidSRI
+	case errors.Is(err, api.ErrUnauthorized):
+		return errorCodeUnauthorized
+	case errors.Is(err, api.ErrUnavailable):
+		return errorCodeUnavailable
+	}
+	if status < http.StatusInternalServerError {
+		return errorCodeBadRequest
+	}
+	return errorCodeInternal
+}
+
+// errorForStatus returns the error of the api package matching a status code,
+// for error responses without a known code (e.g. from proxies).
+// It returns nil if there is no matching error.
+func errorForStatus(status int) error {
+	switch status {
+	case http.StatusNotFound:
+		return api.ErrNotFound
+	case http.StatusRequestEntityTooLarge:
+		return api.ErrTooLarge
+	case http.StatusUnprocessableEntity:
+		return api.ErrIntegrityMismatch
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return api.ErrUnauthorized
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return api.ErrUnavailable
+	}
+	return nil
+}
+
+// codeErrors maps wire codes to the errors of the api package.
+var codeErrors = map[string]error{
+	errorCodeNotFound:          api.ErrNotFound,
+	errorCodeTooLarge:          api.ErrTooLarge,
+	errorCodeIntegrityMismatch: api.ErrIntegrityMismatch,
+	errorCodeInvalidSRI:        api.ErrInvalidSRI,
+	errorCodeUnauthorized:      api.ErrUnauthorized,
+	errorCodeUnavailable:       api.ErrUnavailable,
+}
+
+const (
+	errorCodeNotFound          = "not_found"
+	errorCodeTooLarge          = "too_large"
+	errorCodeIntegrityMismatch = "integrity_mismatch"
+	errorCodeInvalidSRI        = "invalid_sri"
+	errorCodeUnauthorized      = "unauthorized"
+	errorCodeUnavailable       = "unavailable"
+	errorCodeInternal          = "internal"
+	errorCodeBadRequest        = "bad_request"
+)
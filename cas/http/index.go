@@ -0,0 +1,161 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/malt3/abstractfs-core/api"
+)
+
+// handleIndex handles the index namespace, a key-value store for data that is not content addressed
+// (see api.KeyValueStore). CAS wrappers that transform blobs use it to find the representations they store:
+//
+//	GET  /index/<hex-key>  read a value
+//	HEAD /index/<hex-key>  query the existence and size of a value
+//	PUT  /index/<hex-key>  store a value, replacing any previous value
+//
+// Unlike blobs, values are not verified. Serve the namespace only to trusted writers.
+func (s *Handler) handleIndex(w http.ResponseWriter, req *http.Request) {
+	if s.opts.Index == nil {
+		writeErrorWithStatus(w, http.StatusNotImplemented, errors.New("index not supported"))
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, indexPath)
+	if err := validateIndexKey(key); err != nil {
+		writeErrorWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		value, err := s.opts.Index.Get(key)
+		if err != nil {
+			if req.Method == http.MethodHead {
+				w.WriteHeader(errorStatus(err))
+				return
+			}
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		w.Header().Set("Cache-Control", "no-store")
+		if req.Method == http.MethodGet {
+			w.Write(value)
+		}
+	case http.MethodPut:
+		if req.ContentLength > maxIndexValueSize {
+			writeError(w, &api.TooLargeError{Size: req.ContentLength, Limit: maxIndexValueSize})
+			return
+		}
+		value, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxIndexValueSize))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := s.opts.Index.Put(key, value); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	default:
+		writeErrorWithStatus(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// Index returns the index namespace of the server as api.KeyValueStore,
+// e.g. as index of CAS wrappers that transform blobs stored on the server.
+// It uses the settings of the client.
+func (c *Client) Index() api.KeyValueStore {
+	return &indexClient{client: c}
+}
+
+// indexClient is a client for the index namespace.
+type indexClient struct {
+	client *Client
+}
+
+// Get returns the value stored under key.
+// If the key does not exist, it returns an error wrapping fs.ErrNotExist.
+func (i *indexClient) Get(key string) ([]byte, error) {
+	if err := validateIndexKey(key); err != nil {
+		return nil, err
+	}
+	resp, cancel, err := i.client.do(i.client.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, i.client.endpoint(indexPath+key), nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading index entry %s: %w", key, err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, &fs.PathError{Op: "get", Path: key, Err: fs.ErrNotExist}
+	default:
+		return nil, fmt.Errorf("reading index entry %s: %w", key, newStatusError(resp))
+	}
+	value, err := io.ReadAll(io.LimitReader(resp.Body, maxIndexValueSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading index entry %s: %w", key, err)
+	}
+	if len(value) > maxIndexValueSize {
+		return nil, fmt.Errorf("reading index entry %s: %w", key, &api.TooLargeError{Size: -1, Limit: maxIndexValueSize})
+	}
+	return value, nil
+}
+
+// Put stores value under key, replacing any previous value.
+func (i *indexClient) Put(key string, value []byte) error {
+	if err := validateIndexKey(key); err != nil {
+		return err
+	}
+	resp, cancel, err := i.client.do(i.client.Retries, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPut, i.client.endpoint(indexPath+key), bytes.NewReader(value))
+	})
+	if err != nil {
+		return fmt.Errorf("writing index entry %s: %w", key, err)
+	}
+	defer cancel()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("writing index entry %s: %w", key, newStatusError(resp))
+	}
+	return nil
+}
+
+// validateIndexKey checks that the key is a lowercase hex string of 32 to 128 characters.
+func validateIndexKey(key string) error {
+	if len(key) < minIndexKeyLen {
+		return errors.New("invalid index key: too short")
+	}
+	if len(key) > maxIndexKeyLen {
+		return errors.New("invalid index key: too long")
+	}
+	if _, err := hex.DecodeString(key); err != nil || strings.ToLower(key) != key {
+		return errors.New("invalid index key: must be lowercase hex")
+	}
+	return nil
+}
+
+const (
+	// indexPath is the path prefix of the index namespace.
+	indexPath = "/index/"
+	// maxIndexValueSize is the maximum size of a value in the index.
+	maxIndexValueSize = 1 << 20
+	// minIndexKeyLen is the minimum length of an index key.
+	minIndexKeyLen = 32
+	// maxIndexKeyLen is the maximum length of an index key.
+	maxIndexKeyLen = 128
+)
+
+var _ api.KeyValueStore = (*indexClient)(nil)
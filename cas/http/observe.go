@@ -0,0 +1,181 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/malt3/abstractfs-core/cas/metrics"
+)
+
+// EventHook observes the requests served by a handler, e.g. for logging or tracing.
+// Implementations must be safe for concurrent use.
+type EventHook interface {
+	// RequestStarted is called before a request is handled.
+	// The returned context replaces the context of the request, e.g. to carry a tracing span.
+	RequestStarted(req *http.Request) context.Context
+	// RequestFinished is called after a request was handled
+	// with the request passed to the handler.
+	RequestFinished(req *http.Request, event RequestEvent)
+}
+
+// RequestEvent describes a request that was served.
+type RequestEvent struct {
+	// Handler is the kind of handler that served the request: "cas", "oci" or "bazel".
+	Handler string
+	// Method is the method of the request.
+	Method string
+	// Path is the path of the request.
+	Path string
+	// Status is the status code of the response.
+	Status int
+	// BytesIn is the number of request body bytes read by the handler.
+	BytesIn int64
+	// BytesOut is the number of response body bytes written by the handler.
+	BytesOut int64
+	// Duration is the time spent serving the request.
+	Duration time.Duration
+	// Err is the error the request failed with, if any.
+	// Responses to server errors only carry a generic message, so this is where their details end up.
+	Err error
+}
+
+// observer records metrics and events for the requests of a handler.
+type observer struct {
+	handler string
+	hook    EventHook
+	now     func() time.Time
+
+	requests *metrics.Counter
+	latency  *metrics.Histogram
+	bytesIn  *metrics.Counter
+	bytesOut *metrics.Counter
+}
+
+// newObserver returns an observer for the given options,
+// or nil if neither metrics nor events are requested.
+func newObserver(handler string, opts HandlerOptions) *observer {
+	if opts.Metrics == nil && opts.Events == nil {
+		return nil
+	}
+	o := &observer{handler: handler, hook: opts.Events, now: time.Now}
+	if registry := opts.Metrics; registry != nil {
+		o.requests = registry.Counter("abstractfs_http_requests_total",
+			"Number of http requests by method and status code.", "handler", "method", "code")
+		o.latency = registry.Histogram("abstractfs_http_request_duration_seconds",
+			"Latency of http requests in seconds.", metrics.DurationBuckets, "handler", "method")
+		o.bytesIn = registry.Counter("abstractfs_http_received_bytes_total",
+			"Number of request body bytes received.", "handler", "method")
+		o.bytesOut = registry.Counter("abstractfs_http_sent_bytes_total",
+			"Number of response body bytes sent.", "handler", "method")
+	}
+	return o
+}
+
+// serve calls next and records the request.
+// A nil observer calls next directly.
+func (o *observer) serve(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if o == nil {
+		next(w, req)
+		return
+	}
+	start := o.now()
+	if o.hook != nil {
+		req = req.WithContext(o.hook.RequestStarted(req))
+	}
+	body := &countingBody{ReadCloser: req.Body}
+	req.Body = body
+	cw := &countingResponseWriter{ResponseWriter: w}
+	defer func() {
+		// also record requests that were aborted with a panic
+		o.finish(req, RequestEvent{
+			Handler:  o.handler,
+			Method:   req.Method,
+			Path:     req.URL.Path,
+			Status:   cw.statusCode(),
+			BytesIn:  body.n,
+			BytesOut: cw.n,
+			Duration: o.now().Sub(start),
+			Err:      cw.err,
+		})
+	}()
+	next(cw, req)
+}
+
+func (o *observer) finish(req *http.Request, event RequestEvent) {
+	if o.requests != nil {
+		method := methodLabel(event.Method)
+		o.requests.Inc(o.handler, method, strconv.Itoa(event.Status))
+		o.latency.Observe(event.Duration.Seconds(), o.handler, method)
+		o.bytesIn.Add(float64(event.BytesIn), o.handler, method)
+		o.bytesOut.Add(float64(event.BytesOut), o.handler, method)
+	}
+	if o.hook != nil {
+		o.hook.RequestFinished(req, event)
+	}
+}
+
+// methodLabel returns the value of the method label.
+// Unknown methods share a label value, so that clients cannot create arbitrary series.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to a response and remembers its status code.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int
+	err    error
+}
+
+func (c *countingResponseWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recordError remembers the error of an error response.
+func (c *countingResponseWriter) recordError(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// statusCode returns the status code of the response.
+// Handlers that do not write anything respond with 200 OK.
+func (c *countingResponseWriter) statusCode() int {
+	if c.status == 0 {
+		return http.StatusOK
+	}
+	return c.status
+}
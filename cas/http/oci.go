@@ -0,0 +1,410 @@
+package http
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// OCIHandler serves the blob endpoints of the OCI distribution API on top of a CAS,
+// so that registry clients can push and pull blobs.
+// Blobs are shared between all repositories.
+// Manifests and tags are not supported.
+//
+// It implements the following endpoints:
+//
+//	GET    /v2/                                  API version check
+//	GET    /v2/<name>/blobs/<digest>             download a blob (with Range support)
+//	HEAD   /v2/<name>/blobs/<digest>             check for a blob
+//	POST   /v2/<name>/blobs/uploads/             start an upload (or upload monolithically with ?digest=)
+//	PATCH  /v2/<name>/blobs/uploads/<id>         upload a chunk
+//	PUT    /v2/<name>/blobs/uploads/<id>?digest= finish an upload
+//	GET    /v2/<name>/blobs/uploads/<id>         get the status of an upload
+//	DELETE /v2/<name>/blobs/uploads/<id>         cancel an upload
+//
+// Digests use the OCI format <algorithm>:<hex>, e.g. sha256:<hex>.
+type OCIHandler struct {
+	blobs    *Handler
+	uploads  *uploadStore
+	observer *observer
+}
+
+// NewOCIHandler creates a new OCIHandler.
+// Uploads are staged in opts.UploadDir until they are complete.
+func NewOCIHandler(cas api.CAS, opts HandlerOptions) (*OCIHandler, error) {
+	uploads, err := newUploadStore(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &OCIHandler{
+		blobs:    &Handler{cas: cas, opts: opts},
+		uploads:  uploads,
+		observer: newObserver("oci", opts),
+	}, nil
+}
+
+// Close cancels all uploads in progress, removes their staged content
+// and stops the periodic removal of expired uploads.
+func (h *OCIHandler) Close() error {
+	h.uploads.close()
+	return nil
+}
+
+func (h *OCIHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.observer.serve(w, req, h.serve)
+}
+
+func (h *OCIHandler) serve(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	route, err := parseOCIPath(req.URL.Path)
+	if err != nil {
+		writeOCIError(w, http.StatusNotFound, ociCodeNameInvalid, err.Error())
+		return
+	}
+	switch {
+	case route.versionCheck:
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			writeOCIError(w, http.StatusMethodNotAllowed, ociCodeUnsupported, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	case route.upload:
+		h.serveUpload(w, req, route)
+	case route.digest != "":
+		h.serveBlob(w, req, route)
+	default:
+		writeOCIError(w, http.StatusNotFound, ociCodeUnsupported, "only blob endpoints are supported")
+	}
+}
+
+func (h *OCIHandler) serveBlob(w http.ResponseWriter, req *http.Request, route ociRoute) {
+	integrity, err := parseDigest(route.digest)
+	if err != nil {
+		writeOCIError(w, http.StatusBadRequest, ociCodeDigestInvalid, err.Error())
+		return
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		writeOCIError(w, http.StatusMethodNotAllowed, ociCodeUnsupported, "method not allowed")
+		return
+	}
+	size, err := cas.Stat(h.blobs.cas, integrity.String())
+	if errors.Is(err, fs.ErrNotExist) {
+		writeOCIError(w, http.StatusNotFound, ociCodeBlobUnknown, "blob unknown to registry")
+		return
+	}
+	if err != nil {
+		writeOCIInternalError(w, ociCodeBlobUnknown, err)
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", formatDigest(integrity))
+	if req.Method == http.MethodHead {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	body, err := h.blobs.openBlob(integrity.String())
+	if errors.Is(err, fs.ErrNotExist) {
+		// deleted since it was stat'ed
+		writeOCIError(w, http.StatusNotFound, ociCodeBlobUnknown, "blob unknown to registry")
+		return
+	}
+	if err != nil {
+		writeOCIInternalError(w, ociCodeBlobUnknown, err)
+		return
+	}
+	defer body.Close()
+	serveBody(w, req, integrity, body)
+}
+
+func (h *OCIHandler) serveUpload(w http.ResponseWriter, req *http.Request, route ociRoute) {
+	if route.uploadID == "" {
+		if req.Method != http.MethodPost {
+			writeOCIError(w, http.StatusMethodNotAllowed, ociCodeUnsupported, "method not allowed")
+			return
+		}
+		h.startUpload(w, req, route)
+		return
+	}
+	up, ok := h.uploads.get(route.uploadID)
+	if !ok {
+		writeOCIError(w, http.StatusNotFound, ociCodeBlobUploadUnknown, "upload unknown")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		up.mux.Lock()
+		defer up.mux.Unlock()
+		writeUploadStatus(w, route, up, http.StatusNoContent)
+	case http.MethodPatch:
+		h.patchUpload(w, req, route, up)
+	case http.MethodPut:
+		h.finishUpload(w, req, route, up)
+	case http.MethodDelete:
+		h.uploads.remove(up)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeOCIError(w, http.StatusMethodNotAllowed, ociCodeUnsupported, "method not allowed")
+	}
+}
+
+// startUpload starts an upload session.
+// With a digest, the request body is the whole blob (monolithic upload).
+// With mount, an existing blob is "mounted" from another repository, which is a no-op since blobs are shared.
+func (h *OCIHandler) startUpload(w http.ResponseWriter, req *http.Request, route ociRoute) {
+	query := req.URL.Query()
+	if mount := query.Get("mount"); mount != "" {
+		if integrity, err := parseDigest(mount); err == nil {
+			if has, err := cas.Has(h.blobs.cas, integrity.String()); err == nil && has {
+				writeBlobCreated(w, route, integrity)
+				return
+			}
+		}
+	}
+	if digest := query.Get("digest"); digest != "" {
+		integrity, err := parseDigest(digest)
+		if err != nil {
+			writeOCIError(w, http.StatusBadRequest, ociCodeDigestInvalid, err.Error())
+			return
+		}
+		h.putMonolithic(w, req, route, integrity)
+		return
+	}
+	up, err := h.uploads.create()
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	up.mux.Lock()
+	defer up.mux.Unlock()
+	writeUploadStatus(w, route, up, http.StatusAccepted)
+}
+
+// putMonolithic writes the request body to the CAS while verifying it.
+func (h *OCIHandler) putMonolithic(w http.ResponseWriter, req *http.Request, route ociRoute, integrity sri.Integrity) {
+	body := req.Body
+	if max := h.blobs.opts.MaxBlobSize; max > 0 {
+		if req.ContentLength > max {
+			writeOCIError(w, http.StatusRequestEntityTooLarge, ociCodeSizeInvalid, "blob too large")
+			return
+		}
+		body = http.MaxBytesReader(w, body, max)
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, req.ContentLength, body)
+	if err != nil {
+		writeOCIError(w, http.StatusBadRequest, ociCodeDigestInvalid, err.Error())
+		return
+	}
+	if err := h.blobs.cas.Write(integrity.String(), verifier); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeBlobCreated(w, route, integrity)
+}
+
+// patchUpload appends a chunk to an upload.
+// If a Content-Range header is present, it must start at the current end of the upload.
+func (h *OCIHandler) patchUpload(w http.ResponseWriter, req *http.Request, route ociRoute, up *upload) {
+	up.mux.Lock()
+	defer up.mux.Unlock()
+	if contentRange := req.Header.Get("Content-Range"); contentRange != "" {
+		start, ok := parseContentRangeStart(contentRange)
+		if !ok || start != up.size {
+			writeUploadStatus(w, route, up, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+	if _, err := up.append(req.Body, h.blobs.opts.MaxBlobSize, false); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeUploadStatus(w, route, up, http.StatusAccepted)
+}
+
+// finishUpload appends the final chunk (if any) and commits the upload to the CAS.
+func (h *OCIHandler) finishUpload(w http.ResponseWriter, req *http.Request, route ociRoute, up *upload) {
+	integrity, err := parseDigest(req.URL.Query().Get("digest"))
+	if err != nil {
+		writeOCIError(w, http.StatusBadRequest, ociCodeDigestInvalid, err.Error())
+		return
+	}
+	up.mux.Lock()
+	if _, err := up.append(req.Body, h.blobs.opts.MaxBlobSize, false); err != nil {
+		up.mux.Unlock()
+		writeUploadError(w, err)
+		return
+	}
+	err = up.commit(h.blobs.cas, integrity)
+	up.mux.Unlock()
+	if err != nil {
+		if errors.Is(err, sri.ErrHashMismatch) || errors.Is(err, sri.ErrSizeMismatch) {
+			// the staged content can never match the digest
+			h.uploads.remove(up)
+		}
+		writeUploadError(w, err)
+		return
+	}
+	h.uploads.remove(up)
+	writeBlobCreated(w, route, integrity)
+}
+
+// writeUploadStatus writes the location and the received range of an upload.
+func writeUploadStatus(w http.ResponseWriter, route ociRoute, up *upload, status int) {
+	w.Header().Set("Location", "/v2/"+route.name+"/blobs/uploads/"+up.id)
+	w.Header().Set("Docker-Upload-UUID", up.id)
+	end := up.size - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", "0-"+strconv.FormatInt(end, 10))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(status)
+}
+
+func writeBlobCreated(w http.ResponseWriter, route ociRoute, integrity sri.Integrity) {
+	digest := formatDigest(integrity)
+	w.Header().Set("Location", "/v2/"+route.name+"/blobs/"+digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUploadTooLarge), errors.As(err, &maxBytesErr):
+		writeOCIError(w, http.StatusRequestEntityTooLarge, ociCodeSizeInvalid, "blob too large")
+	case errors.Is(err, sri.ErrHashMismatch):
+		writeOCIError(w, http.StatusBadRequest, ociCodeDigestInvalid, err.Error())
+	case errors.Is(err, sri.ErrSizeMismatch):
+		writeOCIError(w, http.StatusBadRequest, ociCodeSizeInvalid, err.Error())
+	case errors.Is(err, errUploadDone):
+		writeOCIError(w, http.StatusNotFound, ociCodeBlobUploadUnknown, err.Error())
+	case errors.Is(err, errTooManyUploads), errors.Is(err, errUploadsFull):
+		writeOCIError(w, http.StatusTooManyRequests, ociCodeTooManyRequests, err.Error())
+	default:
+		writeOCIInternalError(w, ociCodeBlobUploadInvalid, err)
+	}
+}
+
+// writeOCIInternalError writes a server error response in the format of the OCI distribution API.
+// Like writeErrorWithStatus, it only sends a generic message and passes err to the EventHook.
+func writeOCIInternalError(w http.ResponseWriter, code string, err error) {
+	recordError(w, err)
+	writeOCIError(w, http.StatusInternalServerError, code, http.StatusText(http.StatusInternalServerError))
+}
+
+// writeOCIError writes an error response in the format of the OCI distribution API.
+func writeOCIError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ociErrorResponse{Errors: []ociError{{Code: code, Message: message}}})
+}
+
+// ociRoute is a parsed OCI distribution API path.
+type ociRoute struct {
+	versionCheck bool
+	name         string
+	digest       string
+	upload       bool
+	uploadID     string
+}
+
+// parseOCIPath parses a path of the form
+// /v2/, /v2/<name>/blobs/<digest> or /v2/<name>/blobs/uploads/[<id>].
+// Repository names may contain slashes.
+func parseOCIPath(path string) (ociRoute, error) {
+	if path == "/v2/" || path == "/v2" {
+		return ociRoute{versionCheck: true}, nil
+	}
+	if !strings.HasPrefix(path, "/v2/") {
+		return ociRoute{}, errors.New("invalid path: must start with /v2/")
+	}
+	rest := path[len("/v2/"):]
+	if i := strings.LastIndex(rest, ociUploadsPath); i > 0 {
+		id := strings.TrimPrefix(rest[i+len(ociUploadsPath):], "/")
+		if !strings.Contains(id, "/") {
+			return ociRoute{name: rest[:i], upload: true, uploadID: id}, nil
+		}
+	}
+	if i := strings.LastIndex(rest, "/blobs/"); i > 0 {
+		digest := rest[i+len("/blobs/"):]
+		if digest != "" && !strings.Contains(digest, "/") {
+			return ociRoute{name: rest[:i], digest: digest}, nil
+		}
+	}
+	return ociRoute{}, nil
+}
+
+// parseDigest parses an OCI digest (<algorithm>:<hex>).
+func parseDigest(digest string) (sri.Integrity, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok {
+		return sri.Integrity{}, fmt.Errorf("invalid digest %q", digest)
+	}
+	alg, err := sri.AlgorithmFromString(algorithm)
+	if err != nil {
+		return sri.Integrity{}, fmt.Errorf("invalid digest: %w", err)
+	}
+	hash, err := hex.DecodeString(encoded)
+	if err != nil || len(hash) != alg.ByteLen() || strings.ToLower(encoded) != encoded {
+		return sri.Integrity{}, fmt.Errorf("invalid digest %q", digest)
+	}
+	return sri.Integrity{Algorithm: alg, Hash: hash}, nil
+}
+
+// formatDigest returns the OCI digest of the integrity.
+// It is the inverse of parseDigest.
+func formatDigest(integrity sri.Integrity) string {
+	return string(integrity.Algorithm) + ":" + integrity.Hex()
+}
+
+// parseContentRangeStart parses the start of a Content-Range header of a chunk upload (<start>-<end>).
+func parseContentRangeStart(contentRange string) (int64, bool) {
+	start, _, ok := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// ociErrorResponse is the error format of the OCI distribution API.
+type ociErrorResponse struct {
+	Errors []ociError `json:"errors"`
+}
+
+type ociError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// error codes of the OCI distribution API.
+const (
+	ociCodeBlobUnknown       = "BLOB_UNKNOWN"
+	ociCodeBlobUploadInvalid = "BLOB_UPLOAD_INVALID"
+	ociCodeBlobUploadUnknown = "BLOB_UPLOAD_UNKNOWN"
+	ociCodeDigestInvalid     = "DIGEST_INVALID"
+	ociCodeNameInvalid       = "NAME_INVALID"
+	ociCodeSizeInvalid       = "SIZE_INVALID"
+	ociCodeTooManyRequests   = "TOOMANYREQUESTS"
+	ociCodeUnsupported       = "UNSUPPORTED"
+)
+
+// ociUploadsPath is the path segment of the upload sessions of a repository.
+const ociUploadsPath = "/blobs/uploads"
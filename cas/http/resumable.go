@@ -0,0 +1,175 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// handleUpload handles the resumable upload protocol.
+// Large blobs are uploaded in an upload session, so that a dropped connection does not restart the upload:
+//
+//	POST   /cas/uploads           create a session
+//	HEAD   /cas/uploads/<id>      query the number of bytes received (Upload-Offset header)
+//	PATCH  /cas/uploads/<id>      append the body at the offset given in the Upload-Offset header
+//	PUT    /cas/uploads/<id>?sri= verify the received content and commit it to the CAS
+//	DELETE /cas/uploads/<id>      cancel the session
+//
+// If a PATCH request is interrupted, the bytes received so far are kept.
+// Clients query the offset and continue from there.
+// Sessions that are not used for longer than the upload expiry are removed.
+func (s *Handler) handleUpload(w http.ResponseWriter, req *http.Request) {
+	uploads, err := s.uploadStore()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, uploadsPath), "/")
+	if id == "" {
+		if req.Method != http.MethodPost {
+			writeErrorWithStatus(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		s.createUpload(w, uploads)
+		return
+	}
+	up, ok := uploads.get(id)
+	if !ok {
+		writeErrorWithStatus(w, http.StatusNotFound, errors.New("upload session not found or expired"))
+		return
+	}
+	switch req.Method {
+	case http.MethodHead:
+		up.mux.Lock()
+		defer up.mux.Unlock()
+		writeUploadSession(w, up)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		s.appendUpload(w, req, up)
+	case http.MethodPut:
+		s.commitUpload(w, req, uploads, up)
+	case http.MethodDelete:
+		uploads.remove(up)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrorWithStatus(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// createUpload creates a new upload session.
+func (s *Handler) createUpload(w http.ResponseWriter, uploads *uploadStore) {
+	up, err := uploads.create()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	up.mux.Lock()
+	defer up.mux.Unlock()
+	w.Header().Set("Location", uploadsPath+"/"+up.id)
+	writeUploadSession(w, up)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(uploadSession{ID: up.id, Offset: up.size, Expires: up.expires().UTC().Format(time.RFC3339)})
+}
+
+// appendUpload appends the request body to an upload session.
+// The Upload-Offset header must match the number of bytes received so far.
+func (s *Handler) appendUpload(w http.ResponseWriter, req *http.Request, up *upload) {
+	offset, err := strconv.ParseInt(req.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		writeErrorWithStatus(w, http.StatusBadRequest, fmt.Errorf("invalid %s header", uploadOffsetHeader))
+		return
+	}
+	up.mux.Lock()
+	defer up.mux.Unlock()
+	if offset != up.size {
+		writeUploadSession(w, up)
+		writeErrorWithStatus(w, http.StatusConflict, fmt.Errorf("offset %d does not match received size %d", offset, up.size))
+		return
+	}
+	if _, err := up.append(req.Body, s.opts.MaxBlobSize, true); err != nil {
+		writeUploadSession(w, up)
+		s.writeUploadError(w, err)
+		return
+	}
+	writeUploadSession(w, up)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commitUpload verifies the content of an upload session against the sri query parameter
+// and commits it to the CAS. The session is removed unless committing failed for reasons
+// other than the content, e.g. an unavailable backend.
+func (s *Handler) commitUpload(w http.ResponseWriter, req *http.Request, uploads *uploadStore, up *upload) {
+	integrity, err := sri.FromString(req.URL.Query().Get("sri"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	up.mux.Lock()
+	err = up.commit(s.cas, integrity)
+	up.mux.Unlock()
+	if err != nil {
+		if errors.Is(err, api.ErrIntegrityMismatch) {
+			// the staged content can never match the sri
+			uploads.remove(up)
+		}
+		s.writeUploadError(w, err)
+		return
+	}
+	uploads.remove(up)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// writeUploadError writes an error of an upload session.
+func (s *Handler) writeUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUploadDone):
+		// the session was committed or removed concurrently
+		writeErrorWithStatus(w, http.StatusNotFound, errors.New("upload session not found or expired"))
+	case errors.Is(err, errUploadTooLarge):
+		writeError(w, &api.TooLargeError{Size: -1, Limit: s.opts.MaxBlobSize})
+	default:
+		writeError(w, err)
+	}
+}
+
+// uploadStore returns the upload sessions of the handler.
+func (s *Handler) uploadStore() (*uploadStore, error) {
+	s.uploadsOnce.Do(func() {
+		s.uploads, s.uploadsErr = newUploadStore(s.opts)
+	})
+	return s.uploads, s.uploadsErr
+}
+
+// writeUploadSession writes the state of an upload session as response headers.
+func writeUploadSession(w http.ResponseWriter, up *upload) {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(up.size, 10))
+	w.Header().Set(uploadExpiresHeader, up.expires().UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// uploadSession is the response to the creation of an upload session.
+type uploadSession struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	// Expires is the expiry time in RFC 3339 format.
+	// It is extended every time the session is used.
+	Expires string `json:"expires"`
+}
+
+const (
+	// uploadsPath is the path of the upload session endpoint.
+	uploadsPath = "/cas/uploads"
+	// uploadOffsetHeader holds the number of bytes received by an upload session.
+	uploadOffsetHeader = "Upload-Offset"
+	// uploadExpiresHeader holds the expiry time of an upload session.
+	uploadExpiresHeader = "Upload-Expires"
+)
@@ -2,13 +2,21 @@ package http
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/cas/metrics"
+	"github.com/malt3/abstractfs-core/cas/verify"
 	"github.com/malt3/abstractfs-core/sri"
 )
 
@@ -16,72 +24,365 @@ import (
 // It implements the CAS http protocol.
 // It forwards requests to a CAS backend.
 type Handler struct {
-	cas api.CAS
+	cas      api.CAS
+	opts     HandlerOptions
+	observer *observer
+
+	// uploads are the upload sessions. They are created on first use.
+	uploadsOnce sync.Once
+	uploads     *uploadStore
+	uploadsErr  error
+}
+
+// HandlerOptions are the options of a Handler.
+type HandlerOptions struct {
+	// MaxBlobSize is the maximum size of a blob that can be uploaded.
+	// Zero means no limit.
+	MaxBlobSize int64
+	// UploadDir is the directory used to stage uploads that span multiple requests.
+	// If empty, the default directory for temporary files is used.
+	UploadDir string
+	// UploadExpiry is the time after which an unused upload is removed.
+	// Expired uploads are removed periodically, even if no further requests are served.
+	// If zero, DefaultUploadExpiry is used.
+	UploadExpiry time.Duration
+	// MaxUploads is the maximum number of uploads that span multiple requests at a time.
+	// Further uploads are rejected until uploads are finished or expire.
+	// If zero, DefaultMaxUploads is used.
+	MaxUploads int
+	// MaxUploadBytes is the maximum total size of the staged content of these uploads.
+	// Uploads exceeding it fail. Zero means no limit besides MaxUploads times MaxBlobSize.
+	MaxUploadBytes int64
+	// VerifyReads verifies blobs read from the CAS against their SRI while they are served.
+	// If a blob does not match, the response is aborted, so clients never receive a complete response
+	// for a corrupted blob. Range requests are not supported with verification.
+	VerifyReads bool
+	// Metrics receives metrics of the served requests, labeled with the kind of handler.
+	// Serve the registry itself to expose them. Optional.
+	Metrics *metrics.Registry
+	// Events is notified about every request, e.g. for logging or tracing. Optional.
+	Events EventHook
+	// Index is served as index namespace (/index/), for CAS wrappers that transform blobs
+	// (see package cas). Values are not verified, so only trusted clients should have write access.
+	// If nil, the namespace is not available.
+	Index api.KeyValueStore
 }
 
-func NewHandler(cas api.CAS) http.Handler {
+func NewHandler(cas api.CAS) *Handler {
+	return NewHandlerWithOptions(cas, HandlerOptions{})
+}
+
+// NewHandlerWithOptions creates a new Handler with the given options.
+// Call Close to remove the upload sessions when the handler is no longer used.
+func NewHandlerWithOptions(cas api.CAS, opts HandlerOptions) *Handler {
 	return &Handler{
-		cas: cas,
+		cas:      cas,
+		opts:     opts,
+		observer: newObserver("cas", opts),
+	}
+}
+
+// Close removes all upload sessions and stops removing expired sessions in the background.
+// Upload sessions cannot be created after Close.
+func (s *Handler) Close() error {
+	s.uploadsOnce.Do(func() {
+		s.uploadsErr = errUploadsClosed
+	})
+	if s.uploads != nil {
+		s.uploads.close()
 	}
+	return nil
 }
 
 func (s *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.observer.serve(w, req, s.serve)
+}
+
+func (s *Handler) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == uploadsPath || strings.HasPrefix(req.URL.Path, uploadsPath+"/") {
+		s.handleUpload(w, req)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, indexPath) {
+		s.handleIndex(w, req)
+		return
+	}
 	switch req.Method {
 	case http.MethodGet:
+		if req.URL.Path == listPath {
+			s.handleList(w, req)
+			return
+		}
 		s.handleGet(w, req)
+	case http.MethodHead:
+		s.handleHead(w, req)
 	case http.MethodPut:
 		s.handlePut(w, req)
+	case http.MethodPost:
+		s.handlePost(w, req)
+	case http.MethodDelete:
+		s.handleDelete(w, req)
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeErrorWithStatus(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
 	}
 }
 
 // handleGet handles a GET request.
 // It expects the sri in the following format:
 // /cas/<hash-function>/<hash-value-hex>
+// If the blob can be read at arbitrary offsets, Range and If-Range headers are honored.
 func (s *Handler) handleGet(w http.ResponseWriter, req *http.Request) {
 	integrity, err := parsePath(req.URL.Path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-	body, err := s.cas.Open(integrity.String())
+	s.serveBlob(w, req, integrity)
+}
+
+// serveBlob writes the blob to the response.
+func (s *Handler) serveBlob(w http.ResponseWriter, req *http.Request, integrity sri.Integrity) {
+	body, err := s.openBlob(integrity.String())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, err)
 		return
 	}
 	defer body.Close()
+	serveBody(w, req, integrity, body)
+}
+
+// openBlob opens a blob to be served.
+// If reads are verified, the blob is verified while it is read.
+func (s *Handler) openBlob(sri string) (io.ReadCloser, error) {
+	if s.opts.VerifyReads {
+		return verify.New(s.cas).Open(sri)
+	}
+	if seeker, ok := s.openSeekable(sri); ok {
+		return seeker, nil
+	}
+	return s.cas.Open(sri)
+}
+
+// serveBody writes the body of a blob to the response.
+// Seekable bodies support range requests.
+// If reading fails after the headers were sent, the handler is aborted, which breaks the connection.
+func serveBody(w http.ResponseWriter, req *http.Request, integrity sri.Integrity, body io.Reader) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// blobs are immutable, so the sri is a strong entity tag
+	w.Header().Set("ETag", `"`+integrity.String()+`"`)
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, req, "", time.Time{}, seeker)
+		return
+	}
 	if _, err := io.Copy(w, body); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// the headers were already sent, so the client can only notice the error by the broken connection
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// openSeekable returns a seekable reader for the blob
+// if the CAS supports range reads and stat.
+func (s *Handler) openSeekable(sri string) (io.ReadSeekCloser, bool) {
+	rangeReader, ok := s.cas.(api.CASRangeReader)
+	if !ok {
+		return nil, false
+	}
+	stater, ok := s.cas.(api.CASStater)
+	if !ok {
+		return nil, false
+	}
+	size, err := stater.Stat(sri)
+	if err != nil {
+		// let Open report the error
+		return nil, false
+	}
+	return cas.NewReadSeeker(rangeReader, sri, size), true
+}
+
+// handleHead handles a HEAD request.
+// It responds with the size of the blob as Content-Length.
+func (s *Handler) handleHead(w http.ResponseWriter, req *http.Request) {
+	integrity, err := parsePath(req.URL.Path)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	size, err := cas.Stat(s.cas, integrity.String())
+	if err != nil {
+		// responses to HEAD requests have no body
+		w.WriteHeader(errorStatus(err))
 		return
 	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
 }
 
+// handlePut handles a PUT request.
+// The body is verified against the sri while it is forwarded to the CAS.
+// If the body does not match, the final read fails and the CAS does not commit the blob.
 func (s *Handler) handlePut(w http.ResponseWriter, req *http.Request) {
 	integrity, err := parsePath(req.URL.Path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-	if err := s.cas.Write(integrity.String(), req.Body); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	s.putBlob(w, req, integrity)
+}
+
+// putBlob writes the request body to the CAS while verifying it.
+func (s *Handler) putBlob(w http.ResponseWriter, req *http.Request, integrity sri.Integrity) {
+	body := req.Body
+	if s.opts.MaxBlobSize > 0 {
+		if req.ContentLength > s.opts.MaxBlobSize {
+			writeError(w, &api.TooLargeError{Size: req.ContentLength, Limit: s.opts.MaxBlobSize})
+			return
+		}
+		body = http.MaxBytesReader(w, body, s.opts.MaxBlobSize)
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, req.ContentLength, body)
+	if err != nil {
+		writeErrorWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.cas.Write(integrity.String(), verifier); err != nil {
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
 
+// handleDelete handles a DELETE request.
+// It expects the sri in the following format:
+// /cas/<hash-function>/<hash-value-hex>
+func (s *Handler) handleDelete(w http.ResponseWriter, req *http.Request) {
+	integrity, err := parsePath(req.URL.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	deleter, ok := s.cas.(api.CASDeleter)
+	if !ok {
+		writeErrorWithStatus(w, http.StatusNotImplemented, errors.New("deletion not supported"))
+		return
+	}
+	if err := deleter.Delete(integrity.String()); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleList handles a paginated listing of the blobs in the CAS.
+// It accepts the following query parameters:
+// - algorithm: only list blobs using this hash function
+// - page_size: maximum number of blobs in the response
+// - page_token: token of the page to return, as returned in a previous response
+//
+// The page token is the SRI of the last blob of the previous page.
+// Pages resume after that blob, so a listing costs the same as a single listing of the CAS
+// (if the CAS implements api.CASCursorLister), and blobs deleted between pages do not cause
+// other blobs to be skipped.
+func (s *Handler) handleList(w http.ResponseWriter, req *http.Request) {
+	lister, ok := s.cas.(api.CASLister)
+	if !ok {
+		writeErrorWithStatus(w, http.StatusNotImplemented, errors.New("listing not supported"))
+		return
+	}
+	query := req.URL.Query()
+	algorithm := query.Get("algorithm")
+	if algorithm != "" {
+		if _, err := sri.AlgorithmFromString(algorithm); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	pageSize := defaultListPageSize
+	if rawPageSize := query.Get("page_size"); rawPageSize != "" {
+		var err error
+		pageSize, err = strconv.Atoi(rawPageSize)
+		if err != nil || pageSize <= 0 || pageSize > maxListPageSize {
+			writeErrorWithStatus(w, http.StatusBadRequest, errors.New("invalid page size"))
+			return
+		}
+	}
+	pageToken := query.Get("page_token")
+	if pageToken != "" {
+		if _, err := sri.FromString(pageToken); err != nil {
+			writeErrorWithStatus(w, http.StatusBadRequest, fmt.Errorf("invalid page token: %w", err))
+			return
+		}
+	}
+
+	listResp := listResponse{Blobs: []listedBlob{}}
+	err := cas.ListAfter(lister, algorithm, pageToken, func(blob api.BlobInfo) error {
+		if len(listResp.Blobs) == pageSize {
+			listResp.NextPageToken = listResp.Blobs[pageSize-1].SRI
+			return fs.SkipAll
+		}
+		listResp.Blobs = append(listResp.Blobs, newListedBlob(blob))
+		return nil
+	})
+	if errors.Is(err, cas.ErrCursorNotFound) {
+		writeErrorWithStatus(w, http.StatusBadRequest, fmt.Errorf("invalid page token: %w", err))
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listResp)
+}
+
+func (s *Handler) handlePost(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case missingPath:
+		s.handleMissing(w, req)
+	default:
+		writeErrorWithStatus(w, http.StatusNotFound, errors.New("unknown endpoint"))
+	}
+}
+
+// handleMissing handles a batch existence query.
+// It expects a JSON encoded missingRequest and responds
+// with the subset of the SRIs that are not present in the CAS.
+func (s *Handler) handleMissing(w http.ResponseWriter, req *http.Request) {
+	var missingReq missingRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxMissingRequestSize)).Decode(&missingReq); err != nil {
+		writeErrorWithStatus(w, http.StatusBadRequest, fmt.Errorf("decoding request: %w", err))
+		return
+	}
+	for _, sriString := range missingReq.SRIs {
+		if _, err := sri.FromString(sriString); err != nil {
+			writeError(w, fmt.Errorf("parsing %q: %w", sriString, err))
+			return
+		}
+	}
+	missing, err := cas.FindMissing(s.cas, missingReq.SRIs)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if missing == nil {
+		missing = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(missingResponse{Missing: missing})
+}
+
 // parsePath parses the path and returns the sri.
 // It expects the sri in the following format:
 // /cas/<hash-function>/<hash-value-hex>
 func parsePath(path string) (sri.Integrity, error) {
 	if !strings.HasPrefix(path, "/cas/") {
-		return sri.Integrity{}, errors.New("invalid path: must start with /cas/")
+		return sri.Integrity{}, fmt.Errorf("invalid path: must start with /cas/: %w", api.ErrInvalidSRI)
 	}
 	path = path[len("/cas/"):]
 	parts := strings.Split(path, "/")
 	if len(parts) != 2 {
-		return sri.Integrity{}, errors.New("invalid path: must have format /cas/<hash-function>/<hash-value-hex>")
+		return sri.Integrity{}, fmt.Errorf("invalid path: must have format /cas/<hash-function>/<hash-value-hex>: %w", api.ErrInvalidSRI)
 	}
 	alg, err := sri.AlgorithmFromString(parts[0])
 	if err != nil {
@@ -89,10 +390,82 @@ func parsePath(path string) (sri.Integrity, error) {
 	}
 	hash, err := hex.DecodeString(parts[1])
 	if err != nil {
-		return sri.Integrity{}, fmt.Errorf("invalid path: %w", err)
+		return sri.Integrity{}, fmt.Errorf("invalid path: %w: %w", api.ErrInvalidSRI, err)
+	}
+	if len(hash) != alg.ByteLen() {
+		return sri.Integrity{}, fmt.Errorf("invalid path: %w: invalid hash length: %d", api.ErrInvalidSRI, len(hash))
 	}
 	return sri.Integrity{
 		Algorithm: alg,
 		Hash:      hash,
 	}, nil
 }
+
+// formatPath returns the path of the sri.
+// It is the inverse of parsePath.
+func formatPath(integrity sri.Integrity) string {
+	return "/cas/" + string(integrity.Algorithm) + "/" + integrity.Hex()
+}
+
+// missingRequest is the body of a batch existence query.
+type missingRequest struct {
+	SRIs []string `json:"sris"`
+}
+
+// missingResponse is the response to a batch existence query.
+type missingResponse struct {
+	Missing []string `json:"missing"`
+}
+
+// listResponse is a page of a blob listing.
+type listResponse struct {
+	Blobs []listedBlob `json:"blobs"`
+	// NextPageToken is the token of the next page, the SRI of the last blob of this page.
+	// It is empty on the last page.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// listedBlob is the wire format of api.BlobInfo.
+type listedBlob struct {
+	SRI     string `json:"sri"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mtime,omitempty"`
+}
+
+func newListedBlob(blob api.BlobInfo) listedBlob {
+	listed := listedBlob{SRI: blob.SRI, Size: blob.Size}
+	if !blob.ModTime.IsZero() {
+		listed.ModTime = blob.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	return listed
+}
+
+func (b listedBlob) blobInfo() (api.BlobInfo, error) {
+	blob := api.BlobInfo{SRI: b.SRI, Size: b.Size}
+	if b.ModTime != "" {
+		var err error
+		blob.ModTime, err = time.Parse(time.RFC3339Nano, b.ModTime)
+		if err != nil {
+			return api.BlobInfo{}, err
+		}
+	}
+	return blob, nil
+}
+
+const (
+	// listPath is the path of the blob listing endpoint.
+	listPath = "/cas/"
+	// defaultListPageSize is the page size of a listing if the client does not specify one.
+	defaultListPageSize = 1000
+	// maxListPageSize is the maximum page size of a listing.
+	maxListPageSize = 10000
+)
+
+const (
+	// missingPath is the path of the batch existence query endpoint.
+	missingPath = "/cas/missing"
+	// maxMissingRequestSize is the maximum size of a batch existence query.
+	maxMissingRequestSize = 16 << 20
+	// maxMissingBatch is the maximum number of SRIs the client sends in a single batch existence query.
+	maxMissingBatch = 10000
+)
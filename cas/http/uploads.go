@@ -0,0 +1,359 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// uploadStore keeps the staged content of uploads that span multiple requests.
+// Every upload is staged in a temporary file until it is committed to the CAS.
+// Uploads that are not used for longer than the expiry are removed.
+// While there are uploads, a reaper removes expired uploads periodically,
+// so that abandoned uploads do not keep their staged content until the next request.
+// The number of uploads and the total size of their staged content are limited.
+type uploadStore struct {
+	dir        string
+	expiry     time.Duration
+	maxUploads int
+	maxBytes   int64
+	now        func() time.Time
+	// closed is closed when the store is closed, to stop the reaper.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mux     sync.Mutex
+	uploads map[string]*upload
+	reaping bool
+	// staged is the total size of the staged content of all uploads.
+	staged int64
+}
+
+// newUploadStore creates a new upload store with the upload options of opts.
+func newUploadStore(opts HandlerOptions) (*uploadStore, error) {
+	if opts.UploadDir != "" {
+		if err := os.MkdirAll(opts.UploadDir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating upload directory: %w", err)
+		}
+	}
+	expiry := opts.UploadExpiry
+	if expiry <= 0 {
+		expiry = DefaultUploadExpiry
+	}
+	maxUploads := opts.MaxUploads
+	if maxUploads <= 0 {
+		maxUploads = DefaultMaxUploads
+	}
+	return &uploadStore{
+		dir:        opts.UploadDir,
+		expiry:     expiry,
+		maxUploads: maxUploads,
+		maxBytes:   opts.MaxUploadBytes,
+		now:        time.Now,
+		closed:     make(chan struct{}),
+		uploads:    make(map[string]*upload),
+	}, nil
+}
+
+// create starts a new upload.
+// Expired uploads are removed first, and the reaper is started if it is not running.
+func (u *uploadStore) create() (*upload, error) {
+	select {
+	case <-u.closed:
+		return nil, errUploadsClosed
+	default:
+	}
+	u.removeExpired()
+	id, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(u.dir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating upload: %w", err)
+	}
+	up := &upload{id: id, file: file, store: u}
+	up.touch(u.now().Add(u.expiry))
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if len(u.uploads) >= u.maxUploads {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, errTooManyUploads
+	}
+	u.uploads[id] = up
+	if !u.reaping {
+		u.reaping = true
+		go u.reap()
+	}
+	return up, nil
+}
+
+// get returns the upload with the given id and extends its expiry.
+// Expired uploads are removed instead.
+func (u *uploadStore) get(id string) (*upload, bool) {
+	now := u.now()
+	u.mux.Lock()
+	up, ok := u.uploads[id]
+	if ok && now.After(up.expires()) {
+		delete(u.uploads, id)
+		u.mux.Unlock()
+		up.discard()
+		return nil, false
+	}
+	u.mux.Unlock()
+	if ok {
+		up.touch(now.Add(u.expiry))
+	}
+	return up, ok
+}
+
+// removeExpired removes all expired uploads.
+func (u *uploadStore) removeExpired() {
+	now := u.now()
+	var expired []*upload
+	u.mux.Lock()
+	for id, up := range u.uploads {
+		if now.After(up.expires()) {
+			delete(u.uploads, id)
+			expired = append(expired, up)
+		}
+	}
+	u.mux.Unlock()
+	for _, up := range expired {
+		up.discard()
+	}
+}
+
+// reap removes expired uploads periodically.
+// It stops once there are no uploads left or the store is closed.
+func (u *uploadStore) reap() {
+	interval := u.expiry / 2
+	if interval > maxReapInterval {
+		interval = maxReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.closed:
+			return
+		case <-ticker.C:
+		}
+		u.removeExpired()
+		u.mux.Lock()
+		if len(u.uploads) == 0 {
+			u.reaping = false
+			u.mux.Unlock()
+			return
+		}
+		u.mux.Unlock()
+	}
+}
+
+// reserve charges up to n bytes of staged content against the limit and returns the number of bytes charged.
+func (u *uploadStore) reserve(n int64) int64 {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	if u.maxBytes > 0 {
+		if remaining := u.maxBytes - u.staged; n > remaining {
+			n = remaining
+		}
+		if n < 0 {
+			n = 0
+		}
+	}
+	u.staged += n
+	return n
+}
+
+// release refunds n bytes of staged content.
+func (u *uploadStore) release(n int64) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	u.staged -= n
+}
+
+// remove removes the upload and its staged content.
+func (u *uploadStore) remove(up *upload) {
+	u.mux.Lock()
+	delete(u.uploads, up.id)
+	u.mux.Unlock()
+	up.discard()
+}
+
+// close stops the reaper and removes all uploads.
+func (u *uploadStore) close() {
+	u.closeOnce.Do(func() { close(u.closed) })
+	u.mux.Lock()
+	uploads := u.uploads
+	u.uploads = make(map[string]*upload)
+	u.mux.Unlock()
+	for _, up := range uploads {
+		up.discard()
+	}
+}
+
+// upload is an upload in progress.
+// Callers must hold mux while using it.
+type upload struct {
+	mux   sync.Mutex
+	id    string
+	file  *os.File
+	store *uploadStore
+	size  int64
+	done  bool
+	// discarded is set once the staged content was removed.
+	discarded bool
+
+	// expiresAt is the expiry time in unix nanoseconds.
+	// It is accessed atomically, so that it can be extended while the upload is in use.
+	expiresAt atomic.Int64
+}
+
+// append appends r to the staged content.
+// At most limit bytes are accepted in total, unless limit is zero.
+// If appending fails, the staged content is truncated to its previous size.
+// If keepPartial is set, content that was received before reading r failed is kept instead,
+// so that clients can resume an upload after a dropped connection.
+func (up *upload) append(r io.Reader, limit int64, keepPartial bool) (int64, error) {
+	if up.done {
+		return 0, errUploadDone
+	}
+	if _, err := up.file.Seek(up.size, io.SeekStart); err != nil {
+		return 0, err
+	}
+	src := &errorRecordingReader{r: r}
+	staging := &stagingReader{r: src, store: up.store}
+	var limited io.Reader = staging
+	if limit > 0 {
+		limited = io.LimitReader(staging, limit-up.size+1)
+	}
+	n, err := io.Copy(up.file, limited)
+	if err == nil && limit > 0 && up.size+n > limit {
+		err = errUploadTooLarge
+	}
+	// io.Copy wrote everything that was read before an error of the client.
+	// Otherwise, the content received by this call is dropped.
+	if err != nil && !(keepPartial && err == src.err) {
+		up.file.Truncate(up.size)
+		n = 0
+	}
+	// only the content that is kept remains charged
+	up.store.release(staging.reserved - n)
+	up.size += n
+	return n, err
+}
+
+// commit writes the staged content to the CAS under the given SRI.
+// The content is verified while it is written.
+func (up *upload) commit(cas api.CASWriter, integrity sri.Integrity) error {
+	if up.done {
+		return errUploadDone
+	}
+	if _, err := up.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, up.size, io.LimitReader(up.file, up.size))
+	if err != nil {
+		return err
+	}
+	if err := cas.Write(integrity.String(), verifier); err != nil {
+		return err
+	}
+	up.done = true
+	return nil
+}
+
+// expires returns the expiry time of the upload.
+func (up *upload) expires() time.Time {
+	return time.Unix(0, up.expiresAt.Load())
+}
+
+// touch sets the expiry time of the upload.
+func (up *upload) touch(expires time.Time) {
+	up.expiresAt.Store(expires.UnixNano())
+}
+
+func (up *upload) discard() {
+	up.mux.Lock()
+	defer up.mux.Unlock()
+	up.done = true
+	if up.discarded {
+		return
+	}
+	up.discarded = true
+	up.file.Close()
+	os.Remove(up.file.Name())
+	up.store.release(up.size)
+}
+
+// stagingReader charges the bytes read against the staged content limit of the store.
+type stagingReader struct {
+	r        io.Reader
+	store    *uploadStore
+	reserved int64
+}
+
+func (s *stagingReader) Read(p []byte) (int, error) {
+	allowed := s.store.reserve(int64(len(p)))
+	if allowed == 0 && len(p) > 0 {
+		return 0, errUploadsFull
+	}
+	n, err := s.r.Read(p[:allowed])
+	s.store.release(allowed - int64(n))
+	s.reserved += int64(n)
+	return n, err
+}
+
+// errorRecordingReader remembers the error returned by the underlying reader.
+type errorRecordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generating upload id: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+var (
+	errUploadDone     = errors.New("upload already finished")
+	errUploadTooLarge = errors.New("upload too large")
+
+	// errTooManyUploads is returned if the maximum number of uploads is reached.
+	errTooManyUploads = fmt.Errorf("%w: too many uploads", api.ErrUnavailable)
+	// errUploadsFull is returned if the staged content of all uploads reached its maximum size.
+	errUploadsFull = fmt.Errorf("%w: upload storage full", api.ErrUnavailable)
+	// errUploadsClosed is returned if an upload is created after the handler was closed.
+	errUploadsClosed = fmt.Errorf("%w: handler closed", api.ErrUnavailable)
+)
+
+// DefaultUploadExpiry is the time after which unused uploads are removed, unless configured otherwise.
+const DefaultUploadExpiry = 24 * time.Hour
+
+// DefaultMaxUploads is the maximum number of concurrent uploads, unless configured otherwise.
+const DefaultMaxUploads = 1000
+
+// maxReapInterval is the maximum interval between two removals of expired uploads.
+const maxReapInterval = time.Minute
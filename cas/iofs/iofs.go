@@ -0,0 +1,164 @@
+// Package iofs implements a read-only CAS on top of any io/fs.FS,
+// such as embed.FS, os.DirFS or a TreeFS.
+//
+// A Layout maps every SRI to a path in the file system.
+// Use fs.Sub to serve blobs from a subdirectory.
+package iofs
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// Layout returns the path of the blob with the given SRI.
+// The path must be valid according to fs.ValidPath.
+type Layout func(integrity sri.Integrity) string
+
+// ShardedHex is the layout used by dir.CAS:
+// <hash-function>/<first-two-hex-chars>/<remaining-hex-chars>
+func ShardedHex(integrity sri.Integrity) string {
+	hexHash := integrity.Hex()
+	return path.Join(string(integrity.Algorithm), hexHash[:2], hexHash[2:])
+}
+
+// FlatBase64URL stores all blobs in a single directory,
+// named like the SRI but using the URL-safe base64 alphabet without padding:
+// <hash-function>-<base64url-hash>
+func FlatBase64URL(integrity sri.Integrity) string {
+	return string(integrity.Algorithm) + "-" + base64.RawURLEncoding.EncodeToString(integrity.Hash)
+}
+
+// OCI is the blob layout of OCI image layouts:
+// blobs/<hash-function>/<hex-hash>
+func OCI(integrity sri.Integrity) string {
+	return path.Join("blobs", string(integrity.Algorithm), integrity.Hex())
+}
+
+// Options are the options of a CAS backed by an fs.FS.
+type Options struct {
+	// Layout maps SRIs to paths.
+	// If nil, ShardedHex is used.
+	Layout Layout
+	// Verify verifies the content of blobs against their SRI while reading.
+	// The final Read of a blob that does not match fails with an error wrapping sri.ErrHashMismatch.
+	// Range reads are not verified, since only a part of the blob is read.
+	Verify bool
+}
+
+// CAS is a read-only CAS backed by an fs.FS.
+type CAS struct {
+	fsys fs.FS
+	opts Options
+}
+
+// New creates a new CAS that reads blobs from fsys.
+func New(fsys fs.FS, opts Options) *CAS {
+	if opts.Layout == nil {
+		opts.Layout = ShardedHex
+	}
+	return &CAS{fsys: fsys, opts: opts}
+}
+
+// Open returns a reader for the blob with the given SRI.
+// If the blob does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) Open(sriString string) (io.ReadCloser, error) {
+	integrity, file, info, err := c.open(sriString)
+	if err != nil {
+		return nil, err
+	}
+	if !c.opts.Verify {
+		return file, nil
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, info.Size(), file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: verifier, Closer: file}, nil
+}
+
+// OpenRange returns a reader for length bytes of the blob with the given SRI, starting at offset.
+// A negative length reads until the end of the blob.
+// If the file implements io.Seeker, the range is read directly.
+func (c *CAS) OpenRange(sriString string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("opening range: negative offset")
+	}
+	_, file, _, err := c.open(sriString)
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := file.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("opening range: %w", err)
+		}
+		return cas.LimitReadCloser(file, length), nil
+	}
+	if _, err := io.CopyN(io.Discard, file, offset); err != nil && err != io.EOF {
+		file.Close()
+		return nil, fmt.Errorf("opening range: %w", err)
+	}
+	return cas.LimitReadCloser(file, length), nil
+}
+
+// Stat returns the size of the blob with the given SRI.
+// If the blob does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) Stat(sriString string) (int64, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return 0, err
+	}
+	name := c.opts.Layout(integrity)
+	info, err := fs.Stat(c.fsys, name)
+	if err != nil {
+		return 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return 0, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return info.Size(), nil
+}
+
+// open opens the file of the blob with the given SRI.
+// Anything but a regular file is treated as missing.
+func (c *CAS) open(sriString string) (sri.Integrity, fs.File, fs.FileInfo, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return sri.Integrity{}, nil, nil, err
+	}
+	name := c.opts.Layout(integrity)
+	file, err := c.fsys.Open(name)
+	if err != nil {
+		return sri.Integrity{}, nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return sri.Integrity{}, nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return sri.Integrity{}, nil, nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return integrity, file, info, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var (
+	_ api.CASReader      = (*CAS)(nil)
+	_ api.CASStater      = (*CAS)(nil)
+	_ api.CASRangeReader = (*CAS)(nil)
+)
@@ -0,0 +1,36 @@
+package cas
+
+import (
+	"errors"
+
+	"github.com/malt3/abstractfs-core/api"
+)
+
+// ErrCursorNotFound is returned by ListAfter if the CAS cannot resume a listing
+// because the blob it should resume after no longer exists.
+var ErrCursorNotFound = errors.New("list cursor not found")
+
+// ListAfter calls fn for every blob that the CAS lists after the blob with the SRI after.
+// If the CAS implements api.CASCursorLister, it is used.
+// Otherwise, the CAS is listed from the start and blobs up to after are skipped.
+// In that case, it returns ErrCursorNotFound if after is not listed (e.g. because it was deleted).
+func ListAfter(lister api.CASLister, algorithm, after string, fn func(api.BlobInfo) error) error {
+	if cursorLister, ok := lister.(api.CASCursorLister); ok {
+		return cursorLister.ListAfter(algorithm, after, fn)
+	}
+	if after == "" {
+		return lister.List(algorithm, fn)
+	}
+	found := false
+	err := lister.List(algorithm, func(blob api.BlobInfo) error {
+		if found {
+			return fn(blob)
+		}
+		found = blob.SRI == after
+		return nil
+	})
+	if err == nil && !found {
+		return ErrCursorNotFound
+	}
+	return err
+}
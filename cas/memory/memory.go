@@ -0,0 +1,280 @@
+// Package memory implements an in-memory CAS.
+// It can be bounded in size, in which case the least recently used blobs are evicted.
+// This makes it suitable for tests as well as a cache tier in front of slower CAS implementations.
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// CAS is a concurrency-safe in-memory CAS.
+type CAS struct {
+	mux      sync.Mutex
+	capacity int64
+	size     int64
+	// blobs maps SRIs to elements of lru.
+	blobs map[string]*list.Element
+	// lru holds *entry values, ordered from most to least recently used.
+	lru   *list.List
+	stats Stats
+}
+
+// New creates a new in-memory CAS.
+// If capacity is greater than zero, the total size of the stored blobs is limited to capacity bytes
+// and the least recently used blobs are evicted to make room for new ones.
+func New(capacity int64) *CAS {
+	return &CAS{
+		capacity: capacity,
+		blobs:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Open returns a reader for the given SRI.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) Open(sri string) (io.ReadCloser, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.blobs[sri]
+	if !ok {
+		c.stats.Misses++
+		return nil, &fs.PathError{Op: "open", Path: sri, Err: fs.ErrNotExist}
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(element)
+	return io.NopCloser(bytes.NewReader(element.Value.(*entry).data)), nil
+}
+
+// OpenRange returns a reader for length bytes of the blob with the given SRI, starting at offset.
+// A negative length reads until the end of the blob.
+func (c *CAS) OpenRange(sri string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("opening range: negative offset")
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.blobs[sri]
+	if !ok {
+		c.stats.Misses++
+		return nil, &fs.PathError{Op: "open", Path: sri, Err: fs.ErrNotExist}
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(element)
+	data := element.Value.(*entry).data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Stat returns the size of the blob with the given SRI.
+// It does not affect the eviction order.
+func (c *CAS) Stat(sri string) (int64, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.blobs[sri]
+	if !ok {
+		return 0, &fs.PathError{Op: "stat", Path: sri, Err: fs.ErrNotExist}
+	}
+	return int64(len(element.Value.(*entry).data)), nil
+}
+
+// Write reads the blob into memory and stores it if its contents match the SRI.
+// Blobs larger than the capacity are rejected.
+// Writing a blob that already exists updates its modification time.
+func (c *CAS) Write(sriString string, r io.Reader) error {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return err
+	}
+	if c.touch(sriString) {
+		return nil
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, -1, r)
+	if err != nil {
+		return err
+	}
+	r = verifier
+	if c.capacity > 0 {
+		// stop reading as soon as the blob exceeds the capacity
+		r = io.LimitReader(r, c.capacity+1)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	data := buf.Bytes()
+	if c.capacity > 0 && int64(len(data)) > c.capacity {
+		return fmt.Errorf("writing %s: %w", sriString, &api.TooLargeError{Size: -1, Limit: c.capacity})
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if element, ok := c.blobs[sriString]; ok {
+		// written concurrently
+		element.Value.(*entry).modTime = time.Now()
+		c.lru.MoveToFront(element)
+		return nil
+	}
+	c.blobs[sriString] = c.lru.PushFront(&entry{sri: sriString, data: data, modTime: time.Now()})
+	c.size += int64(len(data))
+	for c.capacity > 0 && c.size > c.capacity {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	return nil
+}
+
+// Has returns true if the blob with the given SRI exists.
+// It does not affect the eviction order or the statistics.
+func (c *CAS) Has(sri string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	_, ok := c.blobs[sri]
+	return ok
+}
+
+// touch updates the modification time of the blob with the given SRI,
+// so that a garbage collection grace period also protects existing blobs that are written again.
+// It returns false if the blob does not exist.
+func (c *CAS) touch(sri string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.blobs[sri]
+	if ok {
+		element.Value.(*entry).modTime = time.Now()
+	}
+	return ok
+}
+
+// List calls fn for every blob in the CAS that uses the given algorithm.
+// An empty algorithm lists blobs of all algorithms.
+// Blobs are visited in lexical order of their SRI.
+func (c *CAS) List(algorithm string, fn func(api.BlobInfo) error) error {
+	return c.ListAfter(algorithm, "", fn)
+}
+
+// ListAfter is like List, but only visits blobs whose SRI sorts after the SRI after.
+func (c *CAS) ListAfter(algorithm, after string, fn func(api.BlobInfo) error) error {
+	if algorithm != "" {
+		if _, err := sri.AlgorithmFromString(algorithm); err != nil {
+			return err
+		}
+	}
+	c.mux.Lock()
+	blobs := make([]api.BlobInfo, 0, len(c.blobs))
+	for sri, element := range c.blobs {
+		if algorithm != "" && !strings.HasPrefix(sri, algorithm+"-") || sri <= after {
+			continue
+		}
+		e := element.Value.(*entry)
+		blobs = append(blobs, api.BlobInfo{SRI: sri, Size: int64(len(e.data)), ModTime: e.modTime})
+	}
+	c.mux.Unlock()
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].SRI < blobs[j].SRI
+	})
+	for _, blob := range blobs {
+		if err := fn(blob); err != nil {
+			if err == fs.SkipAll {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the blob with the given SRI.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) Delete(sri string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.blobs[sri]
+	if !ok {
+		return &fs.PathError{Op: "delete", Path: sri, Err: fs.ErrNotExist}
+	}
+	c.remove(element)
+	return nil
+}
+
+// DeleteIfOlder removes the blob with the given SRI if it was last modified before cutoff.
+// If the SRI does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) DeleteIfOlder(sri string, cutoff time.Time) (bool, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	element, ok := c.blobs[sri]
+	if !ok {
+		return false, &fs.PathError{Op: "delete", Path: sri, Err: fs.ErrNotExist}
+	}
+	if !element.Value.(*entry).modTime.Before(cutoff) {
+		return false, nil
+	}
+	c.remove(element)
+	return true, nil
+}
+
+// Stats returns a snapshot of the statistics of the CAS.
+func (c *CAS) Stats() Stats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	stats := c.stats
+	stats.Blobs = len(c.blobs)
+	stats.Size = c.size
+	return stats
+}
+
+// remove removes the element from the CAS.
+// The caller must hold the lock.
+func (c *CAS) remove(element *list.Element) {
+	e := c.lru.Remove(element).(*entry)
+	delete(c.blobs, e.sri)
+	c.size -= int64(len(e.data))
+}
+
+// Stats are the statistics of a CAS.
+type Stats struct {
+	// Hits is the number of reads of blobs that were present.
+	Hits uint64
+	// Misses is the number of reads of blobs that were not present.
+	Misses uint64
+	// Evictions is the number of blobs that were evicted to stay within the capacity.
+	Evictions uint64
+	// Blobs is the number of blobs currently stored.
+	Blobs int
+	// Size is the total size of the blobs currently stored.
+	Size int64
+}
+
+type entry struct {
+	sri     string
+	data    []byte
+	modTime time.Time
+}
+
+var (
+	_ api.CAS                   = (*CAS)(nil)
+	_ api.CASStater             = (*CAS)(nil)
+	_ api.CASRangeReader        = (*CAS)(nil)
+	_ api.CASLister             = (*CAS)(nil)
+	_ api.CASCursorLister       = (*CAS)(nil)
+	_ api.CASDeleter            = (*CAS)(nil)
+	_ api.CASConditionalDeleter = (*CAS)(nil)
+)
@@ -0,0 +1,393 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+)
+
+// Options are the options of an instrumented CAS.
+type Options struct {
+	// Registry receives the metrics of the CAS. If nil, no metrics are recorded.
+	Registry *Registry
+	// Name is the value of the "cas" label of all metrics,
+	// so that multiple instrumented backends can share a registry.
+	Name string
+	// Hook is called after every operation, e.g. for logging or tracing. Optional.
+	Hook Hook
+}
+
+// Hook observes the operations of an instrumented CAS.
+type Hook interface {
+	// OperationFinished is called after an operation finished.
+	// It must be safe for concurrent use.
+	OperationFinished(event Event)
+}
+
+// HookFunc is a function that implements Hook.
+type HookFunc func(event Event)
+
+// OperationFinished calls f(event).
+func (f HookFunc) OperationFinished(event Event) {
+	f(event)
+}
+
+// Event describes a finished operation of an instrumented CAS.
+type Event struct {
+	// Op is the operation: "open", "open_range", "stat", "write", "delete", "delete_if_older",
+	// "find_missing", "list" or "list_after".
+	Op string
+	// SRI is the SRI of the blob. It is empty for find_missing and list operations.
+	SRI string
+	// Size is the number of bytes read or written, or the size returned by Stat.
+	// For find_missing, it is the number of queried SRIs and for list operations the number of listed blobs.
+	Size int64
+	// Duration is the time spent in the operation.
+	// For reads, it spans from opening the blob until the reader was closed.
+	// For list operations, it includes the time spent in the callback.
+	Duration time.Duration
+	// Err is the error of the operation, if any.
+	Err error
+}
+
+// CAS is a CAS that records metrics for the operations of a backend.
+//
+// It records the following metrics, labeled with the name of the CAS:
+//
+//	abstractfs_cas_operations_total{cas,op,result}       operations by result ("ok", "not_found" or "error")
+//	abstractfs_cas_operation_duration_seconds{cas,op}    backend latency; for reads until the blob was opened
+//	abstractfs_cas_read_bytes_total{cas}                 bytes read from the backend
+//	abstractfs_cas_written_bytes_total{cas}              bytes written to the backend
+//	abstractfs_cas_blob_size_bytes{cas,op}               sizes of blobs that were written or read completely
+//
+// The CAS returned by NewCAS implements the optional interfaces of the api package
+// that the backend implements.
+type CAS struct {
+	backend api.CAS
+	opts    Options
+	now     func() time.Time
+
+	operations   *Counter
+	latency      *Histogram
+	readBytes    *Counter
+	writtenBytes *Counter
+	blobSizes    *Histogram
+}
+
+//go:generate go run gen.go
+
+// NewCAS creates a new instrumented CAS on top of backend.
+// The result implements the same optional interfaces of the api package as backend,
+// so that callers can still detect missing capabilities,
+// e.g. to fall back to reading a blob instead of calling Stat.
+func NewCAS(backend api.CAS, opts Options) api.CAS {
+	return withInterfaces(newCAS(backend, opts), capabilitiesOf(backend))
+}
+
+func newCAS(backend api.CAS, opts Options) *CAS {
+	c := &CAS{backend: backend, opts: opts, now: time.Now}
+	if opts.Registry != nil {
+		c.operations = opts.Registry.Counter("abstractfs_cas_operations_total",
+			"Number of CAS operations by result.", "cas", "op", "result")
+		c.latency = opts.Registry.Histogram("abstractfs_cas_operation_duration_seconds",
+			"Latency of CAS backend operations in seconds.", DurationBuckets, "cas", "op")
+		c.readBytes = opts.Registry.Counter("abstractfs_cas_read_bytes_total",
+			"Number of bytes read from the CAS backend.", "cas")
+		c.writtenBytes = opts.Registry.Counter("abstractfs_cas_written_bytes_total",
+			"Number of bytes written to the CAS backend.", "cas")
+		c.blobSizes = opts.Registry.Histogram("abstractfs_cas_blob_size_bytes",
+			"Sizes of blobs written to or completely read from the CAS backend.", SizeBuckets, "cas", "op")
+	}
+	return c
+}
+
+// Open opens the blob in the backend.
+// Bytes read are recorded when the reader is closed.
+func (c *CAS) Open(sri string) (io.ReadCloser, error) {
+	start := c.now()
+	body, err := c.backend.Open(sri)
+	return c.wrapReader(opOpen, sri, start, body, err)
+}
+
+// Write writes the blob to the backend.
+func (c *CAS) Write(sri string, r io.Reader) error {
+	start := c.now()
+	counter := &countingReader{r: r}
+	err := c.backend.Write(sri, counter)
+	if c.writtenBytes != nil {
+		c.writtenBytes.Add(float64(counter.n), c.opts.Name)
+		if err == nil {
+			c.blobSizes.Observe(float64(counter.n), c.opts.Name, opWrite)
+		}
+	}
+	c.finish(Event{Op: opWrite, SRI: sri, Size: counter.n, Duration: c.now().Sub(start), Err: err})
+	return err
+}
+
+// stater implements api.CASStater for backends that implement it.
+type stater struct{ c *CAS }
+
+// Stat returns the size of the blob from the backend.
+func (s stater) Stat(sri string) (int64, error) {
+	c := s.c
+	start := c.now()
+	size, err := c.backend.(api.CASStater).Stat(sri)
+	c.finish(Event{Op: opStat, SRI: sri, Size: size, Duration: c.now().Sub(start), Err: err})
+	return size, err
+}
+
+// rangeReader implements api.CASRangeReader for backends that implement it.
+type rangeReader struct{ c *CAS }
+
+// OpenRange opens a part of the blob in the backend.
+func (r rangeReader) OpenRange(sri string, offset, length int64) (io.ReadCloser, error) {
+	c := r.c
+	start := c.now()
+	body, err := c.backend.(api.CASRangeReader).OpenRange(sri, offset, length)
+	return c.wrapReader(opOpenRange, sri, start, body, err)
+}
+
+// deleter implements api.CASDeleter for backends that implement it.
+type deleter struct{ c *CAS }
+
+// Delete removes the blob from the backend.
+func (d deleter) Delete(sri string) error {
+	c := d.c
+	start := c.now()
+	err := c.backend.(api.CASDeleter).Delete(sri)
+	c.finish(Event{Op: opDelete, SRI: sri, Duration: c.now().Sub(start), Err: err})
+	return err
+}
+
+// conditionalDeleter implements api.CASConditionalDeleter for backends that implement it.
+type conditionalDeleter struct{ c *CAS }
+
+// DeleteIfOlder removes the blob from the backend if it was last modified before cutoff.
+func (d conditionalDeleter) DeleteIfOlder(sri string, cutoff time.Time) (bool, error) {
+	c := d.c
+	start := c.now()
+	deleted, err := c.backend.(api.CASConditionalDeleter).DeleteIfOlder(sri, cutoff)
+	c.finish(Event{Op: opDeleteIfOlder, SRI: sri, Duration: c.now().Sub(start), Err: err})
+	return deleted, err
+}
+
+// missingFinder implements api.CASMissingFinder for backends that implement it.
+type missingFinder struct{ c *CAS }
+
+// FindMissing queries the backend for the given SRIs.
+func (f missingFinder) FindMissing(sris []string) ([]string, error) {
+	c := f.c
+	start := c.now()
+	missing, err := c.backend.(api.CASMissingFinder).FindMissing(sris)
+	c.finish(Event{Op: opFindMissing, Size: int64(len(sris)), Duration: c.now().Sub(start), Err: err})
+	return missing, err
+}
+
+// lister implements api.CASLister for backends that implement it.
+type lister struct{ c *CAS }
+
+// List lists the blobs of the backend.
+func (l lister) List(algorithm string, fn func(api.BlobInfo) error) error {
+	return l.c.list(opList, fn, func(fn func(api.BlobInfo) error) error {
+		return l.c.backend.(api.CASLister).List(algorithm, fn)
+	})
+}
+
+// cursorLister implements api.CASCursorLister for backends that implement it.
+type cursorLister struct{ c *CAS }
+
+// List lists the blobs of the backend.
+func (l cursorLister) List(algorithm string, fn func(api.BlobInfo) error) error {
+	return lister(l).List(algorithm, fn)
+}
+
+// ListAfter lists the blobs of the backend after the given SRI.
+func (l cursorLister) ListAfter(algorithm, after string, fn func(api.BlobInfo) error) error {
+	return l.c.list(opListAfter, fn, func(fn func(api.BlobInfo) error) error {
+		return l.c.backend.(api.CASCursorLister).ListAfter(algorithm, after, fn)
+	})
+}
+
+// list records a list operation that calls fn for every blob.
+func (c *CAS) list(op string, fn func(api.BlobInfo) error, list func(func(api.BlobInfo) error) error) error {
+	start := c.now()
+	var n int64
+	err := list(func(blob api.BlobInfo) error {
+		n++
+		return fn(blob)
+	})
+	c.finish(Event{Op: op, Size: n, Duration: c.now().Sub(start), Err: err})
+	return err
+}
+
+// capabilities is a set of optional interfaces of a backend.
+type capabilities uint8
+
+const (
+	capStat capabilities = 1 << iota
+	capRange
+	capDelete
+	capConditionalDelete
+	capFindMissing
+	// capList and capListAfter are mutually exclusive, since api.CASCursorLister includes api.CASLister.
+	capList
+	capListAfter
+)
+
+// capabilitiesOf returns the optional interfaces implemented by backend.
+func capabilitiesOf(backend api.CAS) capabilities {
+	var caps capabilities
+	if _, ok := backend.(api.CASStater); ok {
+		caps |= capStat
+	}
+	if _, ok := backend.(api.CASRangeReader); ok {
+		caps |= capRange
+	}
+	if _, ok := backend.(api.CASDeleter); ok {
+		caps |= capDelete
+	}
+	if _, ok := backend.(api.CASConditionalDeleter); ok {
+		caps |= capConditionalDelete
+	}
+	if _, ok := backend.(api.CASMissingFinder); ok {
+		caps |= capFindMissing
+	}
+	if _, ok := backend.(api.CASCursorLister); ok {
+		caps |= capListAfter
+	} else if _, ok := backend.(api.CASLister); ok {
+		caps |= capList
+	}
+	return caps
+}
+
+// wrapReader records the outcome of opening a blob and wraps the reader to count the bytes read.
+func (c *CAS) wrapReader(op, sri string, start time.Time, body io.ReadCloser, err error) (io.ReadCloser, error) {
+	if c.latency != nil {
+		c.latency.Observe(c.now().Sub(start).Seconds(), c.opts.Name, op)
+	}
+	if err != nil {
+		c.count(op, err)
+		c.notify(Event{Op: op, SRI: sri, Duration: c.now().Sub(start), Err: err})
+		return nil, err
+	}
+	return &instrumentedReader{cas: c, op: op, sri: sri, start: start, body: body}, nil
+}
+
+// finish records a finished operation that was not a read.
+func (c *CAS) finish(event Event) {
+	if c.latency != nil {
+		c.latency.Observe(event.Duration.Seconds(), c.opts.Name, event.Op)
+	}
+	c.count(event.Op, event.Err)
+	c.notify(event)
+}
+
+func (c *CAS) count(op string, err error) {
+	if c.operations != nil {
+		c.operations.Inc(c.opts.Name, op, result(err))
+	}
+}
+
+func (c *CAS) notify(event Event) {
+	if c.opts.Hook != nil {
+		c.opts.Hook.OperationFinished(event)
+	}
+}
+
+// instrumentedReader counts the bytes read from a blob and records them when it is closed.
+type instrumentedReader struct {
+	cas    *CAS
+	op     string
+	sri    string
+	start  time.Time
+	body   io.ReadCloser
+	n      int64
+	eof    bool
+	err    error
+	closed bool
+}
+
+func (r *instrumentedReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.n += int64(n)
+	if err == io.EOF {
+		r.eof = true
+	} else if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// Close closes the body and records the read.
+// Only the first call is recorded.
+func (r *instrumentedReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	closeErr := r.body.Close()
+	err := r.err
+	if err == nil {
+		err = closeErr
+	}
+	c := r.cas
+	if c.readBytes != nil {
+		c.readBytes.Add(float64(r.n), c.opts.Name)
+		if r.eof && err == nil && r.op == opOpen {
+			c.blobSizes.Observe(float64(r.n), c.opts.Name, r.op)
+		}
+	}
+	c.count(r.op, err)
+	c.notify(Event{Op: r.op, SRI: r.sri, Size: r.n, Duration: c.now().Sub(r.start), Err: err})
+	return closeErr
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// result returns the value of the result label for an error.
+func result(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not_found"
+	}
+	return "error"
+}
+
+const (
+	opOpen          = "open"
+	opOpenRange     = "open_range"
+	opStat          = "stat"
+	opWrite         = "write"
+	opDelete        = "delete"
+	opDeleteIfOlder = "delete_if_older"
+	opFindMissing   = "find_missing"
+	opList          = "list"
+	opListAfter     = "list_after"
+)
+
+var (
+	_ api.CAS            = (*CAS)(nil)
+	_ api.CASStater      = stater{}
+	_ api.CASRangeReader = rangeReader{}
+	_ api.CASDeleter     = deleter{}
+
+	_ api.CASConditionalDeleter = conditionalDeleter{}
+	_ api.CASMissingFinder      = missingFinder{}
+	_ api.CASLister             = lister{}
+	_ api.CASCursorLister       = cursorLister{}
+)
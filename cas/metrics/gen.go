@@ -0,0 +1,90 @@
+//go:build ignore
+
+// gen generates interfaces_gen.go, which combines the method holders
+// of the optional interfaces implemented by a backend.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+)
+
+// holder is a method holder type of an optional interface.
+type holder struct {
+	capability string
+	typ        string
+}
+
+// independent are the holders that can be combined freely.
+var independent = []holder{
+	{"capStat", "stater"},
+	{"capRange", "rangeReader"},
+	{"capDelete", "deleter"},
+	{"capConditionalDelete", "conditionalDeleter"},
+	{"capFindMissing", "missingFinder"},
+}
+
+// listers are mutually exclusive, since cursorLister includes List.
+var listers = []holder{
+	{},
+	{"capList", "lister"},
+	{"capListAfter", "cursorLister"},
+}
+
+func main() {
+	var buf bytes.Buffer
+	buf.WriteString(`// Code generated by gen.go. DO NOT EDIT.
+
+package metrics
+
+import "github.com/malt3/abstractfs-core/api"
+
+// withInterfaces returns c with the method holders of the given capabilities embedded,
+// so that the result implements exactly the optional interfaces of the backend.
+func withInterfaces(c *CAS, caps capabilities) api.CAS {
+	switch caps {
+`)
+	for _, lister := range listers {
+		for mask := 0; mask < 1<<len(independent); mask++ {
+			var holders []holder
+			for i, h := range independent {
+				if mask&(1<<i) != 0 {
+					holders = append(holders, h)
+				}
+			}
+			if lister.typ != "" {
+				holders = append(holders, lister)
+			}
+			if len(holders) == 0 {
+				continue
+			}
+			writeCase(&buf, holders)
+		}
+	}
+	buf.WriteString(`	}
+	return c
+}
+`)
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("interfaces_gen.go", src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeCase(buf *bytes.Buffer, holders []holder) {
+	var caps, fields, values []string
+	for _, h := range holders {
+		caps = append(caps, h.capability)
+		fields = append(fields, h.typ)
+		values = append(values, h.typ+"{c}")
+	}
+	fmt.Fprintf(buf, "\tcase %s:\n", strings.Join(caps, " | "))
+	fmt.Fprintf(buf, "\t\treturn struct {\n\t\t\t*CAS\n\t\t\t%s\n\t\t}{c, %s}\n", strings.Join(fields, "\n\t\t\t"), strings.Join(values, ", "))
+}
@@ -0,0 +1,697 @@
+// Code generated by gen.go. DO NOT EDIT.
+
+package metrics
+
+import "github.com/malt3/abstractfs-core/api"
+
+// withInterfaces returns c with the method holders of the given capabilities embedded,
+// so that the result implements exactly the optional interfaces of the backend.
+func withInterfaces(c *CAS, caps capabilities) api.CAS {
+	switch caps {
+	case capStat:
+		return struct {
+			*CAS
+			stater
+		}{c, stater{c}}
+	case capRange:
+		return struct {
+			*CAS
+			rangeReader
+		}{c, rangeReader{c}}
+	case capStat | capRange:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+		}{c, stater{c}, rangeReader{c}}
+	case capDelete:
+		return struct {
+			*CAS
+			deleter
+		}{c, deleter{c}}
+	case capStat | capDelete:
+		return struct {
+			*CAS
+			stater
+			deleter
+		}{c, stater{c}, deleter{c}}
+	case capRange | capDelete:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+		}{c, rangeReader{c}, deleter{c}}
+	case capStat | capRange | capDelete:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+		}{c, stater{c}, rangeReader{c}, deleter{c}}
+	case capConditionalDelete:
+		return struct {
+			*CAS
+			conditionalDeleter
+		}{c, conditionalDeleter{c}}
+	case capStat | capConditionalDelete:
+		return struct {
+			*CAS
+			stater
+			conditionalDeleter
+		}{c, stater{c}, conditionalDeleter{c}}
+	case capRange | capConditionalDelete:
+		return struct {
+			*CAS
+			rangeReader
+			conditionalDeleter
+		}{c, rangeReader{c}, conditionalDeleter{c}}
+	case capStat | capRange | capConditionalDelete:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			conditionalDeleter
+		}{c, stater{c}, rangeReader{c}, conditionalDeleter{c}}
+	case capDelete | capConditionalDelete:
+		return struct {
+			*CAS
+			deleter
+			conditionalDeleter
+		}{c, deleter{c}, conditionalDeleter{c}}
+	case capStat | capDelete | capConditionalDelete:
+		return struct {
+			*CAS
+			stater
+			deleter
+			conditionalDeleter
+		}{c, stater{c}, deleter{c}, conditionalDeleter{c}}
+	case capRange | capDelete | capConditionalDelete:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			conditionalDeleter
+		}{c, rangeReader{c}, deleter{c}, conditionalDeleter{c}}
+	case capStat | capRange | capDelete | capConditionalDelete:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			conditionalDeleter
+		}{c, stater{c}, rangeReader{c}, deleter{c}, conditionalDeleter{c}}
+	case capFindMissing:
+		return struct {
+			*CAS
+			missingFinder
+		}{c, missingFinder{c}}
+	case capStat | capFindMissing:
+		return struct {
+			*CAS
+			stater
+			missingFinder
+		}{c, stater{c}, missingFinder{c}}
+	case capRange | capFindMissing:
+		return struct {
+			*CAS
+			rangeReader
+			missingFinder
+		}{c, rangeReader{c}, missingFinder{c}}
+	case capStat | capRange | capFindMissing:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			missingFinder
+		}{c, stater{c}, rangeReader{c}, missingFinder{c}}
+	case capDelete | capFindMissing:
+		return struct {
+			*CAS
+			deleter
+			missingFinder
+		}{c, deleter{c}, missingFinder{c}}
+	case capStat | capDelete | capFindMissing:
+		return struct {
+			*CAS
+			stater
+			deleter
+			missingFinder
+		}{c, stater{c}, deleter{c}, missingFinder{c}}
+	case capRange | capDelete | capFindMissing:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			missingFinder
+		}{c, rangeReader{c}, deleter{c}, missingFinder{c}}
+	case capStat | capRange | capDelete | capFindMissing:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			missingFinder
+		}{c, stater{c}, rangeReader{c}, deleter{c}, missingFinder{c}}
+	case capConditionalDelete | capFindMissing:
+		return struct {
+			*CAS
+			conditionalDeleter
+			missingFinder
+		}{c, conditionalDeleter{c}, missingFinder{c}}
+	case capStat | capConditionalDelete | capFindMissing:
+		return struct {
+			*CAS
+			stater
+			conditionalDeleter
+			missingFinder
+		}{c, stater{c}, conditionalDeleter{c}, missingFinder{c}}
+	case capRange | capConditionalDelete | capFindMissing:
+		return struct {
+			*CAS
+			rangeReader
+			conditionalDeleter
+			missingFinder
+		}{c, rangeReader{c}, conditionalDeleter{c}, missingFinder{c}}
+	case capStat | capRange | capConditionalDelete | capFindMissing:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			conditionalDeleter
+			missingFinder
+		}{c, stater{c}, rangeReader{c}, conditionalDeleter{c}, missingFinder{c}}
+	case capDelete | capConditionalDelete | capFindMissing:
+		return struct {
+			*CAS
+			deleter
+			conditionalDeleter
+			missingFinder
+		}{c, deleter{c}, conditionalDeleter{c}, missingFinder{c}}
+	case capStat | capDelete | capConditionalDelete | capFindMissing:
+		return struct {
+			*CAS
+			stater
+			deleter
+			conditionalDeleter
+			missingFinder
+		}{c, stater{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}}
+	case capRange | capDelete | capConditionalDelete | capFindMissing:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			conditionalDeleter
+			missingFinder
+		}{c, rangeReader{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}}
+	case capStat | capRange | capDelete | capConditionalDelete | capFindMissing:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			conditionalDeleter
+			missingFinder
+		}{c, stater{c}, rangeReader{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}}
+	case capList:
+		return struct {
+			*CAS
+			lister
+		}{c, lister{c}}
+	case capStat | capList:
+		return struct {
+			*CAS
+			stater
+			lister
+		}{c, stater{c}, lister{c}}
+	case capRange | capList:
+		return struct {
+			*CAS
+			rangeReader
+			lister
+		}{c, rangeReader{c}, lister{c}}
+	case capStat | capRange | capList:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			lister
+		}{c, stater{c}, rangeReader{c}, lister{c}}
+	case capDelete | capList:
+		return struct {
+			*CAS
+			deleter
+			lister
+		}{c, deleter{c}, lister{c}}
+	case capStat | capDelete | capList:
+		return struct {
+			*CAS
+			stater
+			deleter
+			lister
+		}{c, stater{c}, deleter{c}, lister{c}}
+	case capRange | capDelete | capList:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			lister
+		}{c, rangeReader{c}, deleter{c}, lister{c}}
+	case capStat | capRange | capDelete | capList:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			lister
+		}{c, stater{c}, rangeReader{c}, deleter{c}, lister{c}}
+	case capConditionalDelete | capList:
+		return struct {
+			*CAS
+			conditionalDeleter
+			lister
+		}{c, conditionalDeleter{c}, lister{c}}
+	case capStat | capConditionalDelete | capList:
+		return struct {
+			*CAS
+			stater
+			conditionalDeleter
+			lister
+		}{c, stater{c}, conditionalDeleter{c}, lister{c}}
+	case capRange | capConditionalDelete | capList:
+		return struct {
+			*CAS
+			rangeReader
+			conditionalDeleter
+			lister
+		}{c, rangeReader{c}, conditionalDeleter{c}, lister{c}}
+	case capStat | capRange | capConditionalDelete | capList:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			conditionalDeleter
+			lister
+		}{c, stater{c}, rangeReader{c}, conditionalDeleter{c}, lister{c}}
+	case capDelete | capConditionalDelete | capList:
+		return struct {
+			*CAS
+			deleter
+			conditionalDeleter
+			lister
+		}{c, deleter{c}, conditionalDeleter{c}, lister{c}}
+	case capStat | capDelete | capConditionalDelete | capList:
+		return struct {
+			*CAS
+			stater
+			deleter
+			conditionalDeleter
+			lister
+		}{c, stater{c}, deleter{c}, conditionalDeleter{c}, lister{c}}
+	case capRange | capDelete | capConditionalDelete | capList:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			conditionalDeleter
+			lister
+		}{c, rangeReader{c}, deleter{c}, conditionalDeleter{c}, lister{c}}
+	case capStat | capRange | capDelete | capConditionalDelete | capList:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			conditionalDeleter
+			lister
+		}{c, stater{c}, rangeReader{c}, deleter{c}, conditionalDeleter{c}, lister{c}}
+	case capFindMissing | capList:
+		return struct {
+			*CAS
+			missingFinder
+			lister
+		}{c, missingFinder{c}, lister{c}}
+	case capStat | capFindMissing | capList:
+		return struct {
+			*CAS
+			stater
+			missingFinder
+			lister
+		}{c, stater{c}, missingFinder{c}, lister{c}}
+	case capRange | capFindMissing | capList:
+		return struct {
+			*CAS
+			rangeReader
+			missingFinder
+			lister
+		}{c, rangeReader{c}, missingFinder{c}, lister{c}}
+	case capStat | capRange | capFindMissing | capList:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			missingFinder
+			lister
+		}{c, stater{c}, rangeReader{c}, missingFinder{c}, lister{c}}
+	case capDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			deleter
+			missingFinder
+			lister
+		}{c, deleter{c}, missingFinder{c}, lister{c}}
+	case capStat | capDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			stater
+			deleter
+			missingFinder
+			lister
+		}{c, stater{c}, deleter{c}, missingFinder{c}, lister{c}}
+	case capRange | capDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			missingFinder
+			lister
+		}{c, rangeReader{c}, deleter{c}, missingFinder{c}, lister{c}}
+	case capStat | capRange | capDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			missingFinder
+			lister
+		}{c, stater{c}, rangeReader{c}, deleter{c}, missingFinder{c}, lister{c}}
+	case capConditionalDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			conditionalDeleter
+			missingFinder
+			lister
+		}{c, conditionalDeleter{c}, missingFinder{c}, lister{c}}
+	case capStat | capConditionalDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			stater
+			conditionalDeleter
+			missingFinder
+			lister
+		}{c, stater{c}, conditionalDeleter{c}, missingFinder{c}, lister{c}}
+	case capRange | capConditionalDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			rangeReader
+			conditionalDeleter
+			missingFinder
+			lister
+		}{c, rangeReader{c}, conditionalDeleter{c}, missingFinder{c}, lister{c}}
+	case capStat | capRange | capConditionalDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			conditionalDeleter
+			missingFinder
+			lister
+		}{c, stater{c}, rangeReader{c}, conditionalDeleter{c}, missingFinder{c}, lister{c}}
+	case capDelete | capConditionalDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			deleter
+			conditionalDeleter
+			missingFinder
+			lister
+		}{c, deleter{c}, conditionalDeleter{c}, missingFinder{c}, lister{c}}
+	case capStat | capDelete | capConditionalDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			stater
+			deleter
+			conditionalDeleter
+			missingFinder
+			lister
+		}{c, stater{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}, lister{c}}
+	case capRange | capDelete | capConditionalDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			conditionalDeleter
+			missingFinder
+			lister
+		}{c, rangeReader{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}, lister{c}}
+	case capStat | capRange | capDelete | capConditionalDelete | capFindMissing | capList:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			conditionalDeleter
+			missingFinder
+			lister
+		}{c, stater{c}, rangeReader{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}, lister{c}}
+	case capListAfter:
+		return struct {
+			*CAS
+			cursorLister
+		}{c, cursorLister{c}}
+	case capStat | capListAfter:
+		return struct {
+			*CAS
+			stater
+			cursorLister
+		}{c, stater{c}, cursorLister{c}}
+	case capRange | capListAfter:
+		return struct {
+			*CAS
+			rangeReader
+			cursorLister
+		}{c, rangeReader{c}, cursorLister{c}}
+	case capStat | capRange | capListAfter:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			cursorLister
+		}{c, stater{c}, rangeReader{c}, cursorLister{c}}
+	case capDelete | capListAfter:
+		return struct {
+			*CAS
+			deleter
+			cursorLister
+		}{c, deleter{c}, cursorLister{c}}
+	case capStat | capDelete | capListAfter:
+		return struct {
+			*CAS
+			stater
+			deleter
+			cursorLister
+		}{c, stater{c}, deleter{c}, cursorLister{c}}
+	case capRange | capDelete | capListAfter:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			cursorLister
+		}{c, rangeReader{c}, deleter{c}, cursorLister{c}}
+	case capStat | capRange | capDelete | capListAfter:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			cursorLister
+		}{c, stater{c}, rangeReader{c}, deleter{c}, cursorLister{c}}
+	case capConditionalDelete | capListAfter:
+		return struct {
+			*CAS
+			conditionalDeleter
+			cursorLister
+		}{c, conditionalDeleter{c}, cursorLister{c}}
+	case capStat | capConditionalDelete | capListAfter:
+		return struct {
+			*CAS
+			stater
+			conditionalDeleter
+			cursorLister
+		}{c, stater{c}, conditionalDeleter{c}, cursorLister{c}}
+	case capRange | capConditionalDelete | capListAfter:
+		return struct {
+			*CAS
+			rangeReader
+			conditionalDeleter
+			cursorLister
+		}{c, rangeReader{c}, conditionalDeleter{c}, cursorLister{c}}
+	case capStat | capRange | capConditionalDelete | capListAfter:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			conditionalDeleter
+			cursorLister
+		}{c, stater{c}, rangeReader{c}, conditionalDeleter{c}, cursorLister{c}}
+	case capDelete | capConditionalDelete | capListAfter:
+		return struct {
+			*CAS
+			deleter
+			conditionalDeleter
+			cursorLister
+		}{c, deleter{c}, conditionalDeleter{c}, cursorLister{c}}
+	case capStat | capDelete | capConditionalDelete | capListAfter:
+		return struct {
+			*CAS
+			stater
+			deleter
+			conditionalDeleter
+			cursorLister
+		}{c, stater{c}, deleter{c}, conditionalDeleter{c}, cursorLister{c}}
+	case capRange | capDelete | capConditionalDelete | capListAfter:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			conditionalDeleter
+			cursorLister
+		}{c, rangeReader{c}, deleter{c}, conditionalDeleter{c}, cursorLister{c}}
+	case capStat | capRange | capDelete | capConditionalDelete | capListAfter:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			conditionalDeleter
+			cursorLister
+		}{c, stater{c}, rangeReader{c}, deleter{c}, conditionalDeleter{c}, cursorLister{c}}
+	case capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			missingFinder
+			cursorLister
+		}{c, missingFinder{c}, cursorLister{c}}
+	case capStat | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			stater
+			missingFinder
+			cursorLister
+		}{c, stater{c}, missingFinder{c}, cursorLister{c}}
+	case capRange | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			rangeReader
+			missingFinder
+			cursorLister
+		}{c, rangeReader{c}, missingFinder{c}, cursorLister{c}}
+	case capStat | capRange | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			missingFinder
+			cursorLister
+		}{c, stater{c}, rangeReader{c}, missingFinder{c}, cursorLister{c}}
+	case capDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			deleter
+			missingFinder
+			cursorLister
+		}{c, deleter{c}, missingFinder{c}, cursorLister{c}}
+	case capStat | capDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			stater
+			deleter
+			missingFinder
+			cursorLister
+		}{c, stater{c}, deleter{c}, missingFinder{c}, cursorLister{c}}
+	case capRange | capDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			missingFinder
+			cursorLister
+		}{c, rangeReader{c}, deleter{c}, missingFinder{c}, cursorLister{c}}
+	case capStat | capRange | capDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			missingFinder
+			cursorLister
+		}{c, stater{c}, rangeReader{c}, deleter{c}, missingFinder{c}, cursorLister{c}}
+	case capConditionalDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			conditionalDeleter
+			missingFinder
+			cursorLister
+		}{c, conditionalDeleter{c}, missingFinder{c}, cursorLister{c}}
+	case capStat | capConditionalDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			stater
+			conditionalDeleter
+			missingFinder
+			cursorLister
+		}{c, stater{c}, conditionalDeleter{c}, missingFinder{c}, cursorLister{c}}
+	case capRange | capConditionalDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			rangeReader
+			conditionalDeleter
+			missingFinder
+			cursorLister
+		}{c, rangeReader{c}, conditionalDeleter{c}, missingFinder{c}, cursorLister{c}}
+	case capStat | capRange | capConditionalDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			conditionalDeleter
+			missingFinder
+			cursorLister
+		}{c, stater{c}, rangeReader{c}, conditionalDeleter{c}, missingFinder{c}, cursorLister{c}}
+	case capDelete | capConditionalDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			deleter
+			conditionalDeleter
+			missingFinder
+			cursorLister
+		}{c, deleter{c}, conditionalDeleter{c}, missingFinder{c}, cursorLister{c}}
+	case capStat | capDelete | capConditionalDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			stater
+			deleter
+			conditionalDeleter
+			missingFinder
+			cursorLister
+		}{c, stater{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}, cursorLister{c}}
+	case capRange | capDelete | capConditionalDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			rangeReader
+			deleter
+			conditionalDeleter
+			missingFinder
+			cursorLister
+		}{c, rangeReader{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}, cursorLister{c}}
+	case capStat | capRange | capDelete | capConditionalDelete | capFindMissing | capListAfter:
+		return struct {
+			*CAS
+			stater
+			rangeReader
+			deleter
+			conditionalDeleter
+			missingFinder
+			cursorLister
+		}{c, stater{c}, rangeReader{c}, deleter{c}, conditionalDeleter{c}, missingFinder{c}, cursorLister{c}}
+	}
+	return c
+}
@@ -0,0 +1,350 @@
+// Package metrics implements counters and histograms that are exposed in the Prometheus text format,
+// and a CAS wrapper that records metrics for every operation.
+//
+// The package only depends on the standard library.
+// A Registry is an http.Handler, so it can be mounted on any path of a server:
+//
+//	registry := metrics.NewRegistry()
+//	mux.Handle("/metrics", registry)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a collection of metrics.
+type Registry struct {
+	mux     sync.Mutex
+	metrics map[string]metric
+}
+
+// NewRegistry creates a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Counter returns the counter with the given name, creating it if it does not exist.
+// Counters of the same name share their values, so multiple instrumented components can use the same registry.
+// It panics if a metric of the same name with a different type or labels exists.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	m := r.register(name, func() metric {
+		return &Counter{family: newFamily(name, help, labels)}
+	})
+	counter, ok := m.(*Counter)
+	if !ok || !counter.sameLabels(labels) {
+		panic(fmt.Sprintf("metrics: %s is already registered with a different type or labels", name))
+	}
+	return counter
+}
+
+// Histogram returns the histogram with the given name, creating it if it does not exist.
+// Buckets are the upper bounds of the buckets in increasing order.
+// It panics if a metric of the same name with a different type or labels exists.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	m := r.register(name, func() metric {
+		return &Histogram{family: newFamily(name, help, labels), buckets: buckets}
+	})
+	histogram, ok := m.(*Histogram)
+	if !ok || !histogram.sameLabels(labels) {
+		panic(fmt.Sprintf("metrics: %s is already registered with a different type or labels", name))
+	}
+	return histogram
+}
+
+func (r *Registry) register(name string, create func() metric) metric {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		return m
+	}
+	m := create()
+	r.metrics[name] = m
+	return m
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+// Metrics are sorted by name and series by their label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mux.Lock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mux.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if req.Method == http.MethodHead {
+		return
+	}
+	r.WriteTo(w)
+}
+
+// Counter is a monotonically increasing value, partitioned by labels.
+type Counter struct {
+	*family
+
+	mux    sync.Mutex
+	values map[string]float64
+}
+
+// Inc increments the counter of the given label values by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter of the given label values.
+// It panics if v is negative or the number of label values does not match the labels of the counter.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	key := c.key(labelValues)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[key] += v
+}
+
+// Value returns the value of the counter of the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w *countingWriter) {
+	c.writeHeader(w, "counter")
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		w.printf("%s%s %s\n", c.metricName, c.labelString(key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts observations in buckets, partitioned by labels.
+type Histogram struct {
+	*family
+	buckets []float64
+
+	mux    sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// counts are the non-cumulative counts per bucket.
+	// The last element counts observations above the largest bucket.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds an observation to the histogram of the given label values.
+// It panics if the number of label values does not match the labels of the histogram.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	bucket := sort.SearchFloat64s(h.buckets, v)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.series == nil {
+		h.series = make(map[string]*histogramSeries)
+	}
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[bucket]++
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of observations in the histogram of the given label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.count
+	}
+	return 0
+}
+
+// Sum returns the sum of all observations in the histogram of the given label values.
+func (h *Histogram) Sum(labelValues ...string) float64 {
+	key := h.key(labelValues)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s.sum
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *countingWriter) {
+	h.writeHeader(w, "histogram")
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upperBound := range h.buckets {
+			cumulative += s.counts[i]
+			w.printf("%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", formatFloat(upperBound)), cumulative)
+		}
+		w.printf("%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", "+Inf"), s.count)
+		w.printf("%s_sum%s %s\n", h.metricName, h.labelString(key, "", ""), formatFloat(s.sum))
+		w.printf("%s_count%s %d\n", h.metricName, h.labelString(key, "", ""), s.count)
+	}
+}
+
+// metric is a metric that can be written in the text exposition format.
+type metric interface {
+	name() string
+	write(w *countingWriter)
+}
+
+// family holds the metadata shared by all series of a metric.
+type family struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func newFamily(name, help string, labels []string) *family {
+	return &family{metricName: name, help: help, labels: labels}
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+func (f *family) sameLabels(labels []string) bool {
+	if len(labels) != len(f.labels) {
+		return false
+	}
+	for i := range labels {
+		if labels[i] != f.labels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the map key of a series.
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.metricName, len(f.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, labelSeparator)
+}
+
+// labelString formats the labels of a series, optionally followed by an extra label.
+func (f *family) labelString(key, extraName, extraValue string) string {
+	var pairs []string
+	if len(f.labels) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			pairs = append(pairs, f.labels[i]+`="`+escapeLabelValue(value)+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) writeHeader(w *countingWriter, metricType string) {
+	w.printf("# HELP %s %s\n", f.metricName, escapeHelp(f.help))
+	w.printf("# TYPE %s %s\n", f.metricName, metricType)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+// countingWriter counts the bytes written and remembers the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) printf(format string, args ...any) {
+	if c.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
+
+var (
+	// DurationBuckets are histogram buckets for latencies in seconds, from 1ms to 60s.
+	DurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	// SizeBuckets are histogram buckets for sizes in bytes, from 1KiB to 1GiB.
+	SizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+)
+
+// labelSeparator separates label values in series keys.
+// It is not valid UTF-8, so it cannot be part of a label value.
+const labelSeparator = "\xff"
@@ -0,0 +1,454 @@
+// Package pack implements a single-file, read-only CAS format for distributing trees.
+//
+// A pack consists of a header, the concatenated blobs, an index and a trailer.
+// The index lists the SRI, offset and length of every blob, sorted by SRI,
+// so that blobs can be located without scanning the pack.
+// The trailer holds the offset of the index and a SHA-256 checksum of all preceding bytes.
+//
+// Encoding (big endian):
+//
+//	header:  magic "AFSP" (4 bytes), version (1 byte)
+//	blobs:   blob contents without separators
+//	index:   number of blobs (4 bytes), followed by every blob as
+//	         length of the SRI (2 bytes), SRI, offset (8 bytes), length (8 bytes)
+//	trailer: offset of the index (8 bytes), SHA-256 checksum (32 bytes)
+//
+// Packs are written sequentially using a Writer and read using a Reader on top of an io.ReaderAt,
+// which implements random access to the blobs. A Reader can back a TreeFS directly.
+package pack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/traverse"
+	"github.com/malt3/abstractfs-core/tree"
+)
+
+// Writer writes a pack to an io.Writer.
+// Every blob is written at most once.
+// The pack is only complete after Close was called.
+type Writer struct {
+	out     *countingWriter
+	entries []entry
+	seen    map[string]struct{}
+	closed  bool
+}
+
+// NewWriter creates a new Writer and writes the pack header to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	out := &countingWriter{w: w, hasher: sha256.New()}
+	if _, err := out.Write(newHeader()); err != nil {
+		return nil, fmt.Errorf("writing pack header: %w", err)
+	}
+	return &Writer{out: out, seen: make(map[string]struct{})}, nil
+}
+
+// Write adds the blob with the given SRI to the pack.
+// If the content does not match the SRI or reading from r fails,
+// the blob is not added to the index. The bytes already written remain in the pack unreferenced.
+func (w *Writer) Write(sriString string, r io.Reader) error {
+	if err := w.usable(); err != nil {
+		return err
+	}
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return err
+	}
+	if _, ok := w.seen[sriString]; ok {
+		// content addressed: the blob is already present
+		return nil
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, -1, r)
+	if err != nil {
+		return err
+	}
+	offset := w.out.n
+	if _, err := io.Copy(w.out, verifier); err != nil {
+		if w.out.err != nil {
+			return fmt.Errorf("writing pack: %w", w.out.err)
+		}
+		return fmt.Errorf("writing %s: %w", sriString, err)
+	}
+	w.entries = append(w.entries, entry{sri: sriString, offset: offset, length: w.out.n - offset})
+	w.seen[sriString] = struct{}{}
+	return nil
+}
+
+// AddFrom copies the blobs with the given SRIs from cas into the pack.
+func (w *Writer) AddFrom(cas api.CASReader, sris ...string) error {
+	for _, sriString := range sris {
+		if _, ok := w.seen[sriString]; ok {
+			continue
+		}
+		body, err := cas.Open(sriString)
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", sriString, err)
+		}
+		err = w.Write(sriString, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddTree copies the payloads of all regular files of the tree from its CAS into the pack.
+func (w *Writer) AddTree(fsys *tree.TreeFS) error {
+	if fsys.Tree.Root == nil {
+		return nil
+	}
+	var sris []string
+	traverse.DFS(fsys.Tree.Root, func(_ string, node *api.Node) {
+		if node.Stat.Kind == api.KindRegular && node.Stat.Payload != "" {
+			sris = append(sris, node.Stat.Payload)
+		}
+	})
+	return w.AddFrom(fsys.CASReader, sris...)
+}
+
+// Close writes the index and the trailer.
+// It does not close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if err := w.usable(); err != nil {
+		return err
+	}
+	w.closed = true
+	sort.Slice(w.entries, func(i, j int) bool { return w.entries[i].sri < w.entries[j].sri })
+	indexOffset := w.out.n
+	if _, err := w.out.Write(marshalIndex(w.entries)); err != nil {
+		return fmt.Errorf("writing pack index: %w", err)
+	}
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(indexOffset))
+	if _, err := w.out.Write(trailer); err != nil {
+		return fmt.Errorf("writing pack trailer: %w", err)
+	}
+	if _, err := w.out.w.Write(w.out.hasher.Sum(nil)); err != nil {
+		return fmt.Errorf("writing pack trailer: %w", err)
+	}
+	return nil
+}
+
+func (w *Writer) usable() error {
+	if w.closed {
+		return errors.New("writing pack: writer is closed")
+	}
+	if w.out.err != nil {
+		return fmt.Errorf("writing pack: %w", w.out.err)
+	}
+	return nil
+}
+
+// Reader is a read-only CAS backed by a pack.
+type Reader struct {
+	r       io.ReaderAt
+	size    int64
+	closer  io.Closer
+	entries []entry
+}
+
+// NewReader reads the index of the pack of the given size from r.
+// The checksum is not verified. Use Verify to check the whole pack.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	if size < headerSize+indexHeaderSize+trailerSize {
+		return nil, fmt.Errorf("reading pack: %w", ErrInvalidPack)
+	}
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("reading pack header: %w", err)
+	}
+	if string(header[:len(magic)]) != magic {
+		return nil, fmt.Errorf("reading pack header: %w", ErrInvalidPack)
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("reading pack header: unsupported version %d", header[len(magic)])
+	}
+	trailer := make([]byte, trailerSize)
+	if _, err := r.ReadAt(trailer, size-trailerSize); err != nil {
+		return nil, fmt.Errorf("reading pack trailer: %w", err)
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(trailer))
+	indexEnd := size - trailerSize
+	if indexOffset < headerSize || indexOffset > indexEnd {
+		return nil, fmt.Errorf("reading pack trailer: index offset out of bounds: %w", ErrInvalidPack)
+	}
+	rawIndex := make([]byte, indexEnd-indexOffset)
+	if _, err := r.ReadAt(rawIndex, indexOffset); err != nil {
+		return nil, fmt.Errorf("reading pack index: %w", err)
+	}
+	entries, err := unmarshalIndex(rawIndex, indexOffset)
+	if err != nil {
+		return nil, fmt.Errorf("reading pack index: %w", err)
+	}
+	return &Reader{r: r, size: size, entries: entries}, nil
+}
+
+// OpenFile opens the pack file with the given name.
+// The returned Reader must be closed to release the file.
+func OpenFile(name string) (*Reader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader, err := NewReader(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader.closer = file
+	return reader, nil
+}
+
+// Open returns a reader for the blob with the given SRI.
+// The returned reader implements io.Seeker.
+func (p *Reader) Open(sriString string) (io.ReadCloser, error) {
+	e, err := p.lookup("open", sriString)
+	if err != nil {
+		return nil, err
+	}
+	return &sectionReadCloser{io.NewSectionReader(p.r, e.offset, e.length)}, nil
+}
+
+// OpenRange returns a reader for length bytes of the blob with the given SRI, starting at offset.
+// A negative length reads until the end of the blob.
+func (p *Reader) OpenRange(sriString string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("opening range: negative offset")
+	}
+	e, err := p.lookup("open", sriString)
+	if err != nil {
+		return nil, err
+	}
+	if offset > e.length {
+		offset = e.length
+	}
+	if length < 0 || length > e.length-offset {
+		length = e.length - offset
+	}
+	return &sectionReadCloser{io.NewSectionReader(p.r, e.offset+offset, length)}, nil
+}
+
+// Stat returns the size of the blob with the given SRI.
+func (p *Reader) Stat(sriString string) (int64, error) {
+	e, err := p.lookup("stat", sriString)
+	if err != nil {
+		return 0, err
+	}
+	return e.length, nil
+}
+
+// List calls fn for every blob in the pack that uses the given algorithm.
+// An empty algorithm lists blobs of all algorithms.
+// Blobs are visited in lexical order of their SRI.
+// Packs do not record modification times.
+func (p *Reader) List(algorithm string, fn func(api.BlobInfo) error) error {
+	return p.ListAfter(algorithm, "", fn)
+}
+
+// ListAfter is like List, but only visits blobs whose SRI sorts after the SRI after.
+func (p *Reader) ListAfter(algorithm, after string, fn func(api.BlobInfo) error) error {
+	if algorithm != "" {
+		if _, err := sri.AlgorithmFromString(algorithm); err != nil {
+			return err
+		}
+	}
+	start := sort.Search(len(p.entries), func(i int) bool { return p.entries[i].sri > after })
+	for _, e := range p.entries[start:] {
+		if algorithm != "" && !strings.HasPrefix(e.sri, algorithm+"-") {
+			continue
+		}
+		if err := fn(api.BlobInfo{SRI: e.sri, Size: e.length}); err != nil {
+			if err == fs.SkipAll {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of blobs in the pack.
+func (p *Reader) Len() int {
+	return len(p.entries)
+}
+
+// Verify checks the checksum of the whole pack and the SRIs of all blobs.
+func (p *Reader) Verify() error {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(p.r, 0, p.size-checksumSize)); err != nil {
+		return fmt.Errorf("verifying pack: %w", err)
+	}
+	checksum := make([]byte, checksumSize)
+	if _, err := p.r.ReadAt(checksum, p.size-checksumSize); err != nil {
+		return fmt.Errorf("verifying pack: %w", err)
+	}
+	if !bytes.Equal(hasher.Sum(nil), checksum) {
+		return fmt.Errorf("verifying pack: checksum mismatch: %w", ErrInvalidPack)
+	}
+	for _, e := range p.entries {
+		integrity, err := sri.FromString(e.sri)
+		if err != nil {
+			return err
+		}
+		verifier, err := sri.NewVerifyingReader(integrity, e.length, io.NewSectionReader(p.r, e.offset, e.length))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, verifier); err != nil {
+			return fmt.Errorf("verifying pack: blob %s: %w", e.sri, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying file if the Reader was created by OpenFile.
+func (p *Reader) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+func (p *Reader) lookup(op, sriString string) (entry, error) {
+	i := sort.Search(len(p.entries), func(i int) bool { return p.entries[i].sri >= sriString })
+	if i == len(p.entries) || p.entries[i].sri != sriString {
+		return entry{}, &fs.PathError{Op: op, Path: sriString, Err: fs.ErrNotExist}
+	}
+	return p.entries[i], nil
+}
+
+// entry is a blob in the index.
+type entry struct {
+	sri    string
+	offset int64
+	length int64
+}
+
+func newHeader() []byte {
+	return append([]byte(magic), version)
+}
+
+func marshalIndex(entries []entry) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(entries)))
+	for _, e := range entries {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(e.sri)))
+		buf = append(buf, e.sri...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(e.length))
+	}
+	return buf
+}
+
+// unmarshalIndex parses the index. Blobs must be sorted and lie between the header and the index.
+func unmarshalIndex(data []byte, indexOffset int64) ([]entry, error) {
+	if len(data) < indexHeaderSize {
+		return nil, ErrInvalidPack
+	}
+	count := binary.BigEndian.Uint32(data)
+	data = data[indexHeaderSize:]
+	entries := make([]entry, 0, len(data)/18)
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated entry %d: %w", i, ErrInvalidPack)
+		}
+		sriLen := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < sriLen+16 {
+			return nil, fmt.Errorf("truncated entry %d: %w", i, ErrInvalidPack)
+		}
+		e := entry{
+			sri:    string(data[:sriLen]),
+			offset: int64(binary.BigEndian.Uint64(data[sriLen:])),
+			length: int64(binary.BigEndian.Uint64(data[sriLen+8:])),
+		}
+		data = data[sriLen+16:]
+		if _, err := sri.FromString(e.sri); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		if e.offset < headerSize || e.length < 0 || e.offset > indexOffset || e.length > indexOffset-e.offset {
+			return nil, fmt.Errorf("entry %d: blob out of bounds: %w", i, ErrInvalidPack)
+		}
+		if len(entries) > 0 && entries[len(entries)-1].sri >= e.sri {
+			return nil, fmt.Errorf("entry %d: index not sorted: %w", i, ErrInvalidPack)
+		}
+		entries = append(entries, e)
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("trailing data: %w", ErrInvalidPack)
+	}
+	return entries, nil
+}
+
+// countingWriter counts and hashes written bytes and records the first write error.
+type countingWriter struct {
+	w      io.Writer
+	hasher hash.Hash
+	n      int64
+	err    error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.hasher.Write(p[:n])
+	c.n += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// sectionReadCloser is an io.SectionReader with a no-op Close.
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (sectionReadCloser) Close() error {
+	return nil
+}
+
+// ErrInvalidPack is returned when a pack is malformed or corrupted.
+var ErrInvalidPack = errors.New("invalid pack")
+
+const (
+	// magic identifies packs.
+	magic = "AFSP"
+	// version is the version of the format.
+	version = 1
+	// headerSize is the size of magic and version.
+	headerSize = int64(len(magic) + 1)
+	// indexHeaderSize is the size of the number of blobs in the index.
+	indexHeaderSize = 4
+	// checksumSize is the size of the SHA-256 checksum.
+	checksumSize = sha256.Size
+	// trailerSize is the size of the index offset and the checksum.
+	trailerSize = 8 + checksumSize
+)
+
+var (
+	_ api.CASWriter       = (*Writer)(nil)
+	_ api.CASReader       = (*Reader)(nil)
+	_ api.CASStater       = (*Reader)(nil)
+	_ api.CASRangeReader  = (*Reader)(nil)
+	_ api.CASLister       = (*Reader)(nil)
+	_ api.CASCursorLister = (*Reader)(nil)
+)
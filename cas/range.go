@@ -0,0 +1,107 @@
+package cas
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/malt3/abstractfs-core/api"
+)
+
+// OpenRange returns a reader for length bytes of the blob with the given SRI, starting at offset.
+// A negative length reads until the end of the blob.
+// If the CAS implements api.CASRangeReader, it is used.
+// Otherwise, the blob is opened and the first offset bytes are discarded.
+func OpenRange(cas api.CASReader, sri string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, errors.New("opening range: negative offset")
+	}
+	if rangeReader, ok := cas.(api.CASRangeReader); ok {
+		return rangeReader.OpenRange(sri, offset, length)
+	}
+	body, err := cas.Open(sri)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil && err != io.EOF {
+		body.Close()
+		return nil, fmt.Errorf("opening range: %w", err)
+	}
+	return LimitReadCloser(body, length), nil
+}
+
+// LimitReadCloser returns a ReadCloser that reads at most n bytes from rc.
+// A negative n does not limit the reader.
+// Closing it closes rc.
+func LimitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n < 0 {
+		return rc
+	}
+	return &limitReadCloser{Reader: io.LimitReader(rc, n), Closer: rc}
+}
+
+// NewReadSeeker returns an io.ReadSeekCloser for the blob with the given SRI and size.
+// Reads are served by opening ranges of the blob on demand.
+func NewReadSeeker(cas api.CASRangeReader, sri string, size int64) io.ReadSeekCloser {
+	return &rangeReadSeeker{cas: cas, sri: sri, size: size}
+}
+
+// rangeReadSeeker implements io.ReadSeekCloser on top of an api.CASRangeReader.
+type rangeReadSeeker struct {
+	cas    api.CASRangeReader
+	sri    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *rangeReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.cas.OpenRange(r.sri, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *rangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *rangeReadSeeker) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
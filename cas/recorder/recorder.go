@@ -10,19 +10,22 @@ import (
 // It uses the recorder protocol to read cas contents from a stream
 // and write them to the CAS.
 type Recorder struct {
-	cas    api.CASWriter
-	reader io.Reader
+	cas     api.CASWriter
+	decoder *Decoder
 }
 
 // New creates a new recorder.
+// The stream may be a versioned stream written by an Encoder or a legacy headerless stream.
 func New(cas api.CASWriter, r io.Reader) *Recorder {
 	return &Recorder{
-		cas:    cas,
-		reader: r,
+		cas:     cas,
+		decoder: NewDecoder(r),
 	}
 }
 
 // Consume reads from the reader and writes the contents to the CAS.
+// If the stream is truncated or corrupted, it returns a *DecodeError.
+// Blobs that were decoded completely before the error are written to the CAS.
 func (r *Recorder) Consume() error {
 	var err error
 	for err == nil {
@@ -35,7 +38,7 @@ func (r *Recorder) Consume() error {
 }
 
 func (r *Recorder) consumeOne() error {
-	sri, body, err := Decode(r.reader)
+	sri, body, err := r.decoder.Decode()
 	if err != nil {
 		return err
 	}
@@ -1,15 +1,490 @@
 package recorder
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 
 	"github.com/malt3/abstractfs-core/sri"
 )
 
-// Encode encodes content from a cas emitter.
+// The recorder stream format.
+//
+// A stream starts with a header:
+// - 6 byte: magic ("AFSREC")
+// - 1 byte: version (0x01)
+// - 1 byte: flags (0x01: every record value is followed by its CRC32C)
+// The header is followed by one record per blob:
+// sri, payload
+// Every record is encoded as type-length-value:
+// - 1 byte: type of record (0x01 for the sri, 0x02 for the payload)
+// - 8 byte: length of the value
+// - length bytes: value
+// - 4 byte: CRC32C (Castagnoli) of the value, if enabled in the header
+// The stream ends with a trailer record (type 0x03) whose value holds
+// the number of blobs (8 byte) and the total number of payload bytes (8 byte).
+//
+// Legacy streams have no header and no trailer and start directly with an sri record.
+// They are still decoded by a Decoder.
+
+// EncoderOptions are the options of an Encoder.
+type EncoderOptions struct {
+	// Checksum adds a CRC32C checksum to every record.
+	Checksum bool
+}
+
+// Encoder writes a recorder stream.
+// The stream is only complete after Close was called.
+// Once writing to the stream failed, the stream is broken
+// and every later call of Encode and Close returns the first error.
+type Encoder struct {
+	w    io.Writer
+	opts EncoderOptions
+
+	headerWritten bool
+	closed        bool
+	err           error
+	count         uint64
+	total         uint64
+}
+
+// NewEncoder creates a new Encoder writing to w.
+func NewEncoder(w io.Writer, opts EncoderOptions) *Encoder {
+	return &Encoder{w: w, opts: opts}
+}
+
+// Encode writes a blob with the given sri and size to the stream.
+// Exactly size bytes are read from payload.
+func (e *Encoder) Encode(integrity sri.Integrity, size int64, payload io.Reader) error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.closed {
+		return errors.New("encoding: encoder is closed")
+	}
+	if size < 0 {
+		return fmt.Errorf("encoding %s: negative size", integrity)
+	}
+	if err := e.encode(integrity, size, payload); err != nil {
+		e.err = err
+		return err
+	}
+	e.count++
+	e.total += uint64(size)
+	return nil
+}
+
+func (e *Encoder) encode(integrity sri.Integrity, size int64, payload io.Reader) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	rawSRI := []byte(integrity.String())
+	if err := e.encodeRecord(typeSRI, int64(len(rawSRI)), bytes.NewReader(rawSRI)); err != nil {
+		return fmt.Errorf("encoding %s: %w", integrity, err)
+	}
+	if err := e.encodeRecord(typePayload, size, payload); err != nil {
+		return fmt.Errorf("encoding %s: %w", integrity, err)
+	}
+	return nil
+}
+
+// Close writes the trailer of the stream. It does not close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	if err := e.writeHeader(); err != nil {
+		e.err = err
+		return err
+	}
+	var trailer [trailerSize]byte
+	binary.BigEndian.PutUint64(trailer[:8], e.count)
+	binary.BigEndian.PutUint64(trailer[8:], e.total)
+	if err := e.encodeRecord(typeTrailer, trailerSize, bytes.NewReader(trailer[:])); err != nil {
+		e.err = fmt.Errorf("encoding trailer: %w", err)
+		return e.err
+	}
+	return nil
+}
+
+func (e *Encoder) writeHeader() error {
+	if e.headerWritten {
+		return nil
+	}
+	e.headerWritten = true
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = append(header, version)
+	var flags byte
+	if e.opts.Checksum {
+		flags |= flagChecksum
+	}
+	header = append(header, flags)
+	if _, err := e.w.Write(header); err != nil {
+		return fmt.Errorf("encoding header: %w", err)
+	}
+	return nil
+}
+
+func (e *Encoder) encodeRecord(t byte, l int64, v io.Reader) error {
+	if !e.opts.Checksum {
+		return encodeTLV(e.w, t, l, v)
+	}
+	checksum := crc32.New(castagnoli)
+	if err := encodeTLV(e.w, t, l, io.TeeReader(v, checksum)); err != nil {
+		return err
+	}
+	if err := binary.Write(e.w, binary.BigEndian, checksum.Sum32()); err != nil {
+		return fmt.Errorf("encoding checksum: %w", err)
+	}
+	return nil
+}
+
+// Decoder reads a recorder stream written by an Encoder or a legacy headerless stream.
+type Decoder struct {
+	r *offsetReader
+
+	started  bool
+	legacy   bool
+	checksum bool
+	done     bool
+	err      error
+	body     *payloadReader
+	count    uint64
+	total    uint64
+}
+
+// NewDecoder creates a new Decoder reading from r.
+// The Decoder may read more data from r than the stream contains.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: &offsetReader{r: bufio.NewReader(r)}}
+}
+
+// Decode returns the sri and the payload of the next blob in the stream.
+// At the end of the stream, it returns io.EOF.
+// The caller is free to skip the payload, e.g. if the sri was recorded previously.
+// A payload that was not read completely is skipped by the next call of Decode.
+// Reading the payload returns a *DecodeError if the stream is truncated or a checksum does not match.
+func (d *Decoder) Decode() (sri.Integrity, io.ReadCloser, error) {
+	if d.err != nil {
+		return sri.Integrity{}, nil, d.err
+	}
+	integrity, body, err := d.decode()
+	if err != nil {
+		d.err = err
+		return sri.Integrity{}, nil, err
+	}
+	return integrity, body, nil
+}
+
+// Legacy reports whether the stream is a legacy headerless stream.
+// It is only valid after the first call of Decode.
+func (d *Decoder) Legacy() bool {
+	return d.legacy
+}
+
+func (d *Decoder) decode() (sri.Integrity, io.ReadCloser, error) {
+	if !d.started {
+		d.started = true
+		if err := d.readHeader(); err != nil {
+			return sri.Integrity{}, nil, err
+		}
+	}
+	if d.body != nil {
+		// skip the rest of the previous payload
+		if err := d.body.Close(); err != nil {
+			return sri.Integrity{}, nil, err
+		}
+		d.body = nil
+	}
+	if d.done {
+		return sri.Integrity{}, nil, io.EOF
+	}
+
+	recordStart := d.r.offset
+	t, err := d.r.readByte()
+	if err == io.EOF {
+		if d.legacy {
+			d.done = true
+			return sri.Integrity{}, nil, io.EOF
+		}
+		// the trailer is missing
+		return sri.Integrity{}, nil, d.errorAt(recordStart, ErrTruncated)
+	}
+	if err != nil {
+		return sri.Integrity{}, nil, d.errorAt(recordStart, err)
+	}
+	if t == typeTrailer && !d.legacy {
+		return sri.Integrity{}, nil, d.readTrailer(recordStart)
+	}
+	if t != typeSRI {
+		return sri.Integrity{}, nil, d.errorAt(recordStart, fmt.Errorf("%w: expected type %d, got %d", ErrInvalidStream, typeSRI, t))
+	}
+	rawSRI, err := d.readValue(recordStart, maxSRILength)
+	if err != nil {
+		return sri.Integrity{}, nil, err
+	}
+	integrity, err := sri.FromString(string(rawSRI))
+	if err != nil {
+		return sri.Integrity{}, nil, d.errorAt(recordStart, err)
+	}
+
+	t, err = d.r.readByte()
+	if err != nil {
+		return sri.Integrity{}, nil, d.errorAt(recordStart, truncated(err))
+	}
+	if t != typePayload {
+		return sri.Integrity{}, nil, d.errorAt(recordStart, fmt.Errorf("%w: expected type %d, got %d", ErrInvalidStream, typePayload, t))
+	}
+	length, err := d.readLength(recordStart)
+	if err != nil {
+		return sri.Integrity{}, nil, err
+	}
+	d.body = &payloadReader{
+		decoder:     d,
+		record:      d.count,
+		recordStart: recordStart,
+		remaining:   length,
+	}
+	if d.checksum {
+		d.body.checksum = crc32.New(castagnoli)
+	}
+	d.count++
+	d.total += uint64(length)
+	return integrity, d.body, nil
+}
+
+// readHeader reads the stream header or detects a legacy stream.
+func (d *Decoder) readHeader() error {
+	first, err := d.r.r.Peek(1)
+	if err == io.EOF {
+		// an empty legacy stream
+		d.legacy = true
+		return nil
+	}
+	if err != nil {
+		return d.errorAt(0, err)
+	}
+	if first[0] == typeSRI {
+		d.legacy = true
+		return nil
+	}
+	var header [headerSize]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return d.errorAt(0, fmt.Errorf("%w: reading header: %w", ErrInvalidStream, err))
+	}
+	if string(header[:len(magic)]) != magic {
+		return d.errorAt(0, fmt.Errorf("%w: not a recorder stream", ErrInvalidStream))
+	}
+	if v := header[len(magic)]; v != version {
+		return d.errorAt(0, fmt.Errorf("%w: unsupported version %d", ErrInvalidStream, v))
+	}
+	flags := header[len(magic)+1]
+	if flags&^flagChecksum != 0 {
+		return d.errorAt(0, fmt.Errorf("%w: unsupported flags %#x", ErrInvalidStream, flags))
+	}
+	d.checksum = flags&flagChecksum != 0
+	return nil
+}
+
+// readTrailer reads the trailer and checks it against the decoded records.
+func (d *Decoder) readTrailer(recordStart int64) error {
+	value, err := d.readValue(recordStart, trailerSize)
+	if err != nil {
+		return err
+	}
+	if len(value) != trailerSize {
+		return d.errorAt(recordStart, fmt.Errorf("%w: invalid trailer length %d", ErrInvalidStream, len(value)))
+	}
+	count := binary.BigEndian.Uint64(value[:8])
+	total := binary.BigEndian.Uint64(value[8:])
+	if count != d.count || total != d.total {
+		return d.errorAt(recordStart, fmt.Errorf("%w: trailer expects %d blobs with %d bytes, got %d blobs with %d bytes",
+			ErrInvalidStream, count, total, d.count, d.total))
+	}
+	if _, err := d.r.r.Peek(1); err != io.EOF {
+		return d.errorAt(d.r.offset, fmt.Errorf("%w: unexpected data after trailer", ErrInvalidStream))
+	}
+	d.done = true
+	return io.EOF
+}
+
+// readValue reads the length and value of a record (and its checksum) whose type was already read.
+func (d *Decoder) readValue(recordStart int64, maxLength int64) ([]byte, error) {
+	length, err := d.readLength(recordStart)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxLength {
+		return nil, d.errorAt(recordStart, fmt.Errorf("%w: record length %d exceeds %d", ErrInvalidStream, length, maxLength))
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(d.r, value); err != nil {
+		return nil, d.errorAt(recordStart, truncated(err))
+	}
+	if d.checksum {
+		if err := d.verifyChecksum(recordStart, crc32.Checksum(value, castagnoli)); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+func (d *Decoder) readLength(recordStart int64) (int64, error) {
+	var length int64
+	if err := binary.Read(d.r, binary.BigEndian, &length); err != nil {
+		return 0, d.errorAt(recordStart, truncated(err))
+	}
+	if length < 0 {
+		return 0, d.errorAt(recordStart, fmt.Errorf("%w: negative record length", ErrInvalidStream))
+	}
+	return length, nil
+}
+
+// verifyChecksum reads the checksum of a record value and compares it with sum.
+func (d *Decoder) verifyChecksum(recordStart int64, sum uint32) error {
+	var want uint32
+	if err := binary.Read(d.r, binary.BigEndian, &want); err != nil {
+		return d.errorAt(recordStart, truncated(err))
+	}
+	if want != sum {
+		return d.errorAt(recordStart, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+func (d *Decoder) errorAt(recordStart int64, err error) error {
+	return &DecodeError{Record: d.count, Offset: recordStart, Err: err}
+}
+
+// payloadReader reads the payload of a blob.
+// On close, the rest of the payload is read and discarded, so that the next blob can be decoded.
+type payloadReader struct {
+	decoder     *Decoder
+	record      uint64
+	recordStart int64
+	remaining   int64
+	checksum    hash.Hash32
+	finished    bool
+	err         error
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	if p.remaining == 0 {
+		p.err = p.finish()
+		return 0, p.err
+	}
+	if int64(len(b)) > p.remaining {
+		b = b[:p.remaining]
+	}
+	n, err := p.decoder.r.Read(b)
+	p.remaining -= int64(n)
+	if p.checksum != nil {
+		p.checksum.Write(b[:n])
+	}
+	if err == io.EOF && p.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		p.err = &DecodeError{Record: p.record, Offset: p.recordStart, Err: truncated(err)}
+		return n, p.err
+	}
+	if p.remaining == 0 {
+		if p.err = p.finish(); p.err != io.EOF {
+			// report the checksum error instead of the last bytes
+			return n, p.err
+		}
+		p.err = nil
+	}
+	return n, nil
+}
+
+// finish verifies the checksum of the payload.
+// It returns io.EOF if the payload is valid.
+func (p *payloadReader) finish() error {
+	if p.finished {
+		return io.EOF
+	}
+	p.finished = true
+	if p.checksum != nil {
+		if err := p.decoder.verifyChecksum(p.recordStart, p.checksum.Sum32()); err != nil {
+			var decodeErr *DecodeError
+			if errors.As(err, &decodeErr) {
+				decodeErr.Record = p.record
+			}
+			return err
+		}
+	}
+	return io.EOF
+}
+
+func (p *payloadReader) Close() error {
+	_, err := io.Copy(io.Discard, p)
+	return err
+}
+
+// DecodeError describes an invalid or truncated recorder stream.
+type DecodeError struct {
+	// Record is the zero-based index of the blob that could not be decoded.
+	Record uint64
+	// Offset is the offset of the records of the blob in the stream.
+	Offset int64
+	// Err is the cause, e.g. ErrTruncated, ErrChecksumMismatch or ErrInvalidStream.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if errors.Is(e.Err, ErrTruncated) {
+		return fmt.Sprintf("truncated record %d at offset %d", e.Record, e.Offset)
+	}
+	return fmt.Sprintf("decoding record %d at offset %d: %v", e.Record, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// truncated returns ErrTruncated for errors caused by the end of the stream.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+// offsetReader counts the bytes read from a stream.
+type offsetReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *offsetReader) readByte() (byte, error) {
+	b, err := o.r.ReadByte()
+	if err == nil {
+		o.offset++
+	}
+	return b, err
+}
+
+// Encode encodes a single blob in the legacy headerless format.
 // The contents are encoded in the following order:
 // sri, payload
 // The sri is encoded as follows:
@@ -20,6 +495,8 @@ import (
 // - 1 byte: type of record (0x02)
 // - 8 byte: length of record
 // - length bytes: payload
+//
+// Deprecated: Use an Encoder, which detects truncated streams.
 func Encode(w io.Writer, sri sri.Integrity, size int64, payload io.Reader) error {
 	if err := encodeSRI(w, sri); err != nil {
 		return err
@@ -30,12 +507,14 @@ func Encode(w io.Writer, sri sri.Integrity, size int64, payload io.Reader) error
 	return nil
 }
 
-// Decode decodes content for a cas recorder.
+// Decode decodes a single blob of a legacy headerless stream.
 // The contents are decoded in the following order:
 // sri, payload
 // The components are expected to be encoded as described in Encode.
 // The caller is free to skip the payload if it is not needed (i.e when the sri was recorded previously).
 // The caller must close the returned body before calling Decode again.
+//
+// Deprecated: Use a Decoder, which reads streams of all versions.
 func Decode(r io.Reader) (sri sri.Integrity, body io.ReadCloser, err error) {
 	sri, err = decodeSRI(r)
 	if err != nil {
@@ -138,9 +617,38 @@ func (l *limitReadCloser) Close() error {
 	return nil
 }
 
+var (
+	// ErrTruncated is returned if a stream ends in the middle of a record or before its trailer.
+	ErrTruncated = errors.New("truncated stream")
+	// ErrChecksumMismatch is returned if a record does not match its checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrInvalidStream is returned if a stream is not a valid recorder stream.
+	ErrInvalidStream = errors.New("invalid recorder stream")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 const (
 	// typeSRI is the type of the sri record.
 	typeSRI = 0x01
 	// typePayload is the type of the payload record.
 	typePayload = 0x02
+	// typeTrailer is the type of the trailer record.
+	typeTrailer = 0x03
+)
+
+const (
+	// magic starts every versioned stream.
+	// Its first byte differs from typeSRI, which starts legacy streams.
+	magic = "AFSREC"
+	// version is the version of the stream format.
+	version = 0x01
+	// flagChecksum marks streams with a checksum after every record value.
+	flagChecksum = 0x01
+	// headerSize is the size of the stream header.
+	headerSize = len(magic) + 2
+	// trailerSize is the size of the trailer value.
+	trailerSize = 16
+	// maxSRILength is the maximum length of an sri record.
+	maxSRILength = 1024
 )
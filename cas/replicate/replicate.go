@@ -0,0 +1,245 @@
+// Package replicate copies blobs between CAS implementations,
+// e.g. to migrate from a directory CAS to an HTTP CAS.
+//
+// Blobs that the destination already has are skipped,
+// so an interrupted replication resumes where it stopped when it is run again.
+// Blobs are verified while they are copied, and the destination only commits blobs that match their SRI.
+package replicate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/traverse"
+)
+
+// Options are the options of a replication.
+type Options struct {
+	// Workers is the number of blobs that are copied concurrently.
+	// Zero means DefaultWorkers.
+	Workers int
+	// Progress is called once for every blob after it was copied, skipped or failed.
+	// Calls are serialized.
+	Progress func(Result)
+}
+
+// Status is the outcome of replicating a single blob.
+type Status int
+
+const (
+	// Copied means the blob was copied to the destination.
+	Copied Status = iota
+	// Skipped means the destination already had the blob.
+	Skipped
+	// Failed means the blob could not be copied.
+	Failed
+)
+
+func (s Status) String() string {
+	switch s {
+	case Copied:
+		return "copied"
+	case Skipped:
+		return "skipped"
+	case Failed:
+		return "failed"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Result is the outcome of replicating a single blob.
+type Result struct {
+	// SRI is the SRI of the blob.
+	SRI string
+	// Status is the outcome.
+	Status Status
+	// Size is the number of bytes copied.
+	Size int64
+	// Err is the reason of a failure.
+	Err error
+}
+
+// Report summarizes a replication.
+type Report struct {
+	// Copied is the number of blobs that were copied.
+	Copied int
+	// Skipped is the number of blobs that the destination already had.
+	Skipped int
+	// Failures are the blobs that could not be copied.
+	Failures []Result
+	// BytesCopied is the total size of the copied blobs.
+	BytesCopied int64
+}
+
+func (r *Report) add(result Result) {
+	switch result.Status {
+	case Copied:
+		r.Copied++
+		r.BytesCopied += result.Size
+	case Skipped:
+		r.Skipped++
+	case Failed:
+		r.Failures = append(r.Failures, result)
+	}
+}
+
+// Replicate copies the blobs with the given SRIs from src to dst.
+// Failures of individual blobs do not stop the replication.
+// They are reported and returned together.
+// If ctx is canceled, no new blobs are started and the context error is returned as well.
+func Replicate(ctx context.Context, src api.CASReader, dst api.CAS, sris []string, opts Options) (Report, error) {
+	var report Report
+	sris = unique(sris)
+	missing, err := cas.FindMissing(dst, sris)
+	if err != nil {
+		return report, fmt.Errorf("finding missing blobs: %w", err)
+	}
+
+	var errs []error
+	record := func(result Result) {
+		report.add(result)
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("replicating %s: %w", result.SRI, result.Err))
+		}
+		if opts.Progress != nil {
+			opts.Progress(result)
+		}
+	}
+
+	missingSet := make(map[string]struct{}, len(missing))
+	for _, sri := range missing {
+		missingSet[sri] = struct{}{}
+	}
+	for _, sri := range sris {
+		if _, ok := missingSet[sri]; !ok {
+			record(Result{SRI: sri, Status: Skipped})
+		}
+	}
+
+	for result := range copyAll(ctx, src, dst, missing, opts.workers()) {
+		record(result)
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return report, errors.Join(errs...)
+}
+
+// ReplicateTrees copies the payloads of all regular files of the trees from src to dst.
+func ReplicateTrees(ctx context.Context, src api.CASReader, dst api.CAS, trees []api.Tree, opts Options) (Report, error) {
+	var sris []string
+	for _, tree := range trees {
+		if tree.Root == nil {
+			continue
+		}
+		traverse.BFS(tree.Root, func(_ string, node *api.Node) {
+			if node.Stat.Kind == api.KindRegular && node.Stat.Payload != "" {
+				sris = append(sris, node.Stat.Payload)
+			}
+		})
+	}
+	return Replicate(ctx, src, dst, sris, opts)
+}
+
+// copyAll copies the blobs using a bounded number of workers.
+// The returned channel is closed once all started copies finished.
+func copyAll(ctx context.Context, src api.CASReader, dst api.CAS, sris []string, workers int) <-chan Result {
+	jobs := make(chan string)
+	results := make(chan Result)
+	go func() {
+		defer close(jobs)
+		for _, sri := range sris {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case jobs <- sri:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sri := range jobs {
+				size, err := copyBlob(src, dst, sri)
+				if err != nil {
+					results <- Result{SRI: sri, Status: Failed, Size: size, Err: err}
+					continue
+				}
+				results <- Result{SRI: sri, Status: Copied, Size: size}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// copyBlob copies a single blob and verifies it in flight.
+func copyBlob(src api.CASReader, dst api.CASWriter, sriString string) (int64, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return 0, err
+	}
+	body, err := src.Open(sriString)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	verifier, err := sri.NewVerifyingReader(integrity, -1, body)
+	if err != nil {
+		return 0, err
+	}
+	counter := &countingReader{r: verifier}
+	if err := dst.Write(sriString, counter); err != nil {
+		return counter.n, err
+	}
+	return counter.n, nil
+}
+
+func (o Options) workers() int {
+	if o.Workers <= 0 {
+		return DefaultWorkers
+	}
+	return o.Workers
+}
+
+// unique returns the SRIs without duplicates, preserving their order.
+func unique(sris []string) []string {
+	seen := make(map[string]struct{}, len(sris))
+	var out []string
+	for _, sri := range sris {
+		if _, ok := seen[sri]; ok {
+			continue
+		}
+		seen[sri] = struct{}{}
+		out = append(out, sri)
+	}
+	return out
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// DefaultWorkers is the default number of concurrent copies.
+const DefaultWorkers = 8
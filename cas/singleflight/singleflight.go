@@ -0,0 +1,243 @@
+// Package singleflight implements a CAS wrapper that deduplicates concurrent operations on the same SRI.
+//
+// Ingesting many trees that contain identical files results in concurrent writes of the same SRI.
+// The wrapper coalesces them into a single backend write and remembers the SRIs that were written,
+// so that later writes of the same SRI only check that the blob still exists in the backend.
+// Concurrent reads of small blobs can be coalesced as well.
+package singleflight
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+)
+
+// Options are the options of a coalescing CAS.
+type Options struct {
+	// MaxSharedReadSize is the maximum size of a blob that is read once
+	// and shared between concurrent Open calls for the same SRI.
+	// Larger blobs are opened individually. Zero disables coalescing of reads.
+	MaxSharedReadSize int64
+}
+
+// CAS is a CAS that coalesces concurrent operations on the same SRI.
+type CAS struct {
+	backend api.CAS
+	opts    Options
+
+	mux    sync.Mutex
+	writes map[string]*call
+	reads  map[string]*readCall
+	known  map[string]struct{}
+	stats  Stats
+}
+
+// New creates a new coalescing CAS on top of backend.
+func New(backend api.CAS, opts Options) *CAS {
+	return &CAS{
+		backend: backend,
+		opts:    opts,
+		writes:  make(map[string]*call),
+		reads:   make(map[string]*readCall),
+		known:   make(map[string]struct{}),
+	}
+}
+
+// Write writes the blob to the backend.
+// If a write of the same SRI is in progress, Write waits for it and shares its result.
+// If that write fails, the waiting writes retry with their own input,
+// since the failure might have been caused by the input of the failed write (e.g. a hash mismatch).
+// If the SRI was written before and the backend still has the blob, the backend write is skipped.
+// Skipped writes do not refresh the modification time of the blob in the backend,
+// so they are not protected by gc.Collector.GracePeriod.
+// Writes that do not reach the backend still read r until EOF,
+// so that a writer on the other end of a pipe is not blocked.
+func (c *CAS) Write(sri string, r io.Reader) error {
+	for {
+		c.mux.Lock()
+		if inflight, ok := c.writes[sri]; ok {
+			c.stats.CoalescedWrites++
+			c.mux.Unlock()
+			<-inflight.done
+			if inflight.err == nil {
+				drain(r)
+				return nil
+			}
+			continue
+		}
+		_, known := c.known[sri]
+		inflight := &call{done: make(chan struct{})}
+		c.writes[sri] = inflight
+		c.mux.Unlock()
+
+		skipped := false
+		if known {
+			// the blob may have been deleted from the backend since it was written
+			skipped, _ = cas.Has(c.backend, sri)
+		}
+		if skipped {
+			drain(r)
+		} else {
+			inflight.err = c.backend.Write(sri, r)
+		}
+
+		c.mux.Lock()
+		delete(c.writes, sri)
+		switch {
+		case skipped:
+			c.stats.SkippedWrites++
+		case inflight.err == nil:
+			c.known[sri] = struct{}{}
+		default:
+			delete(c.known, sri)
+		}
+		c.mux.Unlock()
+		close(inflight.done)
+		return inflight.err
+	}
+}
+
+// Open returns a reader for the blob with the given SRI.
+// If reads are coalesced, concurrent Open calls for the same SRI share a single backend read
+// as long as the blob is not larger than MaxSharedReadSize.
+func (c *CAS) Open(sri string) (io.ReadCloser, error) {
+	if c.opts.MaxSharedReadSize <= 0 {
+		return c.backend.Open(sri)
+	}
+	c.mux.Lock()
+	if inflight, ok := c.reads[sri]; ok {
+		c.mux.Unlock()
+		<-inflight.done
+		if inflight.err != nil {
+			return nil, inflight.err
+		}
+		if !inflight.shared {
+			// too large to be shared
+			return c.backend.Open(sri)
+		}
+		c.mux.Lock()
+		c.stats.CoalescedReads++
+		c.mux.Unlock()
+		return io.NopCloser(bytes.NewReader(inflight.data)), nil
+	}
+	inflight := &readCall{done: make(chan struct{})}
+	c.reads[sri] = inflight
+	c.mux.Unlock()
+
+	body, err := c.read(sri, inflight)
+
+	c.mux.Lock()
+	delete(c.reads, sri)
+	c.mux.Unlock()
+	close(inflight.done)
+	return body, err
+}
+
+// read opens the blob and reads it into memory if it is small enough to be shared.
+// The outcome is recorded in inflight.
+func (c *CAS) read(sri string, inflight *readCall) (io.ReadCloser, error) {
+	body, err := c.backend.Open(sri)
+	if err != nil {
+		inflight.err = err
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, c.opts.MaxSharedReadSize+1))
+	if err != nil {
+		body.Close()
+		inflight.err = fmt.Errorf("reading %s: %w", sri, err)
+		return nil, inflight.err
+	}
+	if int64(len(data)) > c.opts.MaxSharedReadSize {
+		return &readCloser{Reader: io.MultiReader(bytes.NewReader(data), body), Closer: body}, nil
+	}
+	if err := body.Close(); err != nil {
+		inflight.err = err
+		return nil, err
+	}
+	inflight.data = data
+	inflight.shared = true
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// OpenRange returns a reader for a part of the blob from the backend.
+func (c *CAS) OpenRange(sri string, offset, length int64) (io.ReadCloser, error) {
+	return cas.OpenRange(c.backend, sri, offset, length)
+}
+
+// Stat returns the size of the blob from the backend.
+func (c *CAS) Stat(sri string) (int64, error) {
+	return cas.Stat(c.backend, sri)
+}
+
+// Delete removes the blob from the backend and forgets that it exists.
+func (c *CAS) Delete(sri string) error {
+	deleter, ok := c.backend.(api.CASDeleter)
+	if !ok {
+		return errors.New("deleting: backend does not support deletion")
+	}
+	c.Forget(sri)
+	return deleter.Delete(sri)
+}
+
+// Forget forgets that the blob with the given SRI exists,
+// so that the next write of it reaches the backend.
+// Call it for blobs that were deleted from the backend directly (e.g. by garbage collection)
+// to avoid the existence check on the next write.
+func (c *CAS) Forget(sri string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.known, sri)
+}
+
+// Stats returns the number of coalesced operations.
+func (c *CAS) Stats() Stats {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.stats
+}
+
+// Stats are the counters of a coalescing CAS.
+type Stats struct {
+	// CoalescedWrites is the number of writes that waited for a concurrent write of the same SRI.
+	CoalescedWrites uint64
+	// SkippedWrites is the number of writes of SRIs that were known to exist in the backend.
+	SkippedWrites uint64
+	// CoalescedReads is the number of reads that shared the result of a concurrent read.
+	CoalescedReads uint64
+}
+
+// drain reads r until EOF. Read errors are ignored, since the blob is already stored.
+func drain(r io.Reader) {
+	io.Copy(io.Discard, r)
+}
+
+// call is a write in progress.
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+// readCall is a read in progress.
+type readCall struct {
+	done   chan struct{}
+	data   []byte
+	shared bool
+	err    error
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var (
+	_ api.CAS            = (*CAS)(nil)
+	_ api.CASStater      = (*CAS)(nil)
+	_ api.CASRangeReader = (*CAS)(nil)
+	_ api.CASDeleter     = (*CAS)(nil)
+)
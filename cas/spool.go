@@ -0,0 +1,72 @@
+package cas
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// Spool stages data in a temporary file while computing its SRI,
+// so that data produced on the fly can be written to a CAS that verifies writes.
+type Spool struct {
+	file      *os.File
+	hasher    hash.Hash
+	algorithm sri.Algorithm
+	size      int64
+}
+
+// NewSpool creates a Spool that stages data in dir and hashes it using the given algorithm.
+// If dir is empty, the default directory for temporary files is used.
+// The caller must Close the Spool.
+func NewSpool(dir string, algorithm sri.Algorithm) (*Spool, error) {
+	hasher, err := algorithm.Hasher()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating spool: %w", err)
+	}
+	return &Spool{file: file, hasher: hasher, algorithm: algorithm}, nil
+}
+
+// Write appends p to the staged data.
+func (s *Spool) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	s.hasher.Write(p[:n])
+	s.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes staged.
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// SRI returns the SRI of the staged data.
+func (s *Spool) SRI() string {
+	return sri.Integrity{Algorithm: s.algorithm, Hash: s.hasher.Sum(nil)}.String()
+}
+
+// Commit writes the staged data to the CAS under its SRI and returns the SRI.
+func (s *Spool) Commit(cas api.CASWriter) (string, error) {
+	sriString := s.SRI()
+	// a section reader can be rewound for retries, but not closed by the CAS
+	if err := cas.Write(sriString, io.NewSectionReader(s.file, 0, s.size)); err != nil {
+		return "", err
+	}
+	return sriString, nil
+}
+
+// Close removes the staged data.
+func (s *Spool) Close() error {
+	err := s.file.Close()
+	if removeErr := os.Remove(s.file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
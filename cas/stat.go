@@ -0,0 +1,67 @@
+package cas
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/malt3/abstractfs-core/api"
+)
+
+// Stat returns the size of the blob with the given SRI.
+// If the CAS implements api.CASStater, it is used.
+// Otherwise, the blob is opened and read to determine its size.
+func Stat(cas api.CASReader, sri string) (int64, error) {
+	if stater, ok := cas.(api.CASStater); ok {
+		return stater.Stat(sri)
+	}
+	body, err := cas.Open(sri)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	return io.Copy(io.Discard, body)
+}
+
+// Has returns true if the blob with the given SRI exists.
+// If the CAS implements api.CASStater, it is used.
+// Otherwise, the blob is opened and closed again without reading it.
+func Has(cas api.CASReader, sri string) (bool, error) {
+	var err error
+	if stater, ok := cas.(api.CASStater); ok {
+		_, err = stater.Stat(sri)
+	} else {
+		var body io.ReadCloser
+		body, err = cas.Open(sri)
+		if err == nil {
+			err = body.Close()
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FindMissing returns the subset of the given SRIs that are not present in the CAS.
+// If the CAS implements api.CASMissingFinder, it is used.
+// Otherwise, Has is called for every SRI.
+func FindMissing(cas api.CASReader, sris []string) ([]string, error) {
+	if finder, ok := cas.(api.CASMissingFinder); ok {
+		return finder.FindMissing(sris)
+	}
+	var missing []string
+	for _, sri := range sris {
+		has, err := Has(cas, sri)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			missing = append(missing, sri)
+		}
+	}
+	return missing, nil
+}
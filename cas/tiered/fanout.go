@@ -0,0 +1,119 @@
+package tiered
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/malt3/abstractfs-core/api"
+)
+
+// fanout is an io.Writer that streams a blob to multiple layers concurrently.
+// A layer that fails or stops reading early is dropped without affecting the others.
+type fanout struct {
+	pipes []*io.PipeWriter
+	errs  []error
+	wg    sync.WaitGroup
+}
+
+func newFanout(layers []api.CAS, targets []int, sri string) *fanout {
+	f := &fanout{
+		pipes: make([]*io.PipeWriter, len(targets)),
+		errs:  make([]error, len(targets)),
+	}
+	for i, target := range targets {
+		pr, pw := io.Pipe()
+		f.pipes[i] = pw
+		f.wg.Add(1)
+		go func(i int, layer api.CASWriter) {
+			defer f.wg.Done()
+			err := layer.Write(sri, pr)
+			f.errs[i] = err
+			// unblock the writer if the layer returned without reading everything
+			pr.CloseWithError(errLayerDone)
+		}(i, layers[target])
+	}
+	return f
+}
+
+// Write writes p to all layers that are still reading.
+// It never fails, so that one failing layer does not affect the others.
+func (f *fanout) Write(p []byte) (int, error) {
+	for i, pw := range f.pipes {
+		if pw == nil {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			f.pipes[i] = nil
+		}
+	}
+	return len(p), nil
+}
+
+// close finishes the stream and waits for all layers.
+// If err is not nil, the layers see err instead of io.EOF and must not commit the blob.
+// It returns the error of every layer.
+func (f *fanout) close(err error) []error {
+	if err == nil {
+		err = io.EOF
+	}
+	for _, pw := range f.pipes {
+		if pw != nil {
+			pw.CloseWithError(err)
+		}
+	}
+	f.wg.Wait()
+	return f.errs
+}
+
+// backfillReader reads a blob from a slow layer and streams it to faster layers at the same time.
+type backfillReader struct {
+	body     io.ReadCloser
+	fanout   *fanout
+	onErrors func([]error)
+	done     bool
+}
+
+func newBackfillReader(body io.ReadCloser, f *fanout, onErrors func([]error)) *backfillReader {
+	return &backfillReader{body: body, fanout: f, onErrors: onErrors}
+}
+
+func (b *backfillReader) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.done {
+		return n, err
+	}
+	if n > 0 {
+		b.fanout.Write(p[:n])
+	}
+	switch err {
+	case nil:
+	case io.EOF:
+		b.finish(nil)
+	default:
+		b.finish(err)
+	}
+	return n, err
+}
+
+// Close closes the body.
+// If the body was not read completely, back-filling is aborted.
+func (b *backfillReader) Close() error {
+	b.finish(errAborted)
+	return b.body.Close()
+}
+
+func (b *backfillReader) finish(err error) {
+	if b.done {
+		return
+	}
+	b.done = true
+	b.onErrors(b.fanout.close(err))
+}
+
+var (
+	// errLayerDone is seen by the writer if a layer returned before reading the whole blob.
+	errLayerDone = errors.New("layer finished writing")
+	// errAborted is seen by back-filled layers if the reader was closed before reading the whole blob.
+	errAborted = errors.New("back-fill aborted")
+)
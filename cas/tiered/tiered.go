@@ -0,0 +1,280 @@
+// Package tiered composes multiple CAS layers into a single CAS.
+//
+// Layers are ordered from fastest (e.g. a local directory) to slowest (e.g. a shared remote).
+// Reads check the layers in order and back-fill faster layers on a hit.
+// Writes go to a configurable set of layers, either synchronously (write-through)
+// or asynchronously after the first layer was written (write-back).
+package tiered
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+)
+
+// WriteMode determines when Write returns.
+type WriteMode int
+
+const (
+	// WriteThrough writes to all write layers before Write returns.
+	WriteThrough WriteMode = iota
+	// WriteBack writes to the first write layer before Write returns.
+	// The remaining write layers are written asynchronously from the first write layer.
+	// Use Flush to wait for pending writes.
+	WriteBack
+)
+
+// Options are the options of a tiered CAS.
+type Options struct {
+	// WriteLayers are the indices of the layers that Write writes to.
+	// If empty, Write writes to all layers.
+	WriteLayers []int
+	// WriteMode determines when Write returns.
+	WriteMode WriteMode
+	// OnError is called for errors of individual layers that do not fail the operation,
+	// such as a failed read from a layer that is followed by a successful read from another layer
+	// or a failed back-fill. It may be called concurrently.
+	OnError func(layer int, err error)
+}
+
+// CAS is a CAS composed of multiple layers.
+type CAS struct {
+	layers      []api.CAS
+	writeLayers []int
+	opts        Options
+
+	pending   sync.WaitGroup
+	mux       sync.Mutex
+	asyncErrs []error
+}
+
+// New creates a new tiered CAS.
+// The layers are ordered from fastest to slowest.
+func New(layers []api.CAS, opts Options) (*CAS, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("creating tiered cas: no layers")
+	}
+	writeLayers := opts.WriteLayers
+	if len(writeLayers) == 0 {
+		for i := range layers {
+			writeLayers = append(writeLayers, i)
+		}
+	}
+	for _, layer := range writeLayers {
+		if layer < 0 || layer >= len(layers) {
+			return nil, fmt.Errorf("creating tiered cas: invalid write layer %d", layer)
+		}
+	}
+	return &CAS{
+		layers:      layers,
+		writeLayers: writeLayers,
+		opts:        opts,
+	}, nil
+}
+
+// Open returns a reader for the given SRI from the first layer that has it.
+// While the blob is read, it is back-filled into all faster layers.
+// Back-filling only completes if the returned reader is read until io.EOF.
+// Errors of individual layers are ignored as long as another layer has the blob.
+func (c *CAS) Open(sri string) (io.ReadCloser, error) {
+	var layerErrs []error
+	for i, layer := range c.layers {
+		body, err := layer.Open(sri)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			layerErrs = append(layerErrs, c.layerError(i, err))
+			continue
+		}
+		if i == 0 {
+			return body, nil
+		}
+		return newBackfillReader(body, newFanout(c.layers, indices(i), sri), c.reportErrors), nil
+	}
+	return nil, c.notFound("open", sri, layerErrs)
+}
+
+// OpenRange returns a reader for a part of the blob from the first layer that has it.
+// Range reads are not back-filled.
+func (c *CAS) OpenRange(sri string, offset, length int64) (io.ReadCloser, error) {
+	var layerErrs []error
+	for i, layer := range c.layers {
+		body, err := cas.OpenRange(layer, sri, offset, length)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			layerErrs = append(layerErrs, c.layerError(i, err))
+			continue
+		}
+		return body, nil
+	}
+	return nil, c.notFound("open", sri, layerErrs)
+}
+
+// Stat returns the size of the blob from the first layer that has it.
+func (c *CAS) Stat(sri string) (int64, error) {
+	var layerErrs []error
+	for i, layer := range c.layers {
+		size, err := cas.Stat(layer, sri)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			layerErrs = append(layerErrs, c.layerError(i, err))
+			continue
+		}
+		return size, nil
+	}
+	return 0, c.notFound("stat", sri, layerErrs)
+}
+
+// Write writes the blob to the write layers.
+func (c *CAS) Write(sri string, r io.Reader) error {
+	if c.opts.WriteMode == WriteBack && len(c.writeLayers) > 1 {
+		return c.writeBack(sri, r)
+	}
+	return c.writeThrough(sri, c.writeLayers, r)
+}
+
+// Delete removes the blob from all write layers.
+// If no write layer has the blob, it returns fs.ErrNotExist.
+func (c *CAS) Delete(sri string) error {
+	deleted := false
+	var layerErrs []error
+	for _, i := range c.writeLayers {
+		deleter, ok := c.layers[i].(api.CASDeleter)
+		if !ok {
+			layerErrs = append(layerErrs, fmt.Errorf("layer %d: deletion not supported", i))
+			continue
+		}
+		err := deleter.Delete(sri)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			layerErrs = append(layerErrs, fmt.Errorf("layer %d: %w", i, err))
+			continue
+		}
+		deleted = true
+	}
+	if len(layerErrs) > 0 {
+		return fmt.Errorf("deleting %s: %w", sri, errors.Join(layerErrs...))
+	}
+	if !deleted {
+		return &fs.PathError{Op: "delete", Path: sri, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// Flush waits for all pending asynchronous writes
+// and returns the errors that occurred since the last flush.
+func (c *CAS) Flush() error {
+	c.pending.Wait()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	err := errors.Join(c.asyncErrs...)
+	c.asyncErrs = nil
+	return err
+}
+
+func (c *CAS) writeThrough(sri string, layers []int, r io.Reader) error {
+	f := newFanout(c.layers, layers, sri)
+	_, copyErr := io.Copy(f, r)
+	errs := f.close(copyErr)
+	if copyErr != nil {
+		return fmt.Errorf("writing %s: %w", sri, copyErr)
+	}
+	var layerErrs []error
+	for i, err := range errs {
+		if err != nil {
+			layerErrs = append(layerErrs, fmt.Errorf("layer %d: %w", layers[i], err))
+		}
+	}
+	if len(layerErrs) > 0 {
+		return fmt.Errorf("writing %s: %w", sri, errors.Join(layerErrs...))
+	}
+	return nil
+}
+
+// writeBack writes to the first write layer synchronously
+// and copies the blob from there to the remaining write layers in the background.
+func (c *CAS) writeBack(sri string, r io.Reader) error {
+	first, rest := c.writeLayers[0], c.writeLayers[1:]
+	if err := c.layers[first].Write(sri, r); err != nil {
+		return fmt.Errorf("writing %s: layer %d: %w", sri, first, err)
+	}
+	c.pending.Add(1)
+	go func() {
+		defer c.pending.Done()
+		body, err := c.layers[first].Open(sri)
+		if err != nil {
+			c.recordAsyncError(first, err)
+			return
+		}
+		defer body.Close()
+		f := newFanout(c.layers, rest, sri)
+		_, copyErr := io.Copy(f, body)
+		for i, err := range f.close(copyErr) {
+			if err != nil {
+				c.recordAsyncError(rest[i], err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *CAS) recordAsyncError(layer int, err error) {
+	err = c.layerError(layer, err)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.asyncErrs = append(c.asyncErrs, err)
+}
+
+// reportErrors reports back-fill errors.
+func (c *CAS) reportErrors(errs []error) {
+	for i, err := range errs {
+		if err != nil && !errors.Is(err, errAborted) {
+			c.layerError(i, err)
+		}
+	}
+}
+
+// layerError reports an error of a layer to the OnError callback and returns it annotated with the layer.
+func (c *CAS) layerError(layer int, err error) error {
+	if c.opts.OnError != nil {
+		c.opts.OnError(layer, err)
+	}
+	return fmt.Errorf("layer %d: %w", layer, err)
+}
+
+// notFound returns the error for a blob that was not found in any layer.
+// If any layer failed, the blob might exist and the layer errors are returned instead.
+func (c *CAS) notFound(op, sri string, layerErrs []error) error {
+	if len(layerErrs) > 0 {
+		return fmt.Errorf("%s %s: %w", op, sri, errors.Join(layerErrs...))
+	}
+	return &fs.PathError{Op: op, Path: sri, Err: fs.ErrNotExist}
+}
+
+// indices returns the indices [0, n).
+func indices(n int) []int {
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx
+}
+
+var (
+	_ api.CAS            = (*CAS)(nil)
+	_ api.CASStater      = (*CAS)(nil)
+	_ api.CASRangeReader = (*CAS)(nil)
+	_ api.CASDeleter     = (*CAS)(nil)
+)
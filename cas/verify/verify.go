@@ -0,0 +1,88 @@
+// Package verify implements a CAS reader wrapper that verifies blobs while they are read.
+//
+// Readers returned by the wrapper hash the blob as it is streamed.
+// The final Read returns an error of type *sri.IntegrityError instead of io.EOF
+// if the digest or the length of the blob does not match,
+// so consumers that read until io.EOF detect corrupted or malicious backends
+// without a separate pass over the data.
+package verify
+
+import (
+	"io"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/sri"
+)
+
+// CAS is a CAS reader that verifies blobs read from a backend.
+type CAS struct {
+	backend api.CASReader
+}
+
+// New creates a new verifying CAS reader on top of backend.
+// If the backend implements api.CASStater, the length of every blob is checked
+// against the reported size as well, so that reads of oversized blobs stop early.
+func New(backend api.CASReader) *CAS {
+	return &CAS{backend: backend}
+}
+
+// Open returns a reader for the blob with the given SRI that verifies the blob while reading.
+func (c *CAS) Open(sriString string) (io.ReadCloser, error) {
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(-1)
+	if stater, ok := c.backend.(api.CASStater); ok {
+		if size, err = stater.Stat(sriString); err != nil {
+			return nil, err
+		}
+	}
+	body, err := c.backend.Open(sriString)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := sri.NewVerifyingReader(integrity, size, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: verifier, Closer: body}, nil
+}
+
+// Stat returns the size of the blob with the given SRI as reported by the backend.
+func (c *CAS) Stat(sriString string) (int64, error) {
+	stater, ok := c.backend.(api.CASStater)
+	if !ok {
+		// determining the size requires reading (and therefore verifying) the blob
+		body, err := c.Open(sriString)
+		if err != nil {
+			return 0, err
+		}
+		defer body.Close()
+		return io.Copy(io.Discard, body)
+	}
+	return stater.Stat(sriString)
+}
+
+// Check reads the blob with the given SRI and returns nil if it matches.
+// If the blob does not exist, it returns an error wrapping fs.ErrNotExist.
+func (c *CAS) Check(sriString string) error {
+	body, err := c.Open(sriString)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(io.Discard, body)
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var (
+	_ api.CASReader = (*CAS)(nil)
+	_ api.CASStater = (*CAS)(nil)
+)
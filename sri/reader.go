@@ -0,0 +1,108 @@
+package sri
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// VerifyingReader is an io.Reader that verifies the data read against an Integrity.
+// Once the underlying reader is exhausted, the final Read returns an error
+// of type *IntegrityError (wrapping ErrHashMismatch or ErrSizeMismatch) instead of io.EOF
+// if the data does not match.
+// Consumers that copy until io.EOF therefore see the error before they commit the data.
+type VerifyingReader struct {
+	integrity Integrity
+	size      int64
+	r         io.Reader
+	hasher    hash.Hash
+	read      int64
+	err       error
+}
+
+// NewVerifyingReader returns a reader that verifies the data read from r.
+// If size is not negative, the length of the data is verified as well.
+func NewVerifyingReader(integrity Integrity, size int64, r io.Reader) (*VerifyingReader, error) {
+	hasher, err := integrity.Algorithm.Hasher()
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyingReader{
+		integrity: integrity,
+		size:      size,
+		r:         r,
+		hasher:    hasher,
+	}, nil
+}
+
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.hasher.Write(p[:n])
+	v.read += int64(n)
+	if v.size >= 0 && v.read > v.size {
+		v.err = &IntegrityError{Expected: v.integrity, ExpectedSize: v.size, ActualSize: v.read, Err: ErrSizeMismatch}
+		return n, v.err
+	}
+	if err == io.EOF {
+		err = v.verify()
+	}
+	if err != nil {
+		v.err = err
+	}
+	return n, err
+}
+
+// verify returns io.EOF if the data read matches the integrity.
+func (v *VerifyingReader) verify() error {
+	if v.size >= 0 && v.read != v.size {
+		return &IntegrityError{Expected: v.integrity, ExpectedSize: v.size, ActualSize: v.read, Err: ErrSizeMismatch}
+	}
+	if sum := v.hasher.Sum(nil); !bytes.Equal(sum, v.integrity.Hash) {
+		return &IntegrityError{
+			Expected:     v.integrity,
+			Actual:       Integrity{Algorithm: v.integrity.Algorithm, Hash: sum},
+			ExpectedSize: v.size,
+			ActualSize:   v.read,
+			Err:          ErrHashMismatch,
+		}
+	}
+	return io.EOF
+}
+
+// IntegrityError describes data that does not match the expected Integrity.
+// It wraps ErrHashMismatch or ErrSizeMismatch.
+type IntegrityError struct {
+	// Expected is the expected integrity.
+	Expected Integrity
+	// Actual is the integrity of the data. It is only set for hash mismatches.
+	Actual Integrity
+	// ExpectedSize is the expected size of the data, or -1 if it is unknown.
+	ExpectedSize int64
+	// ActualSize is the number of bytes read.
+	// For data that exceeds the expected size, reading stops early.
+	ActualSize int64
+	// Err is ErrHashMismatch or ErrSizeMismatch.
+	Err error
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Err == ErrSizeMismatch {
+		if e.ActualSize > e.ExpectedSize {
+			return fmt.Sprintf("verifying %s: read more than %d bytes: %v", e.Expected, e.ExpectedSize, e.Err)
+		}
+		return fmt.Sprintf("verifying %s: read %d bytes, expected %d: %v", e.Expected, e.ActualSize, e.ExpectedSize, e.Err)
+	}
+	return fmt.Sprintf("verifying %s: got %s: %v", e.Expected, e.Actual, e.Err)
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return e.Err
+}
+
+// ErrSizeMismatch is returned when a payload does not have the expected size.
+// It matches ErrIntegrityMismatch.
+var ErrSizeMismatch error = mismatchError("size mismatch")
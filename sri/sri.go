@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
@@ -29,14 +30,14 @@ func FromString(s string) (Integrity, error) {
 	case strings.HasPrefix(s, "sha512-"):
 		algorithm = SHA512
 	default:
-		return Integrity{}, errors.New("invalid algorithm")
+		return Integrity{}, fmt.Errorf("%w: invalid algorithm", ErrInvalidSRI)
 	}
 	hash, err := base64.StdEncoding.DecodeString(s[len(algorithm)+1:])
 	if err != nil {
-		return Integrity{}, fmt.Errorf("decoding hash: %w", err)
+		return Integrity{}, fmt.Errorf("%w: decoding hash: %w", ErrInvalidSRI, err)
 	}
 	if len(hash) != algorithm.ByteLen() {
-		return Integrity{}, fmt.Errorf("invalid hash length: %d", len(hash))
+		return Integrity{}, fmt.Errorf("%w: invalid hash length: %d", ErrInvalidSRI, len(hash))
 	}
 	return Integrity{Algorithm: algorithm, Hash: hash}, nil
 }
@@ -59,7 +60,7 @@ func (i Integrity) Validate(payload io.Reader) error {
 		return err
 	}
 	if !bytes.Equal(i.Hash, payloadHash) {
-		return errors.New("hash mismatch")
+		return ErrHashMismatch
 	}
 	return nil
 }
@@ -68,6 +69,11 @@ func (i Integrity) String() string {
 	return string(i.Algorithm) + "-" + base64.StdEncoding.EncodeToString(i.Hash)
 }
 
+// Hex returns the hash encoded as lowercase hex.
+func (i Integrity) Hex() string {
+	return hex.EncodeToString(i.Hash)
+}
+
 type Algorithm string
 
 func AlgorithmFromString(s string) (Algorithm, error) {
@@ -79,7 +85,7 @@ func AlgorithmFromString(s string) (Algorithm, error) {
 	case "sha512":
 		return SHA512, nil
 	default:
-		return "", errors.New("invalid algorithm")
+		return "", fmt.Errorf("%w: invalid algorithm %q", ErrInvalidSRI, s)
 	}
 }
 
@@ -101,20 +107,50 @@ func (a Algorithm) ByteLen() int {
 	return 0 // unreachable
 }
 
-func (a Algorithm) Hash(in io.Reader) ([]byte, error) {
-	var hasher hash.Hash
+// Hasher returns a new hash.Hash for the algorithm.
+func (a Algorithm) Hasher() (hash.Hash, error) {
 	switch a {
 	case SHA256:
-		hasher = sha256.New()
+		return sha256.New(), nil
 	case SHA384:
-		hasher = sha512.New384()
+		return sha512.New384(), nil
 	case SHA512:
-		hasher = sha512.New()
-	default:
-		return nil, errors.New("hashing: invalid algorithm")
+		return sha512.New(), nil
+	}
+	return nil, errors.New("hashing: invalid algorithm")
+}
+
+func (a Algorithm) Hash(in io.Reader) ([]byte, error) {
+	hasher, err := a.Hasher()
+	if err != nil {
+		return nil, err
 	}
 	if _, err := io.Copy(hasher, in); err != nil {
 		return nil, fmt.Errorf("hashing: %w", err)
 	}
 	return hasher.Sum(nil), nil
 }
+
+var (
+	// ErrInvalidSRI is returned if a string is not a valid SRI.
+	// It is re-exported as api.ErrInvalidSRI.
+	ErrInvalidSRI = errors.New("invalid sri")
+	// ErrIntegrityMismatch is matched by ErrHashMismatch and ErrSizeMismatch.
+	// It is re-exported as api.ErrIntegrityMismatch.
+	ErrIntegrityMismatch = errors.New("integrity mismatch")
+)
+
+// ErrHashMismatch is returned when a payload does not match the expected hash.
+// It matches ErrIntegrityMismatch.
+var ErrHashMismatch error = mismatchError("hash mismatch")
+
+// mismatchError is a sentinel error that matches ErrIntegrityMismatch.
+type mismatchError string
+
+func (e mismatchError) Error() string {
+	return string(e)
+}
+
+func (e mismatchError) Is(target error) bool {
+	return target == ErrIntegrityMismatch
+}
@@ -0,0 +1,65 @@
+package actioncache_test
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/cas/actioncache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+}
+
+func TestStores(t *testing.T) {
+	testCases := map[string]func(t *testing.T) store{
+		"memory": func(t *testing.T) store {
+			return actioncache.NewMemory()
+		},
+		"dir": func(t *testing.T) store {
+			d, err := actioncache.NewDir(t.TempDir())
+			require.NoError(t, err)
+			return d
+		},
+	}
+
+	for name, newStore := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			s := newStore(t)
+			key := strings.Repeat("ab", 32)
+
+			_, err := s.Get(key)
+			assert.ErrorIs(err, fs.ErrNotExist)
+
+			value := []byte("first")
+			require.NoError(s.Put(key, value))
+			value[0] = 'F'
+			got, err := s.Get(key)
+			require.NoError(err)
+			assert.Equal("first", string(got))
+
+			got[0] = 'F'
+			got, err = s.Get(key)
+			require.NoError(err)
+			assert.Equal("first", string(got))
+
+			require.NoError(s.Put(key, []byte("second")))
+			got, err = s.Get(key)
+			require.NoError(err)
+			assert.Equal("second", string(got))
+
+			for _, invalid := range []string{"", "short", "../../etc/passwd" + strings.Repeat("0", 32), strings.Repeat("AB", 32), strings.Repeat("ab", 65)} {
+				assert.Error(s.Put(invalid, []byte("x")), invalid)
+				_, err := s.Get(invalid)
+				assert.Error(err, invalid)
+				assert.NotErrorIs(err, fs.ErrNotExist, invalid)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package chunk_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/actioncache"
+	"github.com/malt3/abstractfs-core/cas/chunk"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/malt3/abstractfs-core/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testOptions() chunk.Options {
+	return chunk.Options{MinSize: 256, AvgSize: 1024, MaxSize: 4096, Index: actioncache.NewMemory()}
+}
+
+func TestRoundTrip(t *testing.T) {
+	large := randomBytes(64 << 10)
+
+	testCases := map[string]struct {
+		payload     []byte
+		wantChunked bool
+	}{
+		"empty": {
+			payload: []byte{},
+		},
+		"small": {
+			payload: []byte("hello world"),
+		},
+		"at threshold": {
+			payload: large[:4096],
+		},
+		"large": {
+			payload:     large,
+			wantChunked: true,
+		},
+		"looks like an index": {
+			payload: append([]byte("AFSCHUNK\x01"), make([]byte, 32)...),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			backend := memory.New(0)
+			cas, err := chunk.New(backend, testOptions())
+			require.NoError(err)
+			sriString := testdata.SRI(t, tc.payload)
+
+			require.NoError(cas.Write(sriString, bytes.NewReader(tc.payload)))
+
+			body, err := cas.Open(sriString)
+			require.NoError(err)
+			got, err := io.ReadAll(body)
+			require.NoError(err)
+			require.NoError(body.Close())
+			assert.Equal(tc.payload, got)
+
+			size, err := cas.Stat(sriString)
+			require.NoError(err)
+			assert.Equal(int64(len(tc.payload)), size)
+
+			refs, err := cas.References(sriString)
+			require.NoError(err)
+			assert.Equal(tc.wantChunked, len(refs) > 1)
+			for _, ref := range refs {
+				assert.True(backend.Has(ref))
+			}
+		})
+	}
+}
+
+func TestOpenRange(t *testing.T) {
+	payload := randomBytes(32 << 10)
+	backend := memory.New(0)
+	cas, err := chunk.New(backend, testOptions())
+	require.NoError(t, err)
+	sriString := testdata.SRI(t, payload)
+	require.NoError(t, cas.Write(sriString, bytes.NewReader(payload)))
+
+	testCases := map[string]struct {
+		offset, length int64
+		want           []byte
+	}{
+		"whole":              {offset: 0, length: -1, want: payload},
+		"prefix":             {offset: 0, length: 100, want: payload[:100]},
+		"across chunks":      {offset: 1000, length: 10000, want: payload[1000:11000]},
+		"suffix":             {offset: 30000, length: -1, want: payload[30000:]},
+		"length beyond end":  {offset: 32000, length: 10000, want: payload[32000:]},
+		"offset beyond end":  {offset: 64 << 10, length: 10, want: []byte{}},
+		"zero length":        {offset: 5, length: 0, want: []byte{}},
+		"last byte":          {offset: int64(len(payload) - 1), length: 1, want: payload[len(payload)-1:]},
+		"single byte middle": {offset: 12345, length: 1, want: payload[12345:12346]},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			body, err := cas.OpenRange(sriString, tc.offset, tc.length)
+			require.NoError(t, err)
+			defer body.Close()
+			got, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend := memory.New(0)
+	cas, err := chunk.New(backend, testOptions())
+	require.NoError(err)
+
+	original := randomBytes(128 << 10)
+	modified := append(bytes.Clone(original[:50000]), []byte("inserted bytes")...)
+	modified = append(modified, original[50000:]...)
+
+	require.NoError(cas.Write(testdata.SRI(t, original), bytes.NewReader(original)))
+	afterOriginal := backend.Stats().Size
+	require.NoError(cas.Write(testdata.SRI(t, modified), bytes.NewReader(modified)))
+	added := backend.Stats().Size - afterOriginal
+
+	// only the chunks around the insertion and the index are new
+	assert.Less(added, int64(len(modified)/4))
+
+	body, err := cas.Open(testdata.SRI(t, modified))
+	require.NoError(err)
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	assert.Equal(modified, got)
+}
+
+func TestWriteMismatch(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	cas, err := chunk.New(backend, testOptions())
+	require.NoError(t, err)
+	payload := randomBytes(16 << 10)
+	wrong := testdata.SRI(t, []byte("something else"))
+
+	err = cas.Write(wrong, bytes.NewReader(payload))
+	assert.ErrorIs(err, sri.ErrHashMismatch)
+	_, err = cas.Open(wrong)
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	err = cas.Write(wrong, strings.NewReader("short"))
+	assert.ErrorIs(err, sri.ErrHashMismatch)
+	_, err = cas.Open(wrong)
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestMissingChunk(t *testing.T) {
+	backend := memory.New(0)
+	cas, err := chunk.New(backend, testOptions())
+	require.NoError(t, err)
+	payload := randomBytes(16 << 10)
+	sriString := testdata.SRI(t, payload)
+	require.NoError(t, cas.Write(sriString, bytes.NewReader(payload)))
+	refs, err := cas.References(sriString)
+	require.NoError(t, err)
+	require.NoError(t, backend.Delete(refs[len(refs)/2]))
+
+	body, err := cas.Open(sriString)
+	require.NoError(t, err)
+	defer body.Close()
+	_, err = io.ReadAll(body)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestTreeFS(t *testing.T) {
+	backend := memory.New(0)
+	cas, err := chunk.New(backend, testOptions())
+	require.NoError(t, err)
+	payload := randomBytes(20 << 10)
+	require.NoError(t, cas.Write(testdata.SRI(t, payload), bytes.NewReader(payload)))
+
+	treeFS := &tree.TreeFS{
+		Tree: api.Tree{Root: &api.Node{
+			Stat: api.Stat{Kind: api.KindDirectory},
+			Children: []*api.Node{
+				{Stat: api.Stat{Name: "image", Kind: api.KindRegular, Payload: testdata.SRI(t, payload), Size: int64(len(payload))}},
+			},
+		}},
+		CASReader: cas,
+	}
+	got, err := fs.ReadFile(treeFS, "image")
+	require.NoError(t, err)
+	assert.Equal(t, payload, got)
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	testCases := map[string]chunk.Options{
+		"min above avg":      {MinSize: 2048, AvgSize: 1024, MaxSize: 4096},
+		"avg above max":      {MinSize: 256, AvgSize: 8192, MaxSize: 4096},
+		"avg not power of 2": {MinSize: 256, AvgSize: 1000, MaxSize: 4096},
+		"negative threshold": {Threshold: -1},
+	}
+	for name, opts := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts.Index = actioncache.NewMemory()
+			_, err := chunk.New(memory.New(0), opts)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewWithoutIndex(t *testing.T) {
+	_, err := chunk.New(memory.New(0), chunk.Options{})
+	assert.Error(t, err)
+}
+
+func TestOverHTTP(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	// the server verifies every upload
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(memory.New(0), cashttp.HandlerOptions{
+		Index: actioncache.NewMemory(),
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(err)
+	opts := testOptions()
+	opts.Index = client.Index()
+	cas, err := chunk.New(client, opts)
+	require.NoError(err)
+
+	payload := randomBytes(32 << 10)
+	sriString := testdata.SRI(t, payload)
+	require.NoError(cas.Write(sriString, bytes.NewReader(payload)))
+	body, err := cas.OpenRange(sriString, 1000, 10000)
+	require.NoError(err)
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	require.NoError(body.Close())
+	assert.Equal(payload[1000:11000], got)
+	size, err := cas.Stat(sriString)
+	require.NoError(err)
+	assert.Equal(int64(len(payload)), size)
+}
+
+func TestIndexCache(t *testing.T) {
+	testCases := map[string]struct {
+		cacheSize int
+		wantOpens int
+	}{
+		"cached":   {cacheSize: 0, wantOpens: 0},
+		"disabled": {cacheSize: -1, wantOpens: 4},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			backend := &countingBackend{CAS: memory.New(0), opened: make(map[string]int)}
+			opts := testOptions()
+			opts.IndexCacheSize = tc.cacheSize
+			cas, err := chunk.New(backend, opts)
+			require.NoError(err)
+			payload := randomBytes(16 << 10)
+			sriString := testdata.SRI(t, payload)
+			require.NoError(cas.Write(sriString, bytes.NewReader(payload)))
+			refs, err := cas.References(sriString)
+			require.NoError(err)
+			indexSRI := refs[0]
+
+			for i := 0; i < 3; i++ {
+				_, err := cas.Stat(sriString)
+				require.NoError(err)
+				body, err := cas.OpenRange(sriString, 100, 10)
+				require.NoError(err)
+				require.NoError(body.Close())
+			}
+			// Stat does not need the index blob
+			assert.Equal(tc.wantOpens, backend.opened[indexSRI])
+		})
+	}
+}
+
+// countingBackend counts how often every blob is opened.
+type countingBackend struct {
+	*memory.CAS
+	opened map[string]int
+}
+
+func (c *countingBackend) Open(sri string) (io.ReadCloser, error) {
+	c.opened[sri]++
+	return c.CAS.Open(sri)
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(buf)
+	return buf
+}
@@ -0,0 +1,213 @@
+package compress_test
+
+import (
+	"crypto/rand"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/actioncache"
+	"github.com/malt3/abstractfs-core/cas/compress"
+	"github.com/malt3/abstractfs-core/cas/gc"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 128<<10)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 4096)
+
+	testCases := map[string]struct {
+		payload        string
+		opts           compress.Options
+		wantCompressed bool
+	}{
+		"text gzip": {
+			payload:        text,
+			wantCompressed: true,
+		},
+		"text flate": {
+			payload:        text,
+			opts:           compress.Options{Encoding: compress.Flate, Level: 9},
+			wantCompressed: true,
+		},
+		"below threshold": {
+			payload: "small",
+			opts:    compress.Options{MinSize: 1024},
+		},
+		"incompressible": {
+			payload: string(random),
+		},
+		"empty": {
+			payload: "",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			backend := memory.New(0)
+			tc.opts.Index = actioncache.NewMemory()
+			cas, err := compress.New(backend, tc.opts)
+			require.NoError(err)
+
+			integrity := testdata.SRI(t, tc.payload)
+			require.NoError(cas.Write(integrity, strings.NewReader(tc.payload)))
+			// writing it again is a no-op
+			require.NoError(cas.Write(integrity, strings.NewReader(tc.payload)))
+
+			stored := listBlobs(t, backend)
+			require.Len(stored, 1)
+			if tc.wantCompressed {
+				assert.NotEqual(integrity, stored[0].SRI)
+				assert.Less(stored[0].Size, int64(len(tc.payload)))
+			} else {
+				// raw blobs are stored under their own SRI
+				assert.Equal(integrity, stored[0].SRI)
+			}
+
+			assert.Equal(tc.payload, string(readAll(t, cas, integrity)))
+			size, err := cas.Stat(integrity)
+			require.NoError(err)
+			assert.Equal(int64(len(tc.payload)), size)
+			if len(tc.payload) > 10 {
+				body, err := cas.OpenRange(integrity, 3, 7)
+				require.NoError(err)
+				got, err := io.ReadAll(body)
+				require.NoError(err)
+				require.NoError(body.Close())
+				assert.Equal(tc.payload[3:10], string(got))
+			}
+		})
+	}
+}
+
+func TestOverHTTP(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	// the server verifies every upload
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(memory.New(0), cashttp.HandlerOptions{
+		Index: actioncache.NewMemory(),
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(err)
+	cas, err := compress.New(client, compress.Options{Index: client.Index()})
+	require.NoError(err)
+
+	payload := strings.Repeat("compressible content ", 10000)
+	require.NoError(cas.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	assert.Equal(payload, string(readAll(t, cas, testdata.SRI(t, payload))))
+	size, err := cas.Stat(testdata.SRI(t, payload))
+	require.NoError(err)
+	assert.Equal(int64(len(payload)), size)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend := memory.New(0)
+	cas, err := compress.New(backend, compress.Options{Index: actioncache.NewMemory()})
+	require.NoError(err)
+	live := strings.Repeat("live content ", 10000)
+	dead := strings.Repeat("dead content ", 10000)
+	require.NoError(cas.Write(testdata.SRI(t, live), strings.NewReader(live)))
+	require.NoError(cas.Write(testdata.SRI(t, dead), strings.NewReader(dead)))
+
+	collector := gc.New(backend)
+	collector.References = cas.References
+	collector.Mark(testdata.SRI(t, live))
+	report, err := collector.Sweep()
+	require.NoError(err)
+	assert.Len(report.Deleted, 1)
+
+	assert.Equal(live, string(readAll(t, cas, testdata.SRI(t, live))))
+	_, err = cas.Open(testdata.SRI(t, dead))
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = cas.Stat(testdata.SRI(t, dead))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestDelete(t *testing.T) {
+	for name, payload := range map[string]string{
+		"raw":        "foo",
+		"compressed": strings.Repeat("foo", 100000),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			backend := memory.New(0)
+			cas, err := compress.New(backend, compress.Options{Index: actioncache.NewMemory()})
+			require.NoError(err)
+			integrity := testdata.SRI(t, payload)
+			require.NoError(cas.Write(integrity, strings.NewReader(payload)))
+
+			require.NoError(cas.Delete(integrity))
+			assert.Empty(listBlobs(t, backend))
+			_, err = cas.Open(integrity)
+			assert.ErrorIs(err, fs.ErrNotExist)
+			_, err = cas.OpenRange(integrity, 1, 1)
+			assert.ErrorIs(err, fs.ErrNotExist)
+			_, err = cas.Stat(integrity)
+			assert.ErrorIs(err, fs.ErrNotExist)
+			assert.ErrorIs(cas.Delete(integrity), fs.ErrNotExist)
+
+			require.NoError(cas.Write(integrity, strings.NewReader(payload)))
+			assert.Equal(payload, string(readAll(t, cas, integrity)))
+		})
+	}
+}
+
+func TestWriteHashMismatch(t *testing.T) {
+	for name, payload := range map[string]string{
+		"small": "bar",
+		"large": strings.Repeat("bar", 100000),
+	} {
+		t.Run(name, func(t *testing.T) {
+			backend := memory.New(0)
+			cas, err := compress.New(backend, compress.Options{Index: actioncache.NewMemory()})
+			require.NoError(t, err)
+
+			err = cas.Write(testdata.SRI(t, "foo"), strings.NewReader(payload))
+			assert.ErrorIs(t, err, sri.ErrHashMismatch)
+			assert.Empty(t, listBlobs(t, backend))
+			_, err = cas.Open(testdata.SRI(t, "foo"))
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+		})
+	}
+}
+
+func TestNewWithoutIndex(t *testing.T) {
+	_, err := compress.New(memory.New(0), compress.Options{})
+	assert.Error(t, err)
+}
+
+func listBlobs(t *testing.T, backend api.CASLister) []api.BlobInfo {
+	t.Helper()
+	var blobs []api.BlobInfo
+	require.NoError(t, backend.List("", func(blob api.BlobInfo) error {
+		blobs = append(blobs, blob)
+		return nil
+	}))
+	return blobs
+}
+
+func readAll(t *testing.T, cas api.CASReader, sri string) []byte {
+	t.Helper()
+	body, err := cas.Open(sri)
+	require.NoError(t, err)
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	require.NoError(t, err)
+	return got
+}
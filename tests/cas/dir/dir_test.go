@@ -0,0 +1,173 @@
+package dir_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteOpen(t *testing.T) {
+	testCases := map[string]struct {
+		payload   string
+		writeSRI  string
+		wantErr   error
+		wantFound bool
+	}{
+		"valid blob": {
+			payload:   "foo",
+			writeSRI:  testdata.SRI(t, "foo"),
+			wantFound: true,
+		},
+		"empty blob": {
+			payload:   "",
+			writeSRI:  testdata.SRI(t, ""),
+			wantFound: true,
+		},
+		"hash mismatch": {
+			payload:  "bar",
+			writeSRI: testdata.SRI(t, "foo"),
+			wantErr:  sri.ErrHashMismatch,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			root := t.TempDir()
+			cas, err := dir.New(root)
+			require.NoError(err)
+
+			err = cas.Write(tc.writeSRI, strings.NewReader(tc.payload))
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+			} else {
+				assert.NoError(err)
+			}
+
+			body, err := cas.Open(tc.writeSRI)
+			if !tc.wantFound {
+				assert.ErrorIs(err, fs.ErrNotExist)
+				assertNoTempFiles(t, root)
+				return
+			}
+			require.NoError(err)
+			defer body.Close()
+			got, err := io.ReadAll(body)
+			require.NoError(err)
+			assert.Equal(tc.payload, string(got))
+		})
+	}
+}
+
+func TestLayout(t *testing.T) {
+	require := require.New(t)
+	root := t.TempDir()
+	cas, err := dir.New(root)
+	require.NoError(err)
+	require.NoError(cas.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+
+	_, err = os.Stat(filepath.Join(root, "sha256", "2c", "26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"))
+	require.NoError(err)
+}
+
+func TestListDelete(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	cas, err := dir.New(t.TempDir())
+	require.NoError(err)
+	require.NoError(cas.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+	require.NoError(cas.Write(testdata.SRI(t, "bar"), strings.NewReader("bar")))
+	sha512, err := sri.FromReader(sri.SHA512, strings.NewReader("foo"))
+	require.NoError(err)
+	require.NoError(cas.Write(sha512.String(), strings.NewReader("foo")))
+
+	list := func(algorithm string) []string {
+		var listed []string
+		require.NoError(cas.List(algorithm, func(blob api.BlobInfo) error {
+			listed = append(listed, blob.SRI)
+			return nil
+		}))
+		return listed
+	}
+	assert.ElementsMatch([]string{testdata.SRI(t, "foo"), testdata.SRI(t, "bar"), sha512.String()}, list(""))
+	assert.ElementsMatch([]string{testdata.SRI(t, "foo"), testdata.SRI(t, "bar")}, list("sha256"))
+	assert.Equal([]string{sha512.String()}, list("sha512"))
+	assert.Error(cas.List("md5", func(api.BlobInfo) error { return nil }))
+
+	// stop early
+	count := 0
+	require.NoError(cas.List("", func(api.BlobInfo) error {
+		count++
+		return fs.SkipAll
+	}))
+	assert.Equal(1, count)
+
+	require.NoError(cas.Delete(testdata.SRI(t, "foo")))
+	assert.ErrorIs(cas.Delete(testdata.SRI(t, "foo")), fs.ErrNotExist)
+	assert.ElementsMatch([]string{testdata.SRI(t, "bar"), sha512.String()}, list(""))
+}
+
+func TestOpenNotExist(t *testing.T) {
+	cas, err := dir.New(t.TempDir())
+	require.NoError(t, err)
+	_, err = cas.Open(testdata.SRI(t, "foo"))
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	require := require.New(t)
+	root := t.TempDir()
+	payload := strings.Repeat("abstractfs", 4096)
+	integrity := testdata.SRI(t, payload)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// each writer uses its own handle to simulate separate processes
+			cas, err := dir.New(root)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- cas.Write(integrity, strings.NewReader(payload))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+
+	cas, err := dir.New(root)
+	require.NoError(err)
+	body, err := cas.Open(integrity)
+	require.NoError(err)
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	require.Equal(payload, string(got))
+	assertNoTempFiles(t, root)
+}
+
+func assertNoTempFiles(t *testing.T, root string) {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(root, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,248 @@
+package encrypt_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/actioncache"
+	"github.com/malt3/abstractfs-core/cas/encrypt"
+	"github.com/malt3/abstractfs-core/cas/gc"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var masterKey = bytes.Repeat([]byte{0x42}, 32)
+
+func TestRoundTrip(t *testing.T) {
+	testCases := map[string]string{
+		"empty":                  "",
+		"small":                  "foo",
+		"exactly one segment":    strings.Repeat("a", 64<<10),
+		"multiple segments":      strings.Repeat("abstractfs", 20000),
+		"exactly three segments": strings.Repeat("b", 3*64<<10),
+	}
+
+	for name, payload := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			backend := newBackend()
+			cas, err := encrypt.New(backend, masterKey, encrypt.Options{Index: actioncache.NewMemory()})
+			require.NoError(err)
+
+			integrity := testdata.SRI(t, payload)
+			require.NoError(cas.Write(integrity, strings.NewReader(payload)))
+
+			// the backend neither knows the sri nor the plaintext
+			assert.False(backend.Has(integrity))
+			stored := readAll(t, backend, listAll(t, backend)[0])
+			if len(payload) > 0 {
+				assert.NotContains(string(stored), payload[:3])
+			}
+
+			assert.Equal(payload, string(readAll(t, cas, integrity)))
+			size, err := cas.Stat(integrity)
+			require.NoError(err)
+			assert.Equal(int64(len(payload)), size)
+		})
+	}
+}
+
+func TestConvergent(t *testing.T) {
+	require := require.New(t)
+	first, second := newBackend(), newBackend()
+	for _, backend := range []*memory.CAS{first, second} {
+		cas, err := encrypt.New(backend, masterKey, encrypt.Options{Index: actioncache.NewMemory()})
+		require.NoError(err)
+		require.NoError(cas.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+	}
+	assert.Equal(t, listAll(t, first), listAll(t, second))
+	key := listAll(t, first)[0]
+	assert.Equal(t, readAll(t, first, key), readAll(t, second, key))
+}
+
+func TestTampering(t *testing.T) {
+	payload := strings.Repeat("abstractfs", 20000)
+	testCases := map[string]func(stored []byte) []byte{
+		"flipped bit": func(stored []byte) []byte {
+			stored[len(stored)/2] ^= 0x01
+			return stored
+		},
+		"truncated at segment boundary": func(stored []byte) []byte {
+			return stored[:9+2*(64<<10+16)]
+		},
+		"truncated in segment": func(stored []byte) []byte {
+			return stored[:len(stored)-5]
+		},
+		"header only": func(stored []byte) []byte {
+			return stored[:9]
+		},
+		"modified header": func(stored []byte) []byte {
+			stored[0] = 'X'
+			return stored
+		},
+	}
+
+	for name, tamper := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+			// a malicious backend returns other bytes than it stored
+			backend := &tamperingCAS{CAS: newBackend(), tamper: tamper}
+			cas, err := encrypt.New(backend, masterKey, encrypt.Options{Index: actioncache.NewMemory()})
+			require.NoError(err)
+			integrity := testdata.SRI(t, payload)
+			require.NoError(cas.Write(integrity, strings.NewReader(payload)))
+
+			body, err := cas.Open(integrity)
+			if err == nil {
+				_, err = io.ReadAll(body)
+				body.Close()
+			}
+			assert.ErrorIs(t, err, encrypt.ErrTampered)
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	require := require.New(t)
+	backend := newBackend()
+	index := actioncache.NewMemory()
+	cas, err := encrypt.New(backend, masterKey, encrypt.Options{Index: index})
+	require.NoError(err)
+	require.NoError(cas.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+
+	other, err := encrypt.New(backend, bytes.Repeat([]byte{0x23}, 32), encrypt.Options{Index: index})
+	require.NoError(err)
+	_, err = other.Open(testdata.SRI(t, "foo"))
+	assert.Error(t, err)
+}
+
+func TestWriteHashMismatch(t *testing.T) {
+	backend := newBackend()
+	cas, err := encrypt.New(backend, masterKey, encrypt.Options{Index: actioncache.NewMemory()})
+	require.NoError(t, err)
+	err = cas.Write(testdata.SRI(t, "foo"), strings.NewReader(strings.Repeat("bar", 100000)))
+	assert.ErrorIs(t, err, sri.ErrHashMismatch)
+	assert.Empty(t, listAll(t, backend))
+}
+
+func TestTamperedIndex(t *testing.T) {
+	require := require.New(t)
+	index := &recordingIndex{KeyValueStore: actioncache.NewMemory()}
+	cas, err := encrypt.New(newBackend(), masterKey, encrypt.Options{Index: index})
+	require.NoError(err)
+	require.NoError(cas.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+	require.NoError(cas.Write(testdata.SRI(t, "bar"), strings.NewReader("bar")))
+
+	// point foo to the ciphertext of bar
+	require.Len(index.keys, 2)
+	bar, err := index.Get(index.keys[1])
+	require.NoError(err)
+	require.NoError(index.Put(index.keys[0], bar))
+	_, err = cas.Open(testdata.SRI(t, "foo"))
+	assert.ErrorIs(t, err, encrypt.ErrTampered)
+}
+
+func TestOverHTTP(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	// the server verifies every upload
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(memory.New(0), cashttp.HandlerOptions{
+		Index: actioncache.NewMemory(),
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(err)
+	cas, err := encrypt.New(client, masterKey, encrypt.Options{Index: client.Index()})
+	require.NoError(err)
+
+	payload := strings.Repeat("secret ", 20000)
+	require.NoError(cas.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	assert.Equal(payload, string(readAll(t, cas, testdata.SRI(t, payload))))
+	_, err = client.Stat(testdata.SRI(t, payload))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend := newBackend()
+	cas, err := encrypt.New(backend, masterKey, encrypt.Options{Index: actioncache.NewMemory()})
+	require.NoError(err)
+	require.NoError(cas.Write(testdata.SRI(t, "live"), strings.NewReader("live")))
+	require.NoError(cas.Write(testdata.SRI(t, "dead"), strings.NewReader("dead")))
+
+	collector := gc.New(backend)
+	collector.References = cas.References
+	collector.Mark(testdata.SRI(t, "live"))
+	report, err := collector.Sweep()
+	require.NoError(err)
+	assert.Len(report.Deleted, 1)
+
+	assert.Equal("live", string(readAll(t, cas, testdata.SRI(t, "live"))))
+	_, err = cas.Open(testdata.SRI(t, "dead"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+// recordingIndex records the order in which keys were written.
+type recordingIndex struct {
+	api.KeyValueStore
+	keys []string
+}
+
+func (r *recordingIndex) Put(key string, value []byte) error {
+	r.keys = append(r.keys, key)
+	return r.KeyValueStore.Put(key, value)
+}
+
+// tamperingCAS modifies blobs when they are read.
+type tamperingCAS struct {
+	*memory.CAS
+	tamper func(stored []byte) []byte
+}
+
+func (c *tamperingCAS) Open(sri string) (io.ReadCloser, error) {
+	body, err := c.CAS.Open(sri)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	stored, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(c.tamper(stored))), nil
+}
+
+func newBackend() *memory.CAS {
+	return memory.New(0)
+}
+
+func listAll(t *testing.T, cas *memory.CAS) []string {
+	t.Helper()
+	var sris []string
+	require.NoError(t, cas.List("", func(blob api.BlobInfo) error {
+		sris = append(sris, blob.SRI)
+		return nil
+	}))
+	return sris
+}
+
+func readAll(t *testing.T, cas api.CASReader, sri string) []byte {
+	t.Helper()
+	body, err := cas.Open(sri)
+	require.NoError(t, err)
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	require.NoError(t, err)
+	return got
+}
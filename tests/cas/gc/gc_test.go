@@ -0,0 +1,212 @@
+package gc_test
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/actioncache"
+	"github.com/malt3/abstractfs-core/cas/chunk"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/cas/gc"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweep(t *testing.T) {
+	testCases := map[string]struct {
+		dryRun       bool
+		gracePeriod  time.Duration
+		wantDeleted  []string
+		wantRetained int
+		wantPresent  []string
+	}{
+		"deletes unreferenced blobs": {
+			wantDeleted: []string{"old", "new"},
+			wantPresent: []string{"tree", "flat"},
+		},
+		"dry run": {
+			dryRun:      true,
+			wantDeleted: []string{"old", "new"},
+			wantPresent: []string{"tree", "flat", "old", "new"},
+		},
+		"grace period": {
+			gracePeriod:  time.Hour,
+			wantDeleted:  []string{"old"},
+			wantRetained: 1,
+			wantPresent:  []string{"tree", "flat", "new"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			root := t.TempDir()
+			cas, err := dir.New(root)
+			require.NoError(err)
+			for _, payload := range []string{"tree", "flat", "old", "new"} {
+				require.NoError(cas.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+			}
+			// age the "old" blob beyond the grace period
+			oldPath := blobPath(t, root, testdata.SRI(t, "old"))
+			longAgo := time.Now().Add(-2 * time.Hour)
+			require.NoError(os.Chtimes(oldPath, longAgo, longAgo))
+
+			collector := gc.New(cas)
+			collector.DryRun = tc.dryRun
+			collector.GracePeriod = tc.gracePeriod
+			collector.MarkTree(api.Tree{Root: &api.Node{
+				Stat: api.Stat{Kind: api.KindDirectory},
+				Children: []*api.Node{
+					{Stat: api.Stat{Name: "file", Kind: api.KindRegular, Payload: testdata.SRI(t, "tree"), Size: 4}},
+					{Stat: api.Stat{Name: "link", Kind: api.KindSymlink, Payload: "file"}},
+				},
+			}})
+			collector.MarkFlat(api.Flat{Files: []api.Stat{
+				{Name: "/", Kind: api.KindDirectory},
+				{Name: "/file", Kind: api.KindRegular, Payload: testdata.SRI(t, "flat"), Size: 4},
+			}})
+
+			report, err := collector.Sweep()
+			require.NoError(err)
+			assert.Equal(4, report.Scanned)
+			assert.Equal(2, report.Live)
+			assert.Equal(tc.wantRetained, report.Retained)
+			var deleted []string
+			var wantBytes int64
+			for _, blob := range report.Deleted {
+				deleted = append(deleted, blob.SRI)
+			}
+			var wantDeleted []string
+			for _, payload := range tc.wantDeleted {
+				wantDeleted = append(wantDeleted, testdata.SRI(t, payload))
+				wantBytes += int64(len(payload))
+			}
+			assert.ElementsMatch(wantDeleted, deleted)
+			assert.Equal(wantBytes, report.BytesReclaimed)
+
+			for _, payload := range tc.wantPresent {
+				_, err := cas.Stat(testdata.SRI(t, payload))
+				assert.NoError(err, payload)
+			}
+			if !tc.dryRun {
+				for _, payload := range tc.wantDeleted {
+					_, err := cas.Stat(testdata.SRI(t, payload))
+					assert.ErrorIs(err, fs.ErrNotExist, payload)
+				}
+			}
+		})
+	}
+}
+
+func TestSweepReferences(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend, err := dir.New(t.TempDir())
+	require.NoError(err)
+	chunked, err := chunk.New(backend, chunk.Options{MinSize: 64, AvgSize: 256, MaxSize: 1024, Index: actioncache.NewMemory()})
+	require.NoError(err)
+	live := strings.Repeat("live payload with some content ", 500)
+	dead := strings.Repeat("dead payload with other content ", 500)
+	require.NoError(chunked.Write(testdata.SRI(t, live), strings.NewReader(live)))
+	require.NoError(chunked.Write(testdata.SRI(t, dead), strings.NewReader(dead)))
+	liveChunks, err := chunked.References(testdata.SRI(t, live))
+	require.NoError(err)
+	require.NotEmpty(liveChunks)
+
+	collector := gc.New(backend)
+	collector.References = chunked.References
+	collector.Mark(testdata.SRI(t, live))
+	report, err := collector.Sweep()
+	require.NoError(err)
+	assert.NotEmpty(report.Deleted)
+
+	body, err := chunked.Open(testdata.SRI(t, live))
+	require.NoError(err)
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	require.NoError(body.Close())
+	assert.Equal(live, string(got))
+	_, err = chunked.Stat(testdata.SRI(t, dead))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestSweepGracePeriodRewrite(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	root := t.TempDir()
+	cas, err := dir.New(root)
+	require.NoError(err)
+	payload := "unreferenced for a long time"
+	require.NoError(cas.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	longAgo := time.Now().Add(-2 * time.Hour)
+	require.NoError(os.Chtimes(blobPath(t, root, testdata.SRI(t, payload)), longAgo, longAgo))
+
+	// a concurrent upload references the old blob again,
+	// but its tree is not marked as live yet
+	require.NoError(cas.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+
+	collector := gc.New(cas)
+	collector.GracePeriod = time.Hour
+	report, err := collector.Sweep()
+	require.NoError(err)
+	assert.Empty(report.Deleted)
+	assert.Equal(1, report.Retained)
+	_, err = cas.Stat(testdata.SRI(t, payload))
+	assert.NoError(err)
+}
+
+func TestSweepRewriteAfterList(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	root := t.TempDir()
+	backend, err := dir.New(root)
+	require.NoError(err)
+	payload := "referenced again during the sweep"
+	require.NoError(backend.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	longAgo := time.Now().Add(-2 * time.Hour)
+	require.NoError(os.Chtimes(blobPath(t, root, testdata.SRI(t, payload)), longAgo, longAgo))
+
+	// the blob is written again after it was listed, but before it is deleted
+	cas := &rewritingCAS{CAS: backend, rewrite: func() {
+		require.NoError(backend.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	}}
+	collector := gc.New(cas)
+	collector.GracePeriod = time.Hour
+	report, err := collector.Sweep()
+	require.NoError(err)
+	assert.Empty(report.Deleted)
+	assert.Equal(1, report.Retained)
+	_, err = backend.Stat(testdata.SRI(t, payload))
+	assert.NoError(err)
+}
+
+// rewritingCAS calls rewrite after listing the blobs of CAS.
+type rewritingCAS struct {
+	*dir.CAS
+	rewrite func()
+}
+
+func (c *rewritingCAS) List(algorithm string, fn func(api.BlobInfo) error) error {
+	if err := c.CAS.List(algorithm, fn); err != nil {
+		return err
+	}
+	c.rewrite()
+	return nil
+}
+
+func blobPath(t *testing.T, root, sriString string) string {
+	t.Helper()
+	integrity, err := sri.FromString(sriString)
+	require.NoError(t, err)
+	hexHash := integrity.Hex()
+	return filepath.Join(root, string(integrity.Algorithm), hexHash[:2], hexHash[2:])
+}
@@ -0,0 +1,259 @@
+package http_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthTokens(t *testing.T) {
+	backend := memory.New(0)
+	require.NoError(t, backend.Write(testdata.SRI(t, "existing"), strings.NewReader("existing")))
+	tokens := cashttp.NewTokenAuthorizer(map[string]cashttp.Principal{
+		"reader": {Permissions: cashttp.PermissionRead},
+		"writer": {Permissions: cashttp.PermissionReadWrite},
+	})
+	server := httptest.NewServer(cashttp.NewAuthHandler(cashttp.NewHandler(backend), cashttp.AuthOptions{
+		Authorizers: []cashttp.Authorizer{tokens},
+	}))
+	defer server.Close()
+	existing := server.URL + blobPath(t, testdata.SRI(t, "existing"))
+	upload := server.URL + blobPath(t, testdata.SRI(t, "new"))
+
+	testCases := map[string]struct {
+		method     string
+		url        string
+		body       string
+		token      string
+		wantStatus int
+	}{
+		"no token":             {method: http.MethodGet, url: existing, wantStatus: http.StatusUnauthorized},
+		"invalid token":        {method: http.MethodGet, url: existing, token: "guess", wantStatus: http.StatusUnauthorized},
+		"reader reads":         {method: http.MethodGet, url: existing, token: "reader", wantStatus: http.StatusOK},
+		"reader queries":       {method: http.MethodPost, url: server.URL + "/cas/missing", body: `{"sris":[]}`, token: "reader", wantStatus: http.StatusOK},
+		"reader cannot write":  {method: http.MethodPut, url: upload, body: "new", token: "reader", wantStatus: http.StatusForbidden},
+		"reader cannot delete": {method: http.MethodDelete, url: existing, token: "reader", wantStatus: http.StatusForbidden},
+		"writer writes":        {method: http.MethodPut, url: upload, body: "new", token: "writer", wantStatus: http.StatusOK},
+		"reader cannot inspect uploads": {
+			method: http.MethodGet, url: server.URL + "/cas/uploads/0123456789abcdef", token: "reader", wantStatus: http.StatusForbidden,
+		},
+		"reader cannot stat uploads": {
+			method: http.MethodHead, url: server.URL + "/cas/uploads/0123456789abcdef", token: "reader", wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			header := map[string]string{}
+			if tc.token != "" {
+				header["Authorization"] = "Bearer " + tc.token
+			}
+			resp := do(t, tc.method, tc.url, tc.body, header)
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+			if tc.wantStatus == http.StatusUnauthorized {
+				assert.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAuthClientToken(t *testing.T) {
+	backend := memory.New(0)
+	server := httptest.NewServer(cashttp.NewAuthHandler(cashttp.NewHandler(backend), cashttp.AuthOptions{
+		Authorizers: []cashttp.Authorizer{cashttp.NewTokenAuthorizer(map[string]cashttp.Principal{
+			"secret": {Permissions: cashttp.PermissionReadWrite},
+		})},
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+
+	assert.Error(t, client.Write(testdata.SRI(t, "blob"), strings.NewReader("blob")))
+	client.Token = "secret"
+	assert.NoError(t, client.Write(testdata.SRI(t, "blob"), strings.NewReader("blob")))
+	assert.True(t, backend.Has(testdata.SRI(t, "blob")))
+}
+
+func TestAuthSignedURLs(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	require.NoError(t, backend.Write(testdata.SRI(t, "shared"), strings.NewReader("shared")))
+	now := time.Unix(1_000_000, 0)
+	clock := func() time.Time { return now }
+	signer := &cashttp.URLSigner{Key: []byte("signing key"), Now: clock}
+	server := httptest.NewServer(cashttp.NewAuthHandler(cashttp.NewHandler(backend), cashttp.AuthOptions{
+		Authorizers: []cashttp.Authorizer{signer},
+	}))
+	defer server.Close()
+	blobURL := server.URL + blobPath(t, testdata.SRI(t, "shared"))
+	clientSigner := &cashttp.URLSigner{Key: []byte("signing key")}
+
+	signed, err := clientSigner.Sign(blobURL, http.MethodGet, now.Add(time.Minute))
+	require.NoError(t, err)
+	resp := do(t, http.MethodGet, signed, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("shared", readBody(t, resp))
+	resp = do(t, http.MethodHead, signed, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// a read signature does not allow writing
+	resp = do(t, http.MethodDelete, signed, "", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	// the signature is bound to the path
+	otherURL := server.URL + blobPath(t, testdata.SRI(t, "other"))
+	tampered := otherURL + signed[len(blobURL):]
+	resp = do(t, http.MethodGet, tampered, "", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	wrongKey := &cashttp.URLSigner{Key: []byte("wrong key")}
+	forged, err := wrongKey.Sign(blobURL, http.MethodGet, now.Add(time.Minute))
+	require.NoError(t, err)
+	resp = do(t, http.MethodGet, forged, "", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	expired, err := clientSigner.Sign(blobURL, http.MethodGet, now.Add(-time.Second))
+	require.NoError(t, err)
+	resp = do(t, http.MethodGet, expired, "", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	// the signature covers the query
+	resp = do(t, http.MethodGet, signed+"&verify=false", "", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	withQuery, err := clientSigner.Sign(blobURL+"?verify=false", http.MethodGet, now.Add(time.Minute))
+	require.NoError(t, err)
+	resp = do(t, http.MethodGet, withQuery, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp = do(t, http.MethodGet, strings.Replace(withQuery, "verify=false", "verify=true", 1), "", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	upload, err := clientSigner.Sign(otherURL, http.MethodPut, now.Add(time.Minute))
+	require.NoError(t, err)
+	resp = do(t, http.MethodPut, upload, "other", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(backend.Has(testdata.SRI(t, "other")))
+}
+
+func TestAuthSignedURLsWithPrefix(t *testing.T) {
+	backend := memory.New(0)
+	require.NoError(t, backend.Write(testdata.SRI(t, "shared"), strings.NewReader("shared")))
+	signer := &cashttp.URLSigner{Key: []byte("signing key"), Prefix: "/cache"}
+	authOpts := cashttp.AuthOptions{Authorizers: []cashttp.Authorizer{signer}}
+	testCases := map[string]http.Handler{
+		"authorized before stripping": cashttp.NewAuthHandler(http.StripPrefix("/cache", cashttp.NewHandler(backend)), authOpts),
+		"authorized after stripping":  http.StripPrefix("/cache", cashttp.NewAuthHandler(cashttp.NewHandler(backend), authOpts)),
+	}
+
+	for name, handler := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			blobURL := server.URL + "/cache" + blobPath(t, testdata.SRI(t, "shared"))
+
+			signed, err := signer.Sign(blobURL, http.MethodGet, time.Now().Add(time.Minute))
+			require.NoError(t, err)
+			resp := do(t, http.MethodGet, signed, "", nil)
+			assert.Equal(http.StatusOK, resp.StatusCode)
+			assert.Equal("shared", readBody(t, resp))
+
+			// the signature is bound to the path below the prefix
+			otherURL := server.URL + "/cache" + blobPath(t, testdata.SRI(t, "other"))
+			resp = do(t, http.MethodGet, otherURL+signed[len(blobURL):], "", nil)
+			assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+			_, err = signer.Sign(server.URL+blobPath(t, testdata.SRI(t, "shared")), http.MethodGet, time.Now().Add(time.Minute))
+			assert.Error(err)
+		})
+	}
+}
+
+func TestAuthQuota(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	require.NoError(t, backend.Write(testdata.SRI(t, "0123456789"), strings.NewReader("0123456789")))
+	now := time.Unix(1_000_000, 0)
+	server := httptest.NewServer(cashttp.NewAuthHandler(cashttp.NewHandler(backend), cashttp.AuthOptions{
+		Authorizers: []cashttp.Authorizer{cashttp.NewTokenAuthorizer(map[string]cashttp.Principal{
+			"limited":  {ID: "limited", Permissions: cashttp.PermissionReadWrite, Quota: cashttp.Quota{Requests: 2, Window: time.Hour}},
+			"metered":  {ID: "metered", Permissions: cashttp.PermissionReadWrite, Quota: cashttp.Quota{Bytes: 15}},
+			"anything": {Permissions: cashttp.PermissionRead},
+		})},
+		Now: func() time.Time { return now },
+	}))
+	defer server.Close()
+	blobURL := server.URL + blobPath(t, testdata.SRI(t, "0123456789"))
+	get := func(token string) int {
+		return do(t, http.MethodGet, blobURL, "", map[string]string{"Authorization": "Bearer " + token}).StatusCode
+	}
+
+	assert.Equal(http.StatusOK, get("limited"))
+	assert.Equal(http.StatusOK, get("limited"))
+	assert.Equal(http.StatusTooManyRequests, get("limited"))
+	now = now.Add(time.Hour)
+	assert.Equal(http.StatusOK, get("limited"))
+
+	// 10 bytes per download
+	assert.Equal(http.StatusOK, get("metered"))
+	assert.Equal(http.StatusOK, get("metered"))
+	assert.Equal(http.StatusTooManyRequests, get("metered"))
+
+	// a principal without a quota is not limited
+	for i := 0; i < 5; i++ {
+		assert.Equal(http.StatusOK, get("anything"))
+	}
+}
+
+func TestAuthQuotaStreaming(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	large := strings.Repeat("x", 100)
+	require.NoError(t, backend.Write(testdata.SRI(t, large), strings.NewReader(large)))
+	server := httptest.NewServer(cashttp.NewAuthHandler(cashttp.NewHandler(backend), cashttp.AuthOptions{
+		Authorizers: []cashttp.Authorizer{cashttp.NewTokenAuthorizer(map[string]cashttp.Principal{
+			"uploader":   {ID: "uploader", Permissions: cashttp.PermissionReadWrite, Quota: cashttp.Quota{Bytes: 50}},
+			"downloader": {ID: "downloader", Permissions: cashttp.PermissionReadWrite, Quota: cashttp.Quota{Bytes: 50}},
+		})},
+	}))
+	defer server.Close()
+
+	// an upload without Content-Length is cut off once it exceeds the quota
+	req, err := http.NewRequest(http.MethodPut, server.URL+blobPath(t, testdata.SRI(t, large+"y")), io.MultiReader(strings.NewReader(large), strings.NewReader("y")))
+	require.NoError(t, err)
+	req.ContentLength = -1
+	req.Header.Set("Authorization", "Bearer uploader")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.False(backend.Has(testdata.SRI(t, large+"y")))
+
+	// a download is cut off once it exceeds the quota
+	resp = do(t, http.MethodGet, server.URL+blobPath(t, testdata.SRI(t, large)), "", map[string]string{"Authorization": "Bearer downloader"})
+	body, err := io.ReadAll(resp.Body)
+	assert.Error(err)
+	assert.Len(body, 50)
+}
+
+func TestAuthAnonymous(t *testing.T) {
+	backend := memory.New(0)
+	require.NoError(t, backend.Write(testdata.SRI(t, "public"), strings.NewReader("public")))
+	server := httptest.NewServer(cashttp.NewAuthHandler(cashttp.NewHandler(backend), cashttp.AuthOptions{
+		Anonymous: cashttp.PermissionRead,
+	}))
+	defer server.Close()
+
+	resp := do(t, http.MethodGet, server.URL+blobPath(t, testdata.SRI(t, "public")), "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(t, http.MethodPut, server.URL+blobPath(t, testdata.SRI(t, "new")), "new", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,82 @@
+package http_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/cas/actioncache"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBazelCAS(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	server := httptest.NewServer(cashttp.NewBazelHandler(backend, actioncache.NewMemory(), cashttp.HandlerOptions{}))
+	defer server.Close()
+	key := sha256Hex("output")
+
+	resp := do(t, http.MethodGet, server.URL+"/cas/"+key, "", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	resp = do(t, http.MethodPut, server.URL+"/cas/"+key, "output", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(backend.Has(testdata.SRI(t, "output")))
+
+	resp = do(t, http.MethodHead, server.URL+"/cas/"+key, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("6", resp.Header.Get("Content-Length"))
+
+	resp = do(t, http.MethodGet, server.URL+"/cas/"+key, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("output", readBody(t, resp))
+
+	// content does not match the key
+	resp = do(t, http.MethodPut, server.URL+"/cas/"+sha256Hex("other"), "output", nil)
+	assert.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.False(backend.Has(testdata.SRI(t, "other")))
+}
+
+func TestBazelAC(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(cashttp.NewBazelHandler(memory.New(0), actioncache.NewMemory(), cashttp.HandlerOptions{}))
+	defer server.Close()
+	key := sha256Hex("action")
+
+	resp := do(t, http.MethodGet, server.URL+"/ac/"+key, "", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// action results are not content addressed
+	resp = do(t, http.MethodPut, server.URL+"/ac/"+key, "result v1", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp = do(t, http.MethodPut, server.URL+"/ac/"+key, "result v2", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp = do(t, http.MethodHead, server.URL+"/ac/"+key, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("9", resp.Header.Get("Content-Length"))
+
+	resp = do(t, http.MethodGet, server.URL+"/ac/"+key, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("result v2", readBody(t, resp))
+}
+
+func TestBazelInvalidPath(t *testing.T) {
+	server := httptest.NewServer(cashttp.NewBazelHandler(memory.New(0), actioncache.NewMemory(), cashttp.HandlerOptions{}))
+	defer server.Close()
+
+	for _, path := range []string{"/cas/sha256/" + sha256Hex("x"), "/cas/abcd", "/ac/", "/other/" + sha256Hex("x")} {
+		resp := do(t, http.MethodGet, server.URL+path, "", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+}
+
+func sha256Hex(payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,300 @@
+package http_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	client := newTestClient(t)
+
+	integrity := testdata.SRI(t, "foo")
+	require.NoError(client.Write(integrity, strings.NewReader("foo")))
+
+	body, err := client.Open(integrity)
+	require.NoError(err)
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	assert.Equal("foo", string(got))
+}
+
+func TestClientOpenNotExist(t *testing.T) {
+	client := newTestClient(t)
+	_, err := client.Open(testdata.SRI(t, "foo"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestClientStat(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	client := newTestClient(t)
+
+	_, err := client.Stat(testdata.SRI(t, "foo"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	require.NoError(client.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+	size, err := client.Stat(testdata.SRI(t, "foo"))
+	require.NoError(err)
+	assert.Equal(int64(3), size)
+}
+
+func TestClientFindMissing(t *testing.T) {
+	testCases := map[string]struct {
+		stored  []string
+		query   []string
+		want    []string
+		wantErr bool
+	}{
+		"empty query": {},
+		"all missing": {
+			query: []string{testdata.SRI(t, "foo"), testdata.SRI(t, "bar")},
+			want:  []string{testdata.SRI(t, "foo"), testdata.SRI(t, "bar")},
+		},
+		"some missing": {
+			stored: []string{"foo"},
+			query:  []string{testdata.SRI(t, "foo"), testdata.SRI(t, "bar")},
+			want:   []string{testdata.SRI(t, "bar")},
+		},
+		"none missing": {
+			stored: []string{"foo", "bar"},
+			query:  []string{testdata.SRI(t, "foo"), testdata.SRI(t, "bar")},
+		},
+		"invalid sri": {
+			query:   []string{"sha256-foo"},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			client := newTestClient(t)
+			client.Retries = 0
+			for _, payload := range tc.stored {
+				require.NoError(client.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+			}
+
+			missing, err := client.FindMissing(tc.query)
+			if tc.wantErr {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			assert.ElementsMatch(tc.want, missing)
+		})
+	}
+}
+
+func TestClientOpenRange(t *testing.T) {
+	payload := "0123456789"
+	dirCAS, err := dir.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, dirCAS.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	mapCAS := newMapCAS()
+	require.NoError(t, mapCAS.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+
+	testCases := map[string]struct {
+		offset, length int64
+		want           string
+	}{
+		"whole blob":      {offset: 0, length: -1, want: payload},
+		"middle":          {offset: 3, length: 4, want: "3456"},
+		"tail":            {offset: 8, length: -1, want: "89"},
+		"empty":           {offset: 3, length: 0, want: ""},
+		"beyond the end":  {offset: 20, length: -1, want: ""},
+		"length too long": {offset: 8, length: 10, want: "89"},
+	}
+
+	backends := map[string]api.CAS{
+		// dir supports range reads on the server side
+		"range capable server": dirCAS,
+		// mapCAS forces the server to ignore the range
+		"range ignoring server": mapCAS,
+	}
+
+	for backendName, backend := range backends {
+		server := httptest.NewServer(cashttp.NewHandler(backend))
+		defer server.Close()
+		client, err := cashttp.NewClient(server.URL)
+		require.NoError(t, err)
+
+		for name, tc := range testCases {
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				require := require.New(t)
+				body, err := client.OpenRange(testdata.SRI(t, payload), tc.offset, tc.length)
+				require.NoError(err)
+				defer body.Close()
+				got, err := io.ReadAll(body)
+				require.NoError(err)
+				assert.Equal(t, tc.want, string(got))
+			})
+		}
+	}
+}
+
+func TestClientListDelete(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	client := newTestClient(t)
+	payloads := []string{"foo", "bar", "baz"}
+	var want []string
+	for _, payload := range payloads {
+		require.NoError(client.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+		want = append(want, testdata.SRI(t, payload))
+	}
+	sha512, err := sri.FromReader(sri.SHA512, strings.NewReader("foo"))
+	require.NoError(err)
+	require.NoError(client.Write(sha512.String(), strings.NewReader("foo")))
+
+	var listed []string
+	require.NoError(client.List("sha256", func(blob api.BlobInfo) error {
+		assert.Equal(int64(3), blob.Size)
+		assert.False(blob.ModTime.IsZero())
+		listed = append(listed, blob.SRI)
+		return nil
+	}))
+	assert.ElementsMatch(want, listed)
+
+	listed = nil
+	require.NoError(client.List("", func(blob api.BlobInfo) error {
+		listed = append(listed, blob.SRI)
+		return nil
+	}))
+	assert.ElementsMatch(append(want, sha512.String()), listed)
+
+	require.NoError(client.Delete(testdata.SRI(t, "foo")))
+	assert.ErrorIs(client.Delete(testdata.SRI(t, "foo")), fs.ErrNotExist)
+	_, err = client.Stat(testdata.SRI(t, "foo"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestClientBasePath(t *testing.T) {
+	require := require.New(t)
+	cas, err := dir.New(t.TempDir())
+	require.NoError(err)
+	mux := http.NewServeMux()
+	mux.Handle("/prefix/", http.StripPrefix("/prefix", cashttp.NewHandler(cas)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := cashttp.NewClient(server.URL + "/prefix/")
+	require.NoError(err)
+	integrity := testdata.SRI(t, "foo")
+	require.NoError(client.Write(integrity, strings.NewReader("foo")))
+	body, err := cas.Open(integrity)
+	require.NoError(err)
+	body.Close()
+}
+
+func TestClientRetries(t *testing.T) {
+	testCases := map[string]struct {
+		failures  int32
+		retries   int
+		body      func() io.Reader
+		wantErr   bool
+		wantCalls int32
+	}{
+		"no failures": {
+			retries:   2,
+			body:      func() io.Reader { return strings.NewReader("foo") },
+			wantCalls: 1,
+		},
+		"recovers after failures": {
+			failures:  2,
+			retries:   2,
+			body:      func() io.Reader { return strings.NewReader("foo") },
+			wantCalls: 3,
+		},
+		"too many failures": {
+			failures:  3,
+			retries:   2,
+			body:      func() io.Reader { return strings.NewReader("foo") },
+			wantErr:   true,
+			wantCalls: 3,
+		},
+		"unseekable body is not retried": {
+			failures:  1,
+			retries:   2,
+			body:      func() io.Reader { return io.MultiReader(bytes.NewBufferString("foo")) },
+			wantErr:   true,
+			wantCalls: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			cas, err := dir.New(t.TempDir())
+			require.NoError(err)
+			handler := cashttp.NewHandler(cas)
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= tc.failures {
+					io.Copy(io.Discard, req.Body)
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				handler.ServeHTTP(w, req)
+			}))
+			defer server.Close()
+
+			client, err := cashttp.NewClient(server.URL)
+			require.NoError(err)
+			client.Retries = tc.retries
+			client.Backoff = time.Millisecond
+
+			err = client.Write(testdata.SRI(t, "foo"), tc.body())
+			assert.Equal(tc.wantErr, err != nil)
+			assert.Equal(tc.wantCalls, atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+	client.Retries = 0
+	client.Timeout = 10 * time.Millisecond
+	_, err = client.Open(testdata.SRI(t, "foo"))
+	assert.Error(t, err)
+}
+
+func newTestClient(t *testing.T) *cashttp.Client {
+	t.Helper()
+	cas, err := dir.New(t.TempDir())
+	require.NoError(t, err)
+	server := httptest.NewServer(cashttp.NewHandler(cas))
+	t.Cleanup(server.Close)
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+	client.Backoff = time.Millisecond
+	return client
+}
@@ -0,0 +1,165 @@
+package http_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerErrorStatus(t *testing.T) {
+	testCases := map[string]struct {
+		openErr     error
+		wantStatus  int
+		wantCode    string
+		wantMessage string
+	}{
+		"not found": {
+			openErr:     fmt.Errorf("opening: %w", api.ErrNotFound),
+			wantStatus:  http.StatusNotFound,
+			wantCode:    "not_found",
+			wantMessage: "opening: file does not exist",
+		},
+		"unavailable": {
+			openErr:     &api.UnavailableError{Err: errors.New("connection refused")},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantCode:    "unavailable",
+			wantMessage: "Service Unavailable",
+		},
+		"integrity mismatch": {
+			openErr:     fmt.Errorf("reading: %w", api.ErrIntegrityMismatch),
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantCode:    "integrity_mismatch",
+			wantMessage: "reading: integrity mismatch",
+		},
+		"io error": {
+			openErr:     errors.New("open /var/cache/abstractfs/blob: disk on fire"),
+			wantStatus:  http.StatusInternalServerError,
+			wantCode:    "internal",
+			wantMessage: "Internal Server Error",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			hook := &recordingHook{}
+			handler := cashttp.NewHandlerWithOptions(&failingCAS{err: tc.openErr}, cashttp.HandlerOptions{Events: hook})
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, blobPath(t, testdata.SRI(t, "blob")), nil))
+			assert.Equal(tc.wantStatus, rec.Code)
+			assert.Equal("application/json", rec.Header().Get("Content-Type"))
+			var body struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			}
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+			assert.Equal(tc.wantCode, body.Code)
+			// details of server errors are only passed to the event hook
+			assert.Equal(tc.wantMessage, body.Message)
+			require.Len(t, hook.events, 1)
+			assert.Equal(tc.openErr, hook.events[0].Err)
+		})
+	}
+}
+
+func TestHandlerInvalidSRI(t *testing.T) {
+	handler := cashttp.NewHandler(memory.New(0))
+	for _, path := range []string{"/cas/md5/00", "/cas/sha256/zz", "/cas/sha256/0011"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, path)
+		assert.Contains(t, rec.Body.String(), `"code":"invalid_sri"`, path)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(backend, cashttp.HandlerOptions{MaxBlobSize: 4}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+	client.Retries = 0
+
+	_, err = client.Open(testdata.SRI(t, "missing"))
+	assert.ErrorIs(err, api.ErrNotFound)
+	err = client.Write(testdata.SRI(t, "blob"), strings.NewReader("tampered"[:4]))
+	assert.ErrorIs(err, api.ErrIntegrityMismatch)
+	err = client.Write(testdata.SRI(t, "large blob"), strings.NewReader("large blob"))
+	assert.ErrorIs(err, api.ErrTooLarge)
+	_, err = client.Open("sha256-invalid")
+	assert.ErrorIs(err, api.ErrInvalidSRI)
+
+	// the kind of errors of failing backends is passed through, but not their details
+	unavailable := httptest.NewServer(cashttp.NewHandler(&failingCAS{err: &api.UnavailableError{Err: io.ErrUnexpectedEOF}}))
+	defer unavailable.Close()
+	client, err = cashttp.NewClient(unavailable.URL)
+	require.NoError(t, err)
+	client.Retries = 0
+	_, err = client.Open(testdata.SRI(t, "blob"))
+	assert.ErrorIs(err, api.ErrUnavailable)
+	assert.NotContains(err.Error(), io.ErrUnexpectedEOF.Error())
+
+	// unreachable servers are unavailable
+	unavailable.Close()
+	_, err = client.Open(testdata.SRI(t, "blob"))
+	assert.ErrorIs(err, api.ErrUnavailable)
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	server := httptest.NewServer(cashttp.NewAuthHandler(cashttp.NewHandler(memory.New(0)), cashttp.AuthOptions{
+		Authorizers: []cashttp.Authorizer{cashttp.NewTokenAuthorizer(map[string]cashttp.Principal{
+			"secret": {Permissions: cashttp.PermissionReadWrite},
+		})},
+		Anonymous: cashttp.PermissionRead,
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+
+	err = client.Write(testdata.SRI(t, "blob"), strings.NewReader("blob"))
+	assert.ErrorIs(t, err, api.ErrUnauthorized)
+	client.Token = "unknown"
+	_, err = client.Stat(testdata.SRI(t, "blob"))
+	assert.ErrorIs(t, err, api.ErrUnauthorized)
+}
+
+func TestClientPlainTextErrors(t *testing.T) {
+	// servers or proxies without JSON error bodies are mapped by status code
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+	client.Retries = 0
+
+	_, err = client.Open(testdata.SRI(t, "blob"))
+	assert.ErrorIs(t, err, api.ErrUnavailable)
+	assert.Contains(t, err.Error(), "slow down")
+}
+
+// failingCAS is a CAS whose operations fail with err.
+type failingCAS struct {
+	err error
+}
+
+func (f *failingCAS) Open(string) (io.ReadCloser, error) {
+	return nil, f.err
+}
+
+func (f *failingCAS) Write(string, io.Reader) error {
+	return f.err
+}
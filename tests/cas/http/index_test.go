@@ -0,0 +1,101 @@
+package http_test
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/cas/actioncache"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIndex(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(memory.New(0), cashttp.HandlerOptions{
+		Index: actioncache.NewMemory(),
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(err)
+	index := client.Index()
+	key := strings.Repeat("ab", 32)
+
+	_, err = index.Get(key)
+	assert.ErrorIs(err, fs.ErrNotExist)
+	require.NoError(index.Put(key, []byte("first")))
+	require.NoError(index.Put(key, []byte("second")))
+	value, err := index.Get(key)
+	require.NoError(err)
+	assert.Equal("second", string(value))
+
+	assert.Error(index.Put("ABCD", []byte("invalid key")))
+}
+
+func TestHandlerIndex(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	testCases := map[string]struct {
+		noIndex    bool
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		"put": {
+			method:     http.MethodPut,
+			path:       "/index/" + key,
+			body:       "value",
+			wantStatus: http.StatusOK,
+		},
+		"get missing": {
+			method:     http.MethodGet,
+			path:       "/index/" + key,
+			wantStatus: http.StatusNotFound,
+		},
+		"head missing": {
+			method:     http.MethodHead,
+			path:       "/index/" + key,
+			wantStatus: http.StatusNotFound,
+		},
+		"short key": {
+			method:     http.MethodGet,
+			path:       "/index/abcd",
+			wantStatus: http.StatusBadRequest,
+		},
+		"uppercase key": {
+			method:     http.MethodGet,
+			path:       "/index/" + strings.ToUpper(key),
+			wantStatus: http.StatusBadRequest,
+		},
+		"value too large": {
+			method:     http.MethodPut,
+			path:       "/index/" + key,
+			body:       strings.Repeat("x", 2<<20),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		"not supported": {
+			noIndex:    true,
+			method:     http.MethodGet,
+			path:       "/index/" + key,
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			opts := cashttp.HandlerOptions{Index: actioncache.NewMemory()}
+			if tc.noIndex {
+				opts.Index = nil
+			}
+			rec := httptest.NewRecorder()
+			cashttp.NewHandlerWithOptions(memory.New(0), opts).ServeHTTP(rec,
+				httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+			assert.Equal(t, tc.wantStatus, rec.Code)
+		})
+	}
+}
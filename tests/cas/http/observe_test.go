@@ -0,0 +1,91 @@
+package http_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/cas/metrics"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerMetrics(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(memory.New(0), cashttp.HandlerOptions{Metrics: registry}))
+	defer server.Close()
+	blobURL := server.URL + blobPath(t, testdata.SRI(t, "hello"))
+
+	assert.Equal(http.StatusNotFound, do(t, http.MethodGet, blobURL, "", nil).StatusCode)
+	assert.Equal(http.StatusOK, do(t, http.MethodPut, blobURL, "hello", nil).StatusCode)
+	resp := do(t, http.MethodGet, blobURL, "", nil)
+	assert.Equal("hello", readBody(t, resp))
+
+	requests := registry.Counter("abstractfs_http_requests_total", "", "handler", "method", "code")
+	assert.Equal(1.0, requests.Value("cas", "GET", "404"))
+	assert.Equal(1.0, requests.Value("cas", "GET", "200"))
+	assert.Equal(1.0, requests.Value("cas", "PUT", "200"))
+	assert.Equal(5.0, registry.Counter("abstractfs_http_received_bytes_total", "", "handler", "method").Value("cas", "PUT"))
+	assert.GreaterOrEqual(registry.Counter("abstractfs_http_sent_bytes_total", "", "handler", "method").Value("cas", "GET"), 5.0)
+	latency := registry.Histogram("abstractfs_http_request_duration_seconds", "", metrics.DurationBuckets, "handler", "method")
+	assert.Equal(uint64(2), latency.Count("cas", "GET"))
+
+	// the registry serves the metrics of the handler
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(rec.Body.String(), `abstractfs_http_requests_total{handler="cas",method="GET",code="404"} 1`)
+}
+
+func TestHandlerEvents(t *testing.T) {
+	assert := assert.New(t)
+	hook := &recordingHook{}
+	backend := memory.New(0)
+	handler, err := cashttp.NewOCIHandler(backend, cashttp.HandlerOptions{Events: hook})
+	require.NoError(t, err)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp := do(t, http.MethodPost, server.URL+"/v2/repo/blobs/uploads/?digest="+mustDigest(t, "layer"), "layer", nil)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	do(t, http.MethodGet, server.URL+"/v2/", "", nil)
+
+	hook.mux.Lock()
+	defer hook.mux.Unlock()
+	require.Len(t, hook.events, 2)
+	assert.Equal("oci", hook.events[0].Handler)
+	assert.Equal(http.MethodPost, hook.events[0].Method)
+	assert.Equal("/v2/repo/blobs/uploads/", hook.events[0].Path)
+	assert.Equal(http.StatusCreated, hook.events[0].Status)
+	assert.Equal(int64(5), hook.events[0].BytesIn)
+	assert.Equal(http.StatusOK, hook.events[1].Status)
+	assert.Equal(int64(2), hook.events[1].BytesOut)
+	// the context returned by RequestStarted is passed to RequestFinished
+	assert.Equal([]string{"span", "span"}, hook.spans)
+}
+
+type recordingHook struct {
+	mux    sync.Mutex
+	events []cashttp.RequestEvent
+	spans  []string
+}
+
+type spanKey struct{}
+
+func (h *recordingHook) RequestStarted(req *http.Request) context.Context {
+	return context.WithValue(req.Context(), spanKey{}, "span")
+}
+
+func (h *recordingHook) RequestFinished(req *http.Request, event cashttp.RequestEvent) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.events = append(h.events, event)
+	span, _ := req.Context().Value(spanKey{}).(string)
+	h.spans = append(h.spans, span)
+}
@@ -0,0 +1,309 @@
+package http_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOCIVersionCheck(t *testing.T) {
+	server := newOCIServer(t, memory.New(0))
+	resp := do(t, http.MethodGet, server.URL+"/v2/", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "registry/2.0", resp.Header.Get("Docker-Distribution-API-Version"))
+}
+
+func TestOCIMonolithicUpload(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	server := newOCIServer(t, backend)
+	digest := mustDigest(t, "layer")
+
+	resp := do(t, http.MethodPost, server.URL+"/v2/library/app/blobs/uploads/?digest="+digest, "layer", nil)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal("/v2/library/app/blobs/"+digest, resp.Header.Get("Location"))
+	assert.Equal(digest, resp.Header.Get("Docker-Content-Digest"))
+	assert.True(backend.Has(testdata.SRI(t, "layer")))
+
+	resp = do(t, http.MethodHead, server.URL+"/v2/other/blobs/"+digest, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("5", resp.Header.Get("Content-Length"))
+	assert.Equal(digest, resp.Header.Get("Docker-Content-Digest"))
+
+	resp = do(t, http.MethodGet, server.URL+"/v2/library/app/blobs/"+digest, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("layer", readBody(t, resp))
+
+	resp = do(t, http.MethodGet, server.URL+"/v2/library/app/blobs/"+digest, "", map[string]string{"Range": "bytes=1-2"})
+	assert.Equal(http.StatusPartialContent, resp.StatusCode)
+	assert.Equal("ay", readBody(t, resp))
+
+	// digest does not match the body
+	resp = do(t, http.MethodPost, server.URL+"/v2/library/app/blobs/uploads/?digest="+mustDigest(t, "other"), "layer", nil)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal("DIGEST_INVALID", errorCode(t, resp))
+	assert.False(backend.Has(testdata.SRI(t, "other")))
+}
+
+func TestOCIChunkedUpload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend := memory.New(0)
+	server := newOCIServer(t, backend)
+	digest := mustDigest(t, "hello world")
+
+	resp := do(t, http.MethodPost, server.URL+"/v2/a/b/c/blobs/uploads/", "", nil)
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	assert.True(strings.HasPrefix(location, "/v2/a/b/c/blobs/uploads/"))
+	assert.Equal("0-0", resp.Header.Get("Range"))
+
+	resp = do(t, http.MethodPatch, server.URL+location, "hello", map[string]string{"Content-Range": "0-4"})
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+	assert.Equal("0-4", resp.Header.Get("Range"))
+
+	// out of order chunk
+	resp = do(t, http.MethodPatch, server.URL+location, "xx", map[string]string{"Content-Range": "9-10"})
+	assert.Equal(http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	assert.Equal("0-4", resp.Header.Get("Range"))
+
+	resp = do(t, http.MethodPatch, server.URL+location, " wor", nil)
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+
+	resp = do(t, http.MethodGet, server.URL+location, "", nil)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Equal("0-8", resp.Header.Get("Range"))
+
+	resp = do(t, http.MethodPut, server.URL+location+"?digest="+digest, "ld", nil)
+	require.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal(digest, resp.Header.Get("Docker-Content-Digest"))
+
+	body, err := backend.Open(testdata.SRI(t, "hello world"))
+	require.NoError(err)
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	assert.Equal("hello world", string(got))
+
+	// the session is gone
+	resp = do(t, http.MethodPatch, server.URL+location, "more", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+	assert.Equal("BLOB_UPLOAD_UNKNOWN", errorCode(t, resp))
+}
+
+func TestOCIChunkedUploadDigestMismatch(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	server := newOCIServer(t, backend)
+
+	resp := do(t, http.MethodPost, server.URL+"/v2/repo/blobs/uploads/", "", nil)
+	location := resp.Header.Get("Location")
+	do(t, http.MethodPatch, server.URL+location, "evil", nil)
+	resp = do(t, http.MethodPut, server.URL+location+"?digest="+mustDigest(t, "good"), "", nil)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal("DIGEST_INVALID", errorCode(t, resp))
+	assert.False(backend.Has(testdata.SRI(t, "good")))
+}
+
+func TestOCIUploadCancelAndMount(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend := memory.New(0)
+	require.NoError(backend.Write(testdata.SRI(t, "base"), strings.NewReader("base")))
+	server := newOCIServer(t, backend)
+
+	resp := do(t, http.MethodPost, server.URL+"/v2/repo/blobs/uploads/?mount="+mustDigest(t, "base")+"&from=other", "", nil)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+
+	// mounting an unknown blob starts a regular upload
+	resp = do(t, http.MethodPost, server.URL+"/v2/repo/blobs/uploads/?mount="+mustDigest(t, "unknown")+"&from=other", "", nil)
+	require.Equal(http.StatusAccepted, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	resp = do(t, http.MethodDelete, server.URL+location, "", nil)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	resp = do(t, http.MethodGet, server.URL+location, "", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestOCIErrors(t *testing.T) {
+	server := newOCIServer(t, memory.New(0))
+
+	testCases := map[string]struct {
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		"unknown blob": {
+			method:     http.MethodGet,
+			path:       "/v2/repo/blobs/" + mustDigest(t, "missing"),
+			wantStatus: http.StatusNotFound,
+			wantCode:   "BLOB_UNKNOWN",
+		},
+		"invalid digest": {
+			method:     http.MethodGet,
+			path:       "/v2/repo/blobs/sha256:nothex",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "DIGEST_INVALID",
+		},
+		"manifests": {
+			method:     http.MethodGet,
+			path:       "/v2/repo/manifests/latest",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "UNSUPPORTED",
+		},
+		"unknown upload": {
+			method:     http.MethodPatch,
+			path:       "/v2/repo/blobs/uploads/unknown",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "BLOB_UPLOAD_UNKNOWN",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resp := do(t, tc.method, server.URL+tc.path, "", nil)
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+			assert.Equal(t, tc.wantCode, errorCode(t, resp))
+		})
+	}
+}
+
+func TestOCIInternalErrors(t *testing.T) {
+	testCases := map[string]struct {
+		method   string
+		path     string
+		wantCode string
+	}{
+		"stat fails": {
+			method:   http.MethodGet,
+			path:     "/v2/repo/blobs/" + mustDigest(t, "blob"),
+			wantCode: "BLOB_UNKNOWN",
+		},
+		"creating upload fails": {
+			method:   http.MethodPost,
+			path:     "/v2/repo/blobs/uploads/",
+			wantCode: "BLOB_UPLOAD_INVALID",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			uploadDir := t.TempDir()
+			handler, err := cashttp.NewOCIHandler(&failingCAS{err: errors.New("disk on fire")}, cashttp.HandlerOptions{UploadDir: uploadDir})
+			require.NoError(t, err)
+			defer handler.Close()
+			require.NoError(t, os.RemoveAll(uploadDir))
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			resp := do(t, tc.method, server.URL+tc.path, "", nil)
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+			assert.Equal(t, tc.wantCode, errorCode(t, resp))
+		})
+	}
+}
+
+func TestOCIOpenFailsAfterStat(t *testing.T) {
+	testCases := map[string]struct {
+		err        error
+		wantStatus int
+	}{
+		"deleted concurrently": {
+			err:        fs.ErrNotExist,
+			wantStatus: http.StatusNotFound,
+		},
+		"open fails": {
+			err:        errors.New("disk on fire"),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			backend := &statingCAS{failingCAS: failingCAS{err: tc.err}, size: 4}
+			handler, err := cashttp.NewOCIHandler(backend, cashttp.HandlerOptions{UploadDir: t.TempDir()})
+			require.NoError(t, err)
+			defer handler.Close()
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			resp := do(t, http.MethodGet, server.URL+"/v2/repo/blobs/"+mustDigest(t, "blob"), "", nil)
+			assert.Equal(t, tc.wantStatus, resp.StatusCode)
+			assert.Equal(t, "BLOB_UNKNOWN", errorCode(t, resp))
+		})
+	}
+}
+
+// statingCAS is a failingCAS that finds every blob with Stat.
+type statingCAS struct {
+	failingCAS
+	size int64
+}
+
+func (s *statingCAS) Stat(string) (int64, error) {
+	return s.size, nil
+}
+
+func newOCIServer(t *testing.T, backend *memory.CAS) *httptest.Server {
+	t.Helper()
+	handler, err := cashttp.NewOCIHandler(backend, cashttp.HandlerOptions{UploadDir: t.TempDir()})
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		server.Close()
+		handler.Close()
+	})
+	return server
+}
+
+func do(t *testing.T, method, url, body string, header map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func errorCode(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var errResp struct {
+		Errors []struct {
+			Code string `json:"code"`
+		} `json:"errors"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	require.NotEmpty(t, errResp.Errors)
+	return errResp.Errors[0].Code
+}
+
+func mustDigest(t *testing.T, payload string) string {
+	t.Helper()
+	integrity, err := sri.FromString(testdata.SRI(t, payload))
+	require.NoError(t, err)
+	return "sha256:" + integrity.Hex()
+}
@@ -0,0 +1,377 @@
+package http_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadSession(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(backend, cashttp.HandlerOptions{UploadDir: t.TempDir()}))
+	defer server.Close()
+	blob := testdata.SRI(t, "hello world")
+
+	sessionURL := createSession(t, server.URL)
+	resp := do(t, http.MethodPatch, sessionURL, "hello ", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Equal("6", resp.Header.Get("Upload-Offset"))
+
+	// the offset must match the received size
+	resp = do(t, http.MethodPatch, sessionURL, "world", map[string]string{"Upload-Offset": "3"})
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+	assert.Equal("6", resp.Header.Get("Upload-Offset"))
+	resp = do(t, http.MethodPatch, sessionURL, "world", nil)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(t, http.MethodHead, sessionURL, "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("6", resp.Header.Get("Upload-Offset"))
+	assert.NotEmpty(resp.Header.Get("Upload-Expires"))
+
+	resp = do(t, http.MethodPatch, sessionURL, "world", map[string]string{"Upload-Offset": "6"})
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.False(backend.Has(blob))
+
+	resp = do(t, http.MethodPut, sessionURL+"?"+url.Values{"sri": {blob}}.Encode(), "", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(backend.Has(blob))
+
+	// the session is removed after committing
+	resp = do(t, http.MethodHead, sessionURL, "", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUploadSessionErrors(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(backend, cashttp.HandlerOptions{MaxBlobSize: 8}))
+	defer server.Close()
+
+	sessionURL := createSession(t, server.URL)
+	resp := do(t, http.MethodPatch, sessionURL, "tampered", map[string]string{"Upload-Offset": "0"})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = do(t, http.MethodPut, sessionURL+"?"+url.Values{"sri": {testdata.SRI(t, "original")}}.Encode(), "", nil)
+	assert.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal("integrity_mismatch", errorResponseCode(t, resp))
+	// content that does not match can never be committed
+	resp = do(t, http.MethodHead, sessionURL, "", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	sessionURL = createSession(t, server.URL)
+	resp = do(t, http.MethodPatch, sessionURL, "too large", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal("0", resp.Header.Get("Upload-Offset"))
+	resp = do(t, http.MethodPut, sessionURL+"?sri=invalid", "", nil)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal("invalid_sri", errorResponseCode(t, resp))
+
+	resp = do(t, http.MethodDelete, sessionURL, "", nil)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	resp = do(t, http.MethodPatch, sessionURL, "data", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+	resp = do(t, http.MethodGet, server.URL+"/cas/uploads", "", nil)
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestUploadSessionKeepsPartialContent(t *testing.T) {
+	handler := cashttp.NewHandler(memory.New(0))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cas/uploads", nil))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	location := rec.Header().Get("Location")
+
+	// the connection drops after 5 bytes
+	body := io.MultiReader(strings.NewReader("hello"), &failingReader{err: io.ErrUnexpectedEOF})
+	req := httptest.NewRequest(http.MethodPatch, location, body)
+	req.Header.Set("Upload-Offset", "0")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, location, nil))
+	assert.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+}
+
+func TestUploadSessionExpiry(t *testing.T) {
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(memory.New(0), cashttp.HandlerOptions{UploadExpiry: 50 * time.Millisecond}))
+	defer server.Close()
+
+	sessionURL := createSession(t, server.URL)
+	time.Sleep(100 * time.Millisecond)
+	resp := do(t, http.MethodHead, sessionURL, "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUploadSessionLimits(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(memory.New(0), cashttp.HandlerOptions{
+		MaxUploads:     2,
+		MaxUploadBytes: 8,
+	}))
+	defer server.Close()
+
+	first := createSession(t, server.URL)
+	second := createSession(t, server.URL)
+	resp := do(t, http.MethodPost, server.URL+"/cas/uploads", "", nil)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+
+	resp = do(t, http.MethodPatch, first, "12345", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	// the staged content of all sessions counts against the limit
+	resp = do(t, http.MethodPatch, second, "67890", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal("0", resp.Header.Get("Upload-Offset"))
+
+	// removing a session frees its slot and its staged content
+	resp = do(t, http.MethodDelete, first, "", nil)
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	resp = do(t, http.MethodPatch, second, "67890", map[string]string{"Upload-Offset": "0"})
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	createSession(t, server.URL)
+}
+
+func TestHandlerClose(t *testing.T) {
+	assert := assert.New(t)
+	uploadDir := t.TempDir()
+	handler := cashttp.NewHandlerWithOptions(memory.New(0), cashttp.HandlerOptions{UploadDir: uploadDir})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	sessionURL := createSession(t, server.URL)
+	require.NoError(t, handler.Close())
+	entries, err := os.ReadDir(uploadDir)
+	require.NoError(t, err)
+	assert.Empty(entries)
+	resp := do(t, http.MethodHead, sessionURL, "", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+	resp = do(t, http.MethodPost, server.URL+"/cas/uploads", "", nil)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	// closing a handler that never created an upload store prevents creating one
+	unused := cashttp.NewHandler(memory.New(0))
+	require.NoError(t, unused.Close())
+	rec := httptest.NewRecorder()
+	unused.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cas/uploads", nil))
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestExpiredUploadRemoved(t *testing.T) {
+	testCases := map[string]struct {
+		newHandler func(opts cashttp.HandlerOptions) http.Handler
+		createPath string
+		wantStatus int
+	}{
+		"resumable upload": {
+			newHandler: func(opts cashttp.HandlerOptions) http.Handler {
+				handler := cashttp.NewHandlerWithOptions(memory.New(0), opts)
+				t.Cleanup(func() { handler.Close() })
+				return handler
+			},
+			createPath: "/cas/uploads",
+			wantStatus: http.StatusCreated,
+		},
+		"oci upload": {
+			newHandler: func(opts cashttp.HandlerOptions) http.Handler {
+				handler, err := cashttp.NewOCIHandler(memory.New(0), opts)
+				require.NoError(t, err)
+				t.Cleanup(func() { handler.Close() })
+				return handler
+			},
+			createPath: "/v2/repo/blobs/uploads/",
+			wantStatus: http.StatusAccepted,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			uploadDir := t.TempDir()
+			server := httptest.NewServer(tc.newHandler(cashttp.HandlerOptions{
+				UploadDir:    uploadDir,
+				UploadExpiry: 50 * time.Millisecond,
+			}))
+			defer server.Close()
+
+			resp := do(t, http.MethodPost, server.URL+tc.createPath, "", nil)
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+			entries, err := os.ReadDir(uploadDir)
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+
+			// no further requests are served
+			assert.Eventually(t, func() bool {
+				entries, err := os.ReadDir(uploadDir)
+				return err == nil && len(entries) == 0
+			}, 2*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestClientResumableUpload(t *testing.T) {
+	assert := assert.New(t)
+	backend := memory.New(0)
+	handler := cashttp.NewHandler(backend)
+	// every other chunk upload is interrupted after half of its body
+	var mux sync.Mutex
+	var patches, received int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPatch {
+			mux.Lock()
+			patches++
+			interrupt := patches%2 == 1
+			mux.Unlock()
+			body := &countingReader{r: req.Body, mux: &mux, n: &received}
+			req.Body = io.NopCloser(body)
+			if interrupt && req.ContentLength > 1 {
+				req.Body = io.NopCloser(io.MultiReader(io.LimitReader(body, req.ContentLength/2), &failingReader{err: io.ErrUnexpectedEOF}))
+			}
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+	client.Backoff = time.Millisecond
+	client.UploadChunkSize = 1000
+
+	payload := strings.Repeat("resumable upload ", 500)
+	blob := testdata.SRI(t, payload)
+	// a non-seekable reader can be resumed, since chunks are buffered
+	require.NoError(t, client.Write(blob, io.MultiReader(strings.NewReader(payload))))
+	assert.True(backend.Has(blob))
+	body, err := backend.Open(blob)
+	require.NoError(t, err)
+	got, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(payload, string(got))
+	// interrupted chunks were resumed instead of restarted
+	assert.Equal(len(payload), received)
+	assert.Greater(patches, 9)
+
+	err = client.Write(testdata.SRI(t, "original"), strings.NewReader("tampered"))
+	assert.ErrorIs(err, api.ErrIntegrityMismatch)
+}
+
+func TestClientResumableUploadFailure(t *testing.T) {
+	// the server drops every chunk without receiving anything
+	var deleted bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]any{"id": "session", "offset": 0})
+		case http.MethodHead:
+			w.Header().Set("Upload-Offset", "0")
+		case http.MethodDelete:
+			deleted = true
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+	client.Backoff = time.Millisecond
+	client.UploadChunkSize = 4
+
+	err = client.Write(testdata.SRI(t, "payload"), strings.NewReader("payload"))
+	assert.ErrorIs(t, err, api.ErrUnavailable)
+	assert.True(t, deleted)
+}
+
+func TestClientResumableCommitFailure(t *testing.T) {
+	// the server receives every chunk, but fails to commit
+	var deleted bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]any{"id": "session", "offset": 0})
+		case http.MethodPatch:
+			body, _ := io.ReadAll(req.Body)
+			offset := req.Header.Get("Upload-Offset")
+			received, _ := strconv.Atoi(offset)
+			w.Header().Set("Upload-Offset", strconv.Itoa(received+len(body)))
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			deleted = true
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+	client.Backoff = time.Millisecond
+	client.UploadChunkSize = 4
+
+	err = client.Write(testdata.SRI(t, "payload"), strings.NewReader("payload"))
+	assert.Error(t, err)
+	assert.True(t, deleted)
+}
+
+// createSession creates an upload session and returns its url.
+func createSession(t *testing.T, serverURL string) string {
+	t.Helper()
+	resp := do(t, http.MethodPost, serverURL+"/cas/uploads", "", nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var session struct {
+		ID     string `json:"id"`
+		Offset int64  `json:"offset"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&session))
+	resp.Body.Close()
+	assert.Zero(t, session.Offset)
+	assert.Equal(t, "/cas/uploads/"+session.ID, resp.Header.Get("Location"))
+	return serverURL + resp.Header.Get("Location")
+}
+
+func errorResponseCode(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var body struct {
+		Code string `json:"code"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(readBody(t, resp)), &body))
+	return body.Code
+}
+
+type failingReader struct {
+	err error
+}
+
+func (f *failingReader) Read([]byte) (int, error) {
+	return 0, f.err
+}
+
+// countingReader counts the bytes read into n.
+type countingReader struct {
+	r   io.Reader
+	mux *sync.Mutex
+	n   *int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.mux.Lock()
+	*c.n += n
+	c.mux.Unlock()
+	return n, err
+}
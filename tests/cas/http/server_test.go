@@ -0,0 +1,324 @@
+package http_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/cas/dir"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerPut(t *testing.T) {
+	testCases := map[string]struct {
+		sri         string
+		body        string
+		maxBlobSize int64
+		wantStatus  int
+	}{
+		"valid": {
+			sri:        testdata.SRI(t, "foo"),
+			body:       "foo",
+			wantStatus: http.StatusOK,
+		},
+		"hash mismatch": {
+			sri:        testdata.SRI(t, "foo"),
+			body:       "bar",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		"within size limit": {
+			sri:         testdata.SRI(t, "foo"),
+			body:        "foo",
+			maxBlobSize: 3,
+			wantStatus:  http.StatusOK,
+		},
+		"too large": {
+			sri:         testdata.SRI(t, "foobar"),
+			body:        "foobar",
+			maxBlobSize: 3,
+			wantStatus:  http.StatusRequestEntityTooLarge,
+		},
+		"invalid path": {
+			sri:        "sha256-foo",
+			body:       "foo",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			backend := newMapCAS()
+			handler := cashttp.NewHandlerWithOptions(backend, cashttp.HandlerOptions{MaxBlobSize: tc.maxBlobSize})
+
+			req := httptest.NewRequest(http.MethodPut, blobPath(t, tc.sri), strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(tc.wantStatus, rec.Code)
+
+			_, err := backend.Open(tc.sri)
+			if tc.wantStatus == http.StatusOK {
+				assert.NoError(err)
+			} else {
+				assert.ErrorIs(err, fs.ErrNotExist)
+			}
+		})
+	}
+}
+
+func TestHandlerPutContentLengthMismatch(t *testing.T) {
+	assert := assert.New(t)
+	backend := newMapCAS()
+	handler := cashttp.NewHandler(backend)
+
+	integrity := testdata.SRI(t, "foo")
+	req := httptest.NewRequest(http.MethodPut, blobPath(t, integrity), strings.NewReader("foo"))
+	req.ContentLength = 4
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	_, err := backend.Open(integrity)
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestHandlerHead(t *testing.T) {
+	assert := assert.New(t)
+	backend := newMapCAS()
+	handler := cashttp.NewHandler(backend)
+	integrity := testdata.SRI(t, "foo")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, blobPath(t, integrity), nil))
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	assert.NoError(backend.Write(integrity, strings.NewReader("foo")))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, blobPath(t, integrity), nil))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("3", rec.Header().Get("Content-Length"))
+}
+
+func TestHandlerVerifyReads(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend := newMapCAS()
+	valid, corrupted := testdata.SRI(t, "foo"), testdata.SRI(t, "bar")
+	require.NoError(backend.Write(valid, strings.NewReader("foo")))
+	require.NoError(backend.Write(corrupted, strings.NewReader("baz")))
+	server := httptest.NewServer(cashttp.NewHandlerWithOptions(backend, cashttp.HandlerOptions{VerifyReads: true}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + blobPath(t, valid))
+	require.NoError(err)
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("foo", string(got))
+
+	resp, err = http.Get(server.URL + blobPath(t, corrupted))
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Error(err)
+}
+
+func TestHandlerGetRange(t *testing.T) {
+	payload := "0123456789"
+	integrity := testdata.SRI(t, payload)
+	etag := `"` + integrity + `"`
+
+	testCases := map[string]struct {
+		rangeHeader   string
+		ifRangeHeader string
+		wantStatus    int
+		wantBody      string
+	}{
+		"full": {
+			wantStatus: http.StatusOK,
+			wantBody:   payload,
+		},
+		"prefix": {
+			rangeHeader: "bytes=0-3",
+			wantStatus:  http.StatusPartialContent,
+			wantBody:    "0123",
+		},
+		"open ended": {
+			rangeHeader: "bytes=7-",
+			wantStatus:  http.StatusPartialContent,
+			wantBody:    "789",
+		},
+		"suffix": {
+			rangeHeader: "bytes=-2",
+			wantStatus:  http.StatusPartialContent,
+			wantBody:    "89",
+		},
+		"not satisfiable": {
+			rangeHeader: "bytes=20-",
+			wantStatus:  http.StatusRequestedRangeNotSatisfiable,
+		},
+		"if-range matches": {
+			rangeHeader:   "bytes=2-4",
+			ifRangeHeader: etag,
+			wantStatus:    http.StatusPartialContent,
+			wantBody:      "234",
+		},
+		"if-range does not match": {
+			rangeHeader:   "bytes=2-4",
+			ifRangeHeader: `"other"`,
+			wantStatus:    http.StatusOK,
+			wantBody:      payload,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			backend, err := dir.New(t.TempDir())
+			require.NoError(err)
+			require.NoError(backend.Write(integrity, strings.NewReader(payload)))
+			handler := cashttp.NewHandler(backend)
+
+			req := httptest.NewRequest(http.MethodGet, blobPath(t, integrity), nil)
+			if tc.rangeHeader != "" {
+				req.Header.Set("Range", tc.rangeHeader)
+			}
+			if tc.ifRangeHeader != "" {
+				req.Header.Set("If-Range", tc.ifRangeHeader)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(tc.wantStatus, rec.Code)
+			assert.Equal(etag, rec.Header().Get("ETag"))
+			if tc.wantBody != "" {
+				assert.Equal(tc.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandlerListPagination(t *testing.T) {
+	testCases := map[string]struct {
+		deleteCursor bool
+	}{
+		"unmodified": {},
+		"cursor deleted between pages": {
+			deleteCursor: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			backend, err := dir.New(t.TempDir())
+			require.NoError(err)
+			want := map[string]struct{}{}
+			for _, payload := range []string{"a", "b", "c", "d", "e"} {
+				require.NoError(backend.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+				want[testdata.SRI(t, payload)] = struct{}{}
+			}
+			handler := cashttp.NewHandler(backend)
+
+			var listed []string
+			pageToken := ""
+			pages := 0
+			for {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cas/?page_size=2&page_token="+url.QueryEscape(pageToken), nil))
+				require.Equal(http.StatusOK, rec.Code)
+				var page struct {
+					Blobs []struct {
+						SRI string `json:"sri"`
+					} `json:"blobs"`
+					NextPageToken string `json:"next_page_token"`
+				}
+				require.NoError(json.NewDecoder(rec.Body).Decode(&page))
+				assert.LessOrEqual(len(page.Blobs), 2)
+				for _, blob := range page.Blobs {
+					listed = append(listed, blob.SRI)
+				}
+				pages++
+				if page.NextPageToken == "" {
+					break
+				}
+				pageToken = page.NextPageToken
+				if tc.deleteCursor && pages == 1 {
+					// e.g. a concurrent garbage collection
+					require.NoError(backend.Delete(pageToken))
+					delete(want, pageToken)
+					listed = listed[:len(listed)-1]
+				}
+			}
+			assert.Equal(3, pages)
+			var wantListed []string
+			for sri := range want {
+				wantListed = append(wantListed, sri)
+			}
+			assert.ElementsMatch(wantListed, listed)
+		})
+	}
+}
+
+func TestHandlerListUnsupported(t *testing.T) {
+	rec := httptest.NewRecorder()
+	cashttp.NewHandler(newMapCAS()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cas/", nil))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+}
+
+// mapCAS is a CAS that trusts its callers and does not verify blobs.
+// It only commits a blob if reading it succeeded.
+type mapCAS struct {
+	mux   sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMapCAS() *mapCAS {
+	return &mapCAS{blobs: make(map[string][]byte)}
+}
+
+func (m *mapCAS) Open(sri string) (io.ReadCloser, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	blob, ok := m.blobs[sri]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(blob)), nil
+}
+
+func (m *mapCAS) Write(sri string, r io.Reader) error {
+	blob, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.blobs[sri] = blob
+	return nil
+}
+
+// blobPath returns the cas/http path of the sri.
+// Invalid SRIs result in an invalid path.
+func blobPath(t *testing.T, sriString string) string {
+	t.Helper()
+	integrity, err := sri.FromString(sriString)
+	if err != nil {
+		return "/cas/sha256/invalid"
+	}
+	return "/cas/" + string(integrity.Algorithm) + "/" + integrity.Hex()
+}
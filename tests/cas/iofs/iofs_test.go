@@ -0,0 +1,152 @@
+package iofs_test
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/cas/iofs"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayouts(t *testing.T) {
+	integrity := mustIntegrity(t, "hello")
+	hexHash := integrity.Hex()
+
+	testCases := map[string]struct {
+		layout iofs.Layout
+		want   string
+	}{
+		"sharded hex":     {layout: iofs.ShardedHex, want: "sha256/" + hexHash[:2] + "/" + hexHash[2:]},
+		"flat base64url":  {layout: iofs.FlatBase64URL, want: "sha256-LPJNul-wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ"},
+		"oci blob layout": {layout: iofs.OCI, want: "blobs/sha256/" + hexHash},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			assert.Equal(tc.want, tc.layout(integrity))
+			assert.True(fs.ValidPath(tc.want))
+
+			cas := iofs.New(fstest.MapFS{
+				tc.want: &fstest.MapFile{Data: []byte("hello")},
+			}, iofs.Options{Layout: tc.layout, Verify: true})
+			body, err := cas.Open(integrity.String())
+			require.NoError(err)
+			got, err := io.ReadAll(body)
+			require.NoError(err)
+			require.NoError(body.Close())
+			assert.Equal("hello", string(got))
+
+			size, err := cas.Stat(integrity.String())
+			require.NoError(err)
+			assert.Equal(int64(5), size)
+
+			body, err = cas.OpenRange(integrity.String(), 1, 3)
+			require.NoError(err)
+			got, err = io.ReadAll(body)
+			require.NoError(err)
+			require.NoError(body.Close())
+			assert.Equal("ell", string(got))
+		})
+	}
+}
+
+func TestNotExist(t *testing.T) {
+	integrity := mustIntegrity(t, "hello")
+	cas := iofs.New(fstest.MapFS{
+		// a directory where the blob is expected
+		iofs.ShardedHex(integrity) + "/file": &fstest.MapFile{Data: []byte("hello")},
+	}, iofs.Options{})
+
+	for _, sriString := range []string{integrity.String(), mustIntegrity(t, "missing").String()} {
+		_, err := cas.Open(sriString)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = cas.Stat(sriString)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = cas.OpenRange(sriString, 0, -1)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	integrity := mustIntegrity(t, "hello")
+	fsys := fstest.MapFS{
+		iofs.ShardedHex(integrity): &fstest.MapFile{Data: []byte("jello")},
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		body, err := iofs.New(fsys, iofs.Options{Verify: true}).Open(integrity.String())
+		require.NoError(t, err)
+		defer body.Close()
+		_, err = io.ReadAll(body)
+		assert.ErrorIs(t, err, sri.ErrHashMismatch)
+	})
+	t.Run("no verify", func(t *testing.T) {
+		body, err := iofs.New(fsys, iofs.Options{}).Open(integrity.String())
+		require.NoError(t, err)
+		defer body.Close()
+		got, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, "jello", string(got))
+	})
+}
+
+func TestDirFS(t *testing.T) {
+	require := require.New(t)
+	root := t.TempDir()
+	dirCAS, err := dir.New(root)
+	require.NoError(err)
+	sriString := mustIntegrity(t, "persisted").String()
+	require.NoError(dirCAS.Write(sriString, strings.NewReader("persisted")))
+
+	cas := iofs.New(os.DirFS(root), iofs.Options{Verify: true})
+	body, err := cas.Open(sriString)
+	require.NoError(err)
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	assert.Equal(t, "persisted", string(got))
+}
+
+func TestTreeFS(t *testing.T) {
+	require := require.New(t)
+	integrity := mustIntegrity(t, "nested")
+	source := memory.New(0)
+	require.NoError(source.Write(integrity.String(), strings.NewReader("nested")))
+	// a tree that contains a file at the position of the blob in the flat layout
+	treeFS := &tree.TreeFS{
+		Tree: api.Tree{Root: &api.Node{
+			Stat: api.Stat{Kind: api.KindDirectory},
+			Children: []*api.Node{
+				{Stat: api.Stat{Name: iofs.FlatBase64URL(integrity), Kind: api.KindRegular, Payload: integrity.String(), Size: 6}},
+			},
+		}},
+		CASReader: source,
+	}
+
+	cas := iofs.New(treeFS, iofs.Options{Layout: iofs.FlatBase64URL, Verify: true})
+	body, err := cas.Open(integrity.String())
+	require.NoError(err)
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	assert.Equal(t, "nested", string(got))
+}
+
+func mustIntegrity(t *testing.T, payload string) sri.Integrity {
+	t.Helper()
+	integrity, err := sri.FromReader(sri.SHA256, strings.NewReader(payload))
+	require.NoError(t, err)
+	return integrity
+}
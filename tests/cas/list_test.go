@@ -0,0 +1,81 @@
+package cas_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListAfter(t *testing.T) {
+	dirCAS, err := dir.New(t.TempDir())
+	require.NoError(t, err)
+	memoryCAS := memory.New(0)
+	fallbackBackend := memory.New(0)
+	backends := map[string]api.CASLister{
+		"dir":      dirCAS,
+		"memory":   memoryCAS,
+		"fallback": listOnly{fallbackBackend},
+	}
+	for _, payload := range []string{"a", "b", "c", "d", "e"} {
+		for _, backend := range []api.CAS{dirCAS, memoryCAS, fallbackBackend} {
+			require.NoError(t, backend.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+		}
+		sha512, err := sri.FromReader(sri.SHA512, strings.NewReader(payload))
+		require.NoError(t, err)
+		require.NoError(t, dirCAS.Write(sha512.String(), strings.NewReader(payload)))
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			all := listAfter(t, backend, "")
+			require.Len(all, 5+map[string]int{"dir": 5}[name])
+			for i, cursor := range all {
+				assert.Equal(all[i+1:], listAfter(t, backend, cursor), "after %s", cursor)
+			}
+		})
+	}
+}
+
+func TestListAfterDeletedCursor(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend := memory.New(0)
+	for _, payload := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(backend.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	}
+	all := listAfter(t, backend, "")
+	require.NoError(backend.Delete(all[2]))
+	assert.Equal(all[3:], listAfter(t, backend, all[2]))
+
+	err := cas.ListAfter(listOnly{backend}, "", all[2], func(api.BlobInfo) error { return nil })
+	assert.ErrorIs(err, cas.ErrCursorNotFound)
+}
+
+func listAfter(t *testing.T, lister api.CASLister, after string) []string {
+	t.Helper()
+	listed := []string{}
+	require.NoError(t, cas.ListAfter(lister, "", after, func(blob api.BlobInfo) error {
+		listed = append(listed, blob.SRI)
+		return nil
+	}))
+	return listed
+}
+
+// listOnly hides all optional interfaces except api.CASLister.
+type listOnly struct {
+	backend *memory.CAS
+}
+
+func (l listOnly) List(algorithm string, fn func(api.BlobInfo) error) error {
+	return l.backend.List(algorithm, fn)
+}
@@ -0,0 +1,178 @@
+package memory_test
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteOpen(t *testing.T) {
+	testCases := map[string]struct {
+		payload  string
+		writeSRI string
+		capacity int64
+		wantErr  bool
+	}{
+		"valid blob": {
+			payload:  "foo",
+			writeSRI: testdata.SRI(t, "foo"),
+		},
+		"hash mismatch": {
+			payload:  "bar",
+			writeSRI: testdata.SRI(t, "foo"),
+			wantErr:  true,
+		},
+		"larger than capacity": {
+			payload:  "foo",
+			writeSRI: testdata.SRI(t, "foo"),
+			capacity: 2,
+			wantErr:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			cas := memory.New(tc.capacity)
+			err := cas.Write(tc.writeSRI, strings.NewReader(tc.payload))
+			if tc.wantErr {
+				assert.Error(err)
+				_, err := cas.Open(tc.writeSRI)
+				assert.ErrorIs(err, fs.ErrNotExist)
+				return
+			}
+			require.NoError(err)
+			body, err := cas.Open(tc.writeSRI)
+			require.NoError(err)
+			got, err := io.ReadAll(body)
+			require.NoError(err)
+			assert.Equal(tc.payload, string(got))
+		})
+	}
+}
+
+func TestWriteLargerThanCapacity(t *testing.T) {
+	assert := assert.New(t)
+	cas := memory.New(1024)
+	// an endless stream must be rejected as soon as it exceeds the capacity
+	endless := &countingReader{}
+	err := cas.Write(testdata.SRI(t, "foo"), endless)
+	assert.ErrorIs(err, api.ErrTooLarge)
+	assert.LessOrEqual(endless.n, int64(1024+1))
+	assert.Equal(0, cas.Stats().Blobs)
+}
+
+// countingReader is an endless stream of zeros that counts the bytes read.
+type countingReader struct {
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestEviction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	cas := memory.New(9)
+	for _, payload := range []string{"aaa", "bbb", "ccc"} {
+		require.NoError(cas.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	}
+	// use "aaa" so that "bbb" becomes the least recently used blob
+	body, err := cas.Open(testdata.SRI(t, "aaa"))
+	require.NoError(err)
+	body.Close()
+
+	require.NoError(cas.Write(testdata.SRI(t, "ddd"), strings.NewReader("ddd")))
+	assert.True(cas.Has(testdata.SRI(t, "aaa")))
+	assert.False(cas.Has(testdata.SRI(t, "bbb")))
+	assert.True(cas.Has(testdata.SRI(t, "ccc")))
+	assert.True(cas.Has(testdata.SRI(t, "ddd")))
+
+	_, err = cas.Open(testdata.SRI(t, "bbb"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	assert.Equal(memory.Stats{
+		Hits:      1,
+		Misses:    1,
+		Evictions: 1,
+		Blobs:     3,
+		Size:      9,
+	}, cas.Stats())
+}
+
+func TestListDelete(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	cas := memory.New(0)
+	for _, payload := range []string{"foo", "bar"} {
+		require.NoError(cas.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	}
+	var listed []string
+	require.NoError(cas.List("sha256", func(blob api.BlobInfo) error {
+		listed = append(listed, blob.SRI)
+		return nil
+	}))
+	assert.ElementsMatch([]string{testdata.SRI(t, "foo"), testdata.SRI(t, "bar")}, listed)
+
+	require.NoError(cas.Delete(testdata.SRI(t, "foo")))
+	assert.ErrorIs(cas.Delete(testdata.SRI(t, "foo")), fs.ErrNotExist)
+	assert.Equal(int64(3), cas.Stats().Size)
+}
+
+func TestRewriteRefreshesModTime(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	cas := memory.New(0)
+	require.NoError(cas.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+	first := modTime(t, cas, testdata.SRI(t, "foo"))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(cas.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+	assert.True(modTime(t, cas, testdata.SRI(t, "foo")).After(first))
+}
+
+func modTime(t *testing.T, cas *memory.CAS, sriString string) time.Time {
+	t.Helper()
+	var modTime time.Time
+	require.NoError(t, cas.List("", func(blob api.BlobInfo) error {
+		if blob.SRI == sriString {
+			modTime = blob.ModTime
+		}
+		return nil
+	}))
+	require.False(t, modTime.IsZero())
+	return modTime
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	cas := memory.New(64)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := strings.Repeat(string(rune('a'+i%8)), 16)
+			assert.NoError(t, cas.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+			if body, err := cas.Open(testdata.SRI(t, payload)); err == nil {
+				io.Copy(io.Discard, body)
+				body.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, cas.Stats().Size, int64(64))
+}
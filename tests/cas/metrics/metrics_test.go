@@ -0,0 +1,293 @@
+package metrics_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/cas/gc"
+	cashttp "github.com/malt3/abstractfs-core/cas/http"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/cas/metrics"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryTextFormat(t *testing.T) {
+	registry := metrics.NewRegistry()
+	requests := registry.Counter("requests_total", "Number of requests.", "method", "code")
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(0.5, "PUT", "500")
+	latency := registry.Histogram("latency_seconds", "Request latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(2)
+	registry.Counter("escaped_total", "Help with \\ and\nnewline.", "path").Inc("a\"b\\c\nd")
+
+	var out strings.Builder
+	n, err := registry.WriteTo(&out)
+	require.NoError(t, err)
+	assert.Equal(t, int64(out.Len()), n)
+	assert.Equal(t, `# HELP escaped_total Help with \\ and\nnewline.
+# TYPE escaped_total counter
+escaped_total{path="a\"b\\c\nd"} 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.15
+latency_seconds_count 3
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 2
+requests_total{method="PUT",code="500"} 0.5
+`, out.String())
+}
+
+func TestRegistryShared(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Counter("shared_total", "", "label").Inc("a")
+	registry.Counter("shared_total", "", "label").Inc("a")
+	assert.Equal(t, 2.0, registry.Counter("shared_total", "", "label").Value("a"))
+
+	assert.Panics(t, func() { registry.Histogram("shared_total", "", nil, "label") })
+	assert.Panics(t, func() { registry.Counter("shared_total", "", "other") })
+	assert.Panics(t, func() { registry.Counter("shared_total", "", "label").Inc("a", "b") })
+	assert.Panics(t, func() { registry.Counter("shared_total", "", "label").Add(-1, "a") })
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Counter("up", "Whether the server is up.").Inc()
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, rec.Body.String(), "\nup 1\n")
+
+	rec = httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestCAS(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	var mux sync.Mutex
+	var events []metrics.Event
+	c := metrics.NewCAS(memory.New(0), metrics.Options{
+		Registry: registry,
+		Name:     "memory",
+		Hook: metrics.HookFunc(func(event metrics.Event) {
+			mux.Lock()
+			defer mux.Unlock()
+			events = append(events, event)
+		}),
+	})
+	blob := testdata.SRI(t, "hello world")
+
+	require.NoError(t, c.Write(blob, strings.NewReader("hello world")))
+	assert.Error(c.Write(testdata.SRI(t, "other"), strings.NewReader("tampered")))
+	body, err := c.Open(blob)
+	require.NoError(t, err)
+	data, err := io.ReadAll(body)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	// closing again is not recorded again
+	require.NoError(t, body.Close())
+	assert.Equal("hello world", string(data))
+	rangeBody, err := c.(api.CASRangeReader).OpenRange(blob, 6, 5)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rangeBody)
+	require.NoError(t, err)
+	require.NoError(t, rangeBody.Close())
+	_, err = c.Open(testdata.SRI(t, "missing"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+	size, err := c.(api.CASStater).Stat(blob)
+	require.NoError(t, err)
+	assert.Equal(int64(11), size)
+
+	operations := registry.Counter("abstractfs_cas_operations_total", "", "cas", "op", "result")
+	assert.Equal(1.0, operations.Value("memory", "write", "ok"))
+	assert.Equal(1.0, operations.Value("memory", "write", "error"))
+	assert.Equal(1.0, operations.Value("memory", "open", "ok"))
+	assert.Equal(1.0, operations.Value("memory", "open", "not_found"))
+	assert.Equal(1.0, operations.Value("memory", "open_range", "ok"))
+	assert.Equal(1.0, operations.Value("memory", "stat", "ok"))
+	assert.Equal(16.0, registry.Counter("abstractfs_cas_read_bytes_total", "", "cas").Value("memory"))
+	assert.Equal(19.0, registry.Counter("abstractfs_cas_written_bytes_total", "", "cas").Value("memory"))
+	sizes := registry.Histogram("abstractfs_cas_blob_size_bytes", "", metrics.SizeBuckets, "cas", "op")
+	assert.Equal(uint64(1), sizes.Count("memory", "write"))
+	assert.Equal(11.0, sizes.Sum("memory", "open"))
+	latency := registry.Histogram("abstractfs_cas_operation_duration_seconds", "", metrics.DurationBuckets, "cas", "op")
+	assert.Equal(uint64(2), latency.Count("memory", "open"))
+
+	require.Len(t, events, 6)
+	assert.Equal(metrics.Event{Op: "write", SRI: blob, Size: 11, Duration: events[0].Duration}, events[0])
+	assert.Equal("open", events[2].Op)
+	assert.Equal(int64(11), events[2].Size)
+	assert.True(errors.Is(events[4].Err, fs.ErrNotExist))
+}
+
+func TestCASWithoutRegistry(t *testing.T) {
+	var count int
+	c := metrics.NewCAS(memory.New(0), metrics.Options{
+		Hook: metrics.HookFunc(func(metrics.Event) { count++ }),
+	})
+	blob := testdata.SRI(t, "blob")
+	require.NoError(t, c.Write(blob, strings.NewReader("blob")))
+	_, err := c.(api.CASStater).Stat(blob)
+	require.NoError(t, err)
+	require.NoError(t, c.(api.CASDeleter).Delete(blob))
+	assert.Equal(t, 3, count)
+}
+
+func TestCASOptionalInterfaces(t *testing.T) {
+	server := httptest.NewServer(cashttp.NewHandler(memory.New(0)))
+	defer server.Close()
+	client, err := cashttp.NewClient(server.URL)
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		backend       api.CAS
+		want          capabilities
+		wantDeleteRes int
+	}{
+		"memory": {
+			backend: memory.New(0),
+			want: capabilities{
+				stater: true, rangeReader: true, lister: true, cursorLister: true,
+				deleter: true, conditionalDeleter: true,
+			},
+			wantDeleteRes: http.StatusOK,
+		},
+		"http client": {
+			backend: client,
+			want: capabilities{
+				stater: true, rangeReader: true, lister: true, cursorLister: true,
+				missingFinder: true, deleter: true,
+			},
+			wantDeleteRes: http.StatusOK,
+		},
+		"none": {
+			backend:       plainCAS{memory.New(0)},
+			wantDeleteRes: http.StatusNotImplemented,
+		},
+		"stat only": {
+			backend:       statCAS{plainCAS{memory.New(0)}},
+			want:          capabilities{stater: true},
+			wantDeleteRes: http.StatusNotImplemented,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			c := metrics.NewCAS(tc.backend, metrics.Options{Registry: metrics.NewRegistry()})
+			assert.Equal(tc.want, capabilitiesOf(tc.backend))
+			assert.Equal(tc.want, capabilitiesOf(c))
+
+			blob := testdata.SRI(t, "blob")
+			require.NoError(t, c.Write(blob, strings.NewReader("blob")))
+			server := httptest.NewServer(cashttp.NewHandler(c))
+			defer server.Close()
+			integrity, err := sri.FromString(blob)
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodDelete, server.URL+"/cas/sha256/"+integrity.Hex(), nil)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(tc.wantDeleteRes, resp.StatusCode)
+		})
+	}
+}
+
+func TestCASCollect(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	registry := metrics.NewRegistry()
+	backend, err := dir.New(t.TempDir())
+	require.NoError(err)
+	c := metrics.NewCAS(backend, metrics.Options{Registry: registry, Name: "dir"})
+	live, dead := testdata.SRI(t, "live"), testdata.SRI(t, "dead")
+	require.NoError(c.Write(live, strings.NewReader("live")))
+	require.NoError(c.Write(dead, strings.NewReader("dead")))
+
+	lister, ok := c.(api.CASLister)
+	require.True(ok)
+	var listed []string
+	require.NoError(cas.ListAfter(lister, "", "", func(blob api.BlobInfo) error {
+		listed = append(listed, blob.SRI)
+		return nil
+	}))
+	assert.ElementsMatch([]string{live, dead}, listed)
+
+	collectable, ok := c.(gc.CAS)
+	require.True(ok)
+	collector := gc.New(collectable)
+	collector.Mark(live)
+	report, err := collector.Sweep()
+	require.NoError(err)
+	require.Len(report.Deleted, 1)
+	assert.Equal(dead, report.Deleted[0].SRI)
+	_, err = backend.Stat(live)
+	assert.NoError(err)
+
+	operations := registry.Counter("abstractfs_cas_operations_total", "", "cas", "op", "result")
+	assert.Equal(1.0, operations.Value("dir", "list_after", "ok"))
+	assert.Equal(1.0, operations.Value("dir", "list", "ok"))
+	assert.Equal(1.0, operations.Value("dir", "delete", "ok"))
+}
+
+// capabilities are the optional interfaces implemented by a CAS.
+type capabilities struct {
+	stater, rangeReader, lister, cursorLister, missingFinder, deleter, conditionalDeleter bool
+}
+
+func capabilitiesOf(c api.CAS) capabilities {
+	var caps capabilities
+	_, caps.stater = c.(api.CASStater)
+	_, caps.rangeReader = c.(api.CASRangeReader)
+	_, caps.lister = c.(api.CASLister)
+	_, caps.cursorLister = c.(api.CASCursorLister)
+	_, caps.missingFinder = c.(api.CASMissingFinder)
+	_, caps.deleter = c.(api.CASDeleter)
+	_, caps.conditionalDeleter = c.(api.CASConditionalDeleter)
+	return caps
+}
+
+// plainCAS hides the optional interfaces of a CAS.
+type plainCAS struct {
+	cas api.CAS
+}
+
+func (p plainCAS) Open(sri string) (io.ReadCloser, error) {
+	return p.cas.Open(sri)
+}
+
+func (p plainCAS) Write(sri string, r io.Reader) error {
+	return p.cas.Write(sri, r)
+}
+
+// statCAS is a plainCAS that can stat blobs.
+type statCAS struct {
+	plainCAS
+}
+
+func (s statCAS) Stat(sri string) (int64, error) {
+	return s.cas.(api.CASStater).Stat(sri)
+}
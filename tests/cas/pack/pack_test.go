@@ -0,0 +1,188 @@
+package pack_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/cas/pack"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/malt3/abstractfs-core/tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	source := memory.New(0)
+	files := map[string]string{
+		"a":         "hello",
+		"dir/b":     "world",
+		"dir/copy":  "hello",
+		"dir/empty": "",
+	}
+	root := &api.Node{Stat: api.Stat{Kind: api.KindDirectory}}
+	dir := &api.Node{Stat: api.Stat{Name: "dir", Kind: api.KindDirectory}}
+	root.Children = []*api.Node{dir}
+	for name, content := range files {
+		require.NoError(source.Write(testdata.SRI(t, content), strings.NewReader(content)))
+		node := &api.Node{Stat: api.Stat{Name: filepath.Base(name), Kind: api.KindRegular, Payload: testdata.SRI(t, content), Size: int64(len(content))}}
+		if strings.HasPrefix(name, "dir/") {
+			dir.Children = append(dir.Children, node)
+		} else {
+			root.Children = append(root.Children, node)
+		}
+	}
+	tr := api.Tree{Root: root}
+
+	name := filepath.Join(t.TempDir(), "tree.pack")
+	out, err := os.Create(name)
+	require.NoError(err)
+	writer, err := pack.NewWriter(out)
+	require.NoError(err)
+	require.NoError(writer.AddTree(&tree.TreeFS{Tree: tr, CASReader: source}))
+	require.NoError(writer.Close())
+	require.NoError(out.Close())
+
+	reader, err := pack.OpenFile(name)
+	require.NoError(err)
+	defer reader.Close()
+	require.NoError(reader.Verify())
+	assert.Equal(3, reader.Len())
+
+	packFS := &tree.TreeFS{Tree: tr, CASReader: reader}
+	for name, content := range files {
+		got, err := fs.ReadFile(packFS, name)
+		require.NoError(err, name)
+		assert.Equal(content, string(got), name)
+	}
+
+	var listed []string
+	require.NoError(reader.List("", func(blob api.BlobInfo) error {
+		listed = append(listed, blob.SRI)
+		return nil
+	}))
+	assert.IsIncreasing(listed)
+	assert.Len(listed, 3)
+}
+
+func TestOpenRange(t *testing.T) {
+	payload := "0123456789"
+	reader := newPack(t, payload, "other")
+
+	testCases := map[string]struct {
+		offset, length int64
+		want           string
+	}{
+		"whole":         {offset: 0, length: -1, want: payload},
+		"middle":        {offset: 2, length: 3, want: "234"},
+		"suffix":        {offset: 7, length: -1, want: "789"},
+		"beyond end":    {offset: 8, length: 10, want: "89"},
+		"offset at end": {offset: 10, length: 5, want: ""},
+		"past end":      {offset: 20, length: 5, want: ""},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			body, err := reader.OpenRange(testdata.SRI(t, payload), tc.offset, tc.length)
+			require.NoError(t, err)
+			defer body.Close()
+			got, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, string(got))
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	reader := newPack(t, "foo", "bar")
+
+	body, err := reader.Open(testdata.SRI(t, "bar"))
+	require.NoError(err)
+	_, ok := body.(io.Seeker)
+	assert.True(ok)
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	assert.Equal("bar", string(got))
+
+	size, err := reader.Stat(testdata.SRI(t, "foo"))
+	require.NoError(err)
+	assert.Equal(int64(3), size)
+
+	_, err = reader.Open(testdata.SRI(t, "baz"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+	_, err = reader.Stat(testdata.SRI(t, "baz"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestWriteMismatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	var buf bytes.Buffer
+	writer, err := pack.NewWriter(&buf)
+	require.NoError(err)
+	require.NoError(writer.Write(testdata.SRI(t, "good"), strings.NewReader("good")))
+	err = writer.Write(testdata.SRI(t, "bad"), strings.NewReader("evil"))
+	assert.ErrorIs(err, sri.ErrHashMismatch)
+	require.NoError(writer.Close())
+	assert.Error(writer.Write(testdata.SRI(t, "late"), strings.NewReader("late")))
+
+	reader, err := pack.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(err)
+	require.NoError(reader.Verify())
+	assert.Equal(1, reader.Len())
+	_, err = reader.Open(testdata.SRI(t, "bad"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+}
+
+func TestCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := pack.NewWriter(&buf)
+	require.NoError(t, err)
+	require.NoError(t, writer.Write(testdata.SRI(t, "content"), strings.NewReader("content")))
+	require.NoError(t, writer.Close())
+	valid := buf.Bytes()
+
+	t.Run("truncated", func(t *testing.T) {
+		truncated := valid[:len(valid)-10]
+		_, err := pack.NewReader(bytes.NewReader(truncated), int64(len(truncated)))
+		assert.Error(t, err)
+	})
+	t.Run("bad magic", func(t *testing.T) {
+		corrupted := bytes.Clone(valid)
+		corrupted[0] = 'X'
+		_, err := pack.NewReader(bytes.NewReader(corrupted), int64(len(corrupted)))
+		assert.ErrorIs(t, err, pack.ErrInvalidPack)
+	})
+	t.Run("modified blob", func(t *testing.T) {
+		corrupted := bytes.Clone(valid)
+		corrupted[6] ^= 0xff
+		reader, err := pack.NewReader(bytes.NewReader(corrupted), int64(len(corrupted)))
+		require.NoError(t, err)
+		assert.ErrorIs(t, reader.Verify(), pack.ErrInvalidPack)
+	})
+}
+
+func newPack(t *testing.T, payloads ...string) *pack.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, err := pack.NewWriter(&buf)
+	require.NoError(t, err)
+	for _, payload := range payloads {
+		require.NoError(t, writer.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	}
+	require.NoError(t, writer.Close())
+	reader, err := pack.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	return reader
+}
@@ -0,0 +1,76 @@
+package cas_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenRange(t *testing.T) {
+	payload := "0123456789"
+	dirCAS, err := dir.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, dirCAS.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+
+	testCases := map[string]struct {
+		offset, length int64
+		want           string
+	}{
+		"whole blob":      {offset: 0, length: -1, want: payload},
+		"middle":          {offset: 3, length: 4, want: "3456"},
+		"tail":            {offset: 8, length: -1, want: "89"},
+		"empty":           {offset: 3, length: 0, want: ""},
+		"beyond the end":  {offset: 20, length: -1, want: ""},
+		"length too long": {offset: 8, length: 10, want: "89"},
+	}
+
+	for name, tc := range testCases {
+		for backendName, backend := range map[string]api.CASReader{"range reader": dirCAS, "fallback": openOnly{payload}} {
+			t.Run(backendName+"/"+name, func(t *testing.T) {
+				require := require.New(t)
+				body, err := cas.OpenRange(backend, testdata.SRI(t, payload), tc.offset, tc.length)
+				require.NoError(err)
+				defer body.Close()
+				got, err := io.ReadAll(body)
+				require.NoError(err)
+				assert.Equal(t, tc.want, string(got))
+			})
+		}
+	}
+}
+
+func TestReadSeeker(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	payload := "0123456789"
+	dirCAS, err := dir.New(t.TempDir())
+	require.NoError(err)
+	require.NoError(dirCAS.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+
+	seeker := cas.NewReadSeeker(dirCAS, testdata.SRI(t, payload), int64(len(payload)))
+	defer seeker.Close()
+
+	size, err := seeker.Seek(0, io.SeekEnd)
+	require.NoError(err)
+	assert.Equal(int64(10), size)
+
+	_, err = seeker.Seek(4, io.SeekStart)
+	require.NoError(err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(seeker, buf)
+	require.NoError(err)
+	assert.Equal("45", string(buf))
+
+	_, err = seeker.Seek(-3, io.SeekCurrent)
+	require.NoError(err)
+	rest, err := io.ReadAll(seeker)
+	require.NoError(err)
+	assert.Equal("3456789", string(rest))
+}
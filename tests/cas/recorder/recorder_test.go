@@ -0,0 +1,252 @@
+package recorder_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/cas/recorder"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var payloads = []string{"hello", "", "world of blobs"}
+
+func TestRoundTrip(t *testing.T) {
+	testCases := map[string]struct {
+		checksum bool
+	}{
+		"without checksum": {},
+		"with checksum":    {checksum: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			stream := encode(t, recorder.EncoderOptions{Checksum: tc.checksum}, payloads...)
+			backend := memory.New(0)
+			require.NoError(t, recorder.New(backend, bytes.NewReader(stream)).Consume())
+			for _, payload := range payloads {
+				assert.True(backend.Has(testdata.Integrity(t, payload).String()))
+			}
+
+			decoder := recorder.NewDecoder(bytes.NewReader(stream))
+			for i, payload := range payloads {
+				integrity, body, err := decoder.Decode()
+				require.NoError(t, err)
+				assert.Equal(testdata.Integrity(t, payload), integrity)
+				if i%2 == 0 {
+					// skipping a payload is allowed
+					continue
+				}
+				got, err := io.ReadAll(body)
+				require.NoError(t, err)
+				assert.Equal(payload, string(got))
+				require.NoError(t, body.Close())
+			}
+			_, _, err := decoder.Decode()
+			assert.Equal(io.EOF, err)
+			assert.False(decoder.Legacy())
+		})
+	}
+}
+
+func TestEmptyStream(t *testing.T) {
+	for name, stream := range map[string][]byte{
+		"versioned": encode(t, recorder.EncoderOptions{}),
+		"legacy":    nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := recorder.NewDecoder(bytes.NewReader(stream)).Decode()
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestLegacyStream(t *testing.T) {
+	assert := assert.New(t)
+	var stream bytes.Buffer
+	for _, payload := range payloads {
+		require.NoError(t, recorder.Encode(&stream, testdata.Integrity(t, payload), int64(len(payload)), strings.NewReader(payload)))
+	}
+
+	backend := memory.New(0)
+	require.NoError(t, recorder.New(backend, bytes.NewReader(stream.Bytes())).Consume())
+	for _, payload := range payloads {
+		assert.True(backend.Has(testdata.Integrity(t, payload).String()))
+	}
+
+	decoder := recorder.NewDecoder(bytes.NewReader(stream.Bytes()))
+	_, _, err := decoder.Decode()
+	require.NoError(t, err)
+	assert.True(decoder.Legacy())
+
+	// truncated payloads of legacy streams are detected as well
+	truncated := stream.Bytes()[:stream.Len()-1]
+	err = recorder.New(memory.New(0), bytes.NewReader(truncated)).Consume()
+	assert.ErrorIs(err, recorder.ErrTruncated)
+}
+
+func TestTruncatedStream(t *testing.T) {
+	for _, checksum := range []bool{false, true} {
+		stream := encode(t, recorder.EncoderOptions{Checksum: checksum}, payloads...)
+		for size := 1; size < len(stream); size++ {
+			err := recorder.New(memory.New(0), bytes.NewReader(stream[:size])).Consume()
+			require.Error(t, err, "checksum %v, size %d", checksum, size)
+			var decodeErr *recorder.DecodeError
+			require.ErrorAs(t, err, &decodeErr)
+			if size < 8 {
+				// the header is incomplete
+				assert.ErrorIs(t, err, recorder.ErrInvalidStream)
+				continue
+			}
+			assert.ErrorIs(t, err, recorder.ErrTruncated, "checksum %v, size %d", checksum, size)
+		}
+	}
+}
+
+func TestTruncatedErrorMessage(t *testing.T) {
+	stream := encode(t, recorder.EncoderOptions{}, "first", "second")
+	// header (8) + first blob: sri record (9 + 51) + payload record (9 + 5)
+	secondOffset := 8 + 9 + 51 + 9 + 5
+	decoder := recorder.NewDecoder(bytes.NewReader(stream[:secondOffset+20]))
+	_, _, err := decoder.Decode()
+	require.NoError(t, err)
+	_, _, err = decoder.Decode()
+	assert.EqualError(t, err, "truncated record 1 at offset 82")
+	assert.Equal(t, 82, secondOffset)
+	// errors are sticky
+	_, _, err = decoder.Decode()
+	assert.ErrorIs(t, err, recorder.ErrTruncated)
+
+	// a stream without trailer is truncated
+	decoder = recorder.NewDecoder(bytes.NewReader(stream[:len(stream)-9-16]))
+	for i := 0; i < 2; i++ {
+		_, _, err := decoder.Decode()
+		require.NoError(t, err)
+	}
+	_, _, err = decoder.Decode()
+	assert.EqualError(t, err, "truncated record 2 at offset 157")
+}
+
+func TestCorruptedStream(t *testing.T) {
+	stream := encode(t, recorder.EncoderOptions{Checksum: true}, "payload")
+	testCases := map[string]struct {
+		corrupt func([]byte) []byte
+		wantErr error
+	}{
+		"payload": {
+			corrupt: func(b []byte) []byte {
+				b[bytes.Index(b, []byte("payload"))] ^= 0xff
+				return b
+			},
+			wantErr: recorder.ErrChecksumMismatch,
+		},
+		"sri": {
+			corrupt: func(b []byte) []byte {
+				b[8+9+10] ^= 0x01
+				return b
+			},
+			wantErr: recorder.ErrChecksumMismatch,
+		},
+		"foreign stream": {
+			corrupt: func([]byte) []byte { return []byte("PK\x03\x04 this is a zip file") },
+			wantErr: recorder.ErrInvalidStream,
+		},
+		"unsupported version": {
+			corrupt: func(b []byte) []byte {
+				b[6] = 2
+				return b
+			},
+			wantErr: recorder.ErrInvalidStream,
+		},
+		"data after trailer": {
+			corrupt: func(b []byte) []byte { return append(b, 0x00) },
+			wantErr: recorder.ErrInvalidStream,
+		},
+		"trailer mismatch": {
+			corrupt: func(b []byte) []byte {
+				// the blob count is the first value of the trailer, followed by the total size and the checksum
+				b[len(b)-4-16+7] = 2
+				return b
+			},
+			wantErr: recorder.ErrChecksumMismatch,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			corrupted := tc.corrupt(append([]byte(nil), stream...))
+			err := recorder.New(memory.New(0), bytes.NewReader(corrupted)).Consume()
+			assert.ErrorIs(t, err, tc.wantErr)
+			var decodeErr *recorder.DecodeError
+			assert.True(t, errors.As(err, &decodeErr))
+		})
+	}
+}
+
+func TestTrailerMismatch(t *testing.T) {
+	// without checksums, a manipulated trailer is detected by comparing it with the stream
+	stream := encode(t, recorder.EncoderOptions{}, "payload")
+	stream[len(stream)-16+7] = 2
+	err := recorder.New(memory.New(0), bytes.NewReader(stream)).Consume()
+	assert.ErrorIs(t, err, recorder.ErrInvalidStream)
+	assert.ErrorContains(t, err, "trailer expects 2 blobs")
+}
+
+func TestEncoderSizeMismatch(t *testing.T) {
+	var stream bytes.Buffer
+	encoder := recorder.NewEncoder(&stream, recorder.EncoderOptions{})
+	err := encoder.Encode(testdata.Integrity(t, "payload"), 10, strings.NewReader("payload"))
+	require.Error(t, err)
+	// the stream is broken: the error sticks
+	assert.Equal(t, err, encoder.Encode(testdata.Integrity(t, "payload"), 7, strings.NewReader("payload")))
+	assert.Equal(t, err, encoder.Close())
+}
+
+func TestEncoderWriteFails(t *testing.T) {
+	writer := &failingWriter{left: 20}
+	encoder := recorder.NewEncoder(writer, recorder.EncoderOptions{})
+	err := encoder.Encode(testdata.Integrity(t, "payload"), 7, strings.NewReader("payload"))
+	require.ErrorIs(t, err, errWriteFailed)
+
+	writer.left = 1 << 20
+	assert.Equal(t, err, encoder.Encode(testdata.Integrity(t, "other"), 5, strings.NewReader("other")))
+	assert.Equal(t, err, encoder.Close())
+	assert.Equal(t, 20, writer.written)
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter fails once more than left bytes were written.
+type failingWriter struct {
+	left    int
+	written int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.left {
+		n := f.left
+		f.left = 0
+		f.written += n
+		return n, errWriteFailed
+	}
+	f.left -= len(p)
+	f.written += len(p)
+	return len(p), nil
+}
+
+func encode(t *testing.T, opts recorder.EncoderOptions, payloads ...string) []byte {
+	t.Helper()
+	var stream bytes.Buffer
+	encoder := recorder.NewEncoder(&stream, opts)
+	for _, payload := range payloads {
+		require.NoError(t, encoder.Encode(testdata.Integrity(t, payload), int64(len(payload)), strings.NewReader(payload)))
+	}
+	require.NoError(t, encoder.Close())
+	return stream.Bytes()
+}
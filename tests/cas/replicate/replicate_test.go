@@ -0,0 +1,183 @@
+package replicate_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/cas/replicate"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	src := newRawCAS()
+	for _, payload := range []string{"a", "bb", "ccc", "existing"} {
+		src.put(testdata.SRI(t, payload), payload)
+	}
+	// stored under the SRI of "corrupt", but with different content
+	src.put(testdata.SRI(t, "corrupt"), "tampered")
+	dst, err := dir.New(t.TempDir())
+	require.NoError(err)
+	require.NoError(dst.Write(testdata.SRI(t, "existing"), strings.NewReader("existing")))
+
+	sris := []string{testdata.SRI(t, "a"), testdata.SRI(t, "bb"), testdata.SRI(t, "ccc"), testdata.SRI(t, "a"), testdata.SRI(t, "existing"), testdata.SRI(t, "corrupt"), testdata.SRI(t, "missing")}
+	results := make(map[string]replicate.Result)
+	report, err := replicate.Replicate(context.Background(), src, dst, sris, replicate.Options{
+		Workers: 2,
+		Progress: func(result replicate.Result) {
+			_, duplicate := results[result.SRI]
+			assert.False(duplicate)
+			results[result.SRI] = result
+		},
+	})
+	assert.ErrorIs(err, sri.ErrHashMismatch)
+	assert.ErrorIs(err, fs.ErrNotExist)
+	assert.Equal(3, report.Copied)
+	assert.Equal(1, report.Skipped)
+	assert.Len(report.Failures, 2)
+	assert.Equal(int64(6), report.BytesCopied)
+	assert.Len(results, 6)
+	assert.Equal(replicate.Skipped, results[testdata.SRI(t, "existing")].Status)
+	assert.Equal(replicate.Failed, results[testdata.SRI(t, "corrupt")].Status)
+	assert.ErrorIs(results[testdata.SRI(t, "missing")].Err, fs.ErrNotExist)
+
+	for _, payload := range []string{"a", "bb", "ccc"} {
+		body, err := dst.Open(testdata.SRI(t, payload))
+		require.NoError(err)
+		got, err := io.ReadAll(body)
+		body.Close()
+		require.NoError(err)
+		assert.Equal(payload, string(got))
+	}
+	_, err = dst.Stat(testdata.SRI(t, "corrupt"))
+	assert.ErrorIs(err, fs.ErrNotExist)
+
+	// a second run resumes: everything that was copied is skipped
+	report, err = replicate.Replicate(context.Background(), src, dst, sris[:5], replicate.Options{})
+	require.NoError(err)
+	assert.Equal(0, report.Copied)
+	assert.Equal(4, report.Skipped)
+}
+
+func TestReplicateTrees(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	src := memory.New(0)
+	for _, payload := range []string{"one", "two"} {
+		require.NoError(src.Write(testdata.SRI(t, payload), strings.NewReader(payload)))
+	}
+	trees := []api.Tree{
+		{Root: &api.Node{
+			Stat: api.Stat{Kind: api.KindDirectory},
+			Children: []*api.Node{
+				{Stat: api.Stat{Name: "one", Kind: api.KindRegular, Payload: testdata.SRI(t, "one"), Size: 3}},
+				{Stat: api.Stat{Name: "link", Kind: api.KindSymlink, Payload: "one"}},
+			},
+		}},
+		{Root: &api.Node{
+			Stat: api.Stat{Kind: api.KindDirectory},
+			Children: []*api.Node{
+				{Stat: api.Stat{Name: "one", Kind: api.KindRegular, Payload: testdata.SRI(t, "one"), Size: 3}},
+				{Stat: api.Stat{Name: "two", Kind: api.KindRegular, Payload: testdata.SRI(t, "two"), Size: 3}},
+			},
+		}},
+		{},
+	}
+	dst := memory.New(0)
+
+	report, err := replicate.ReplicateTrees(context.Background(), src, dst, trees, replicate.Options{})
+	require.NoError(err)
+	assert.Equal(2, report.Copied)
+	assert.True(dst.Has(testdata.SRI(t, "one")))
+	assert.True(dst.Has(testdata.SRI(t, "two")))
+}
+
+func TestReplicateBoundedWorkers(t *testing.T) {
+	src := newRawCAS()
+	var sris []string
+	for i := 0; i < 20; i++ {
+		payload := fmt.Sprintf("blob %d", i)
+		src.put(testdata.SRI(t, payload), payload)
+		sris = append(sris, testdata.SRI(t, payload))
+	}
+	src.delay = 5 * time.Millisecond
+
+	report, err := replicate.Replicate(context.Background(), src, memory.New(0), sris, replicate.Options{Workers: 3})
+	require.NoError(t, err)
+	assert.Equal(t, 20, report.Copied)
+	assert.LessOrEqual(t, src.maxActive.Load(), int32(3))
+	assert.Greater(t, src.maxActive.Load(), int32(1))
+}
+
+func TestReplicateCanceled(t *testing.T) {
+	src := memory.New(0)
+	require.NoError(t, src.Write(testdata.SRI(t, "a"), strings.NewReader("a")))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := replicate.Replicate(ctx, src, memory.New(0), []string{testdata.SRI(t, "a")}, replicate.Options{})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, report.Copied)
+}
+
+// rawCAS returns blobs without verifying them and tracks concurrent readers.
+type rawCAS struct {
+	mux       sync.Mutex
+	blobs     map[string]string
+	delay     time.Duration
+	active    atomic.Int32
+	maxActive atomic.Int32
+}
+
+func newRawCAS() *rawCAS {
+	return &rawCAS{blobs: make(map[string]string)}
+}
+
+func (r *rawCAS) put(sri, content string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.blobs[sri] = content
+}
+
+func (r *rawCAS) Open(sri string) (io.ReadCloser, error) {
+	r.mux.Lock()
+	blob, ok := r.blobs[sri]
+	r.mux.Unlock()
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	active := r.active.Add(1)
+	for {
+		max := r.maxActive.Load()
+		if active <= max || r.maxActive.CompareAndSwap(max, active) {
+			break
+		}
+	}
+	time.Sleep(r.delay)
+	return &trackedReader{Reader: bytes.NewReader([]byte(blob)), cas: r}, nil
+}
+
+type trackedReader struct {
+	io.Reader
+	cas *rawCAS
+}
+
+func (t *trackedReader) Close() error {
+	t.cas.active.Add(-1)
+	return nil
+}
@@ -0,0 +1,183 @@
+package singleflight_test
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/malt3/abstractfs-core/cas/memory"
+	"github.com/malt3/abstractfs-core/cas/singleflight"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCoalesced(t *testing.T) {
+	assert := assert.New(t)
+	backend := newSlowCAS()
+	cas := singleflight.New(backend, singleflight.Options{})
+	sriString := testdata.SRI(t, "shared")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(cas.Write(sriString, strings.NewReader("shared")))
+		}()
+	}
+	wg.Wait()
+	writes := backend.writes.Load()
+	assert.Less(writes, int32(10))
+	assert.Equal(uint64(10), uint64(writes)+cas.Stats().CoalescedWrites)
+
+	// known to exist: the backend write is skipped
+	assert.NoError(cas.Write(sriString, strings.NewReader("shared")))
+	assert.Equal(writes, backend.writes.Load())
+	assert.Equal(uint64(1), cas.Stats().SkippedWrites)
+}
+
+func TestWriteCoalescedPipe(t *testing.T) {
+	assert := assert.New(t)
+	backend := newSlowCAS()
+	cas := singleflight.New(backend, singleflight.Options{})
+	sriString := testdata.SRI(t, "piped")
+
+	// writers that do not reach the backend must still consume their pipe
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		pr, pw := io.Pipe()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := io.WriteString(pw, "piped")
+			pw.CloseWithError(err)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(cas.Write(sriString, pr))
+		}()
+	}
+	wg.Wait()
+	stats := cas.Stats()
+	assert.Equal(uint64(10), uint64(backend.writes.Load())+stats.CoalescedWrites+stats.SkippedWrites)
+}
+
+func TestWriteAfterBackendDelete(t *testing.T) {
+	assert := assert.New(t)
+	backend := newSlowCAS()
+	cas := singleflight.New(backend, singleflight.Options{})
+	sriString := testdata.SRI(t, "blob")
+	assert.NoError(cas.Write(sriString, strings.NewReader("blob")))
+
+	// deleted behind the back of the wrapper, e.g. by garbage collection
+	assert.NoError(backend.Delete(sriString))
+	assert.NoError(cas.Write(sriString, strings.NewReader("blob")))
+	assert.Equal(int32(2), backend.writes.Load())
+	assert.Zero(cas.Stats().SkippedWrites)
+	assert.True(backend.Has(sriString))
+}
+
+func TestWriteLeaderFails(t *testing.T) {
+	assert := assert.New(t)
+	backend := newSlowCAS()
+	cas := singleflight.New(backend, singleflight.Options{})
+	sriString := testdata.SRI(t, "content")
+
+	leaderStarted := make(chan struct{})
+	backend.onWrite = func() {
+		select {
+		case <-leaderStarted:
+		default:
+			close(leaderStarted)
+		}
+	}
+	var leaderErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leaderErr = cas.Write(sriString, strings.NewReader("tampered"))
+	}()
+	<-leaderStarted
+	// waits for the leader, then retries with its own valid input
+	assert.NoError(cas.Write(sriString, strings.NewReader("content")))
+	<-done
+	assert.ErrorIs(leaderErr, sri.ErrHashMismatch)
+	assert.True(backend.Has(sriString))
+}
+
+func TestOpenCoalesced(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	backend := newSlowCAS()
+	small, large := "small", strings.Repeat("large", 100)
+	require.NoError(backend.Write(testdata.SRI(t, small), strings.NewReader(small)))
+	require.NoError(backend.Write(testdata.SRI(t, large), strings.NewReader(large)))
+	cas := singleflight.New(backend, singleflight.Options{MaxSharedReadSize: 64})
+
+	for _, payload := range []string{small, large} {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				body, err := cas.Open(testdata.SRI(t, payload))
+				if !assert.NoError(err) {
+					return
+				}
+				defer body.Close()
+				got, err := io.ReadAll(body)
+				assert.NoError(err)
+				assert.Equal(payload, string(got))
+			}()
+		}
+		wg.Wait()
+	}
+	assert.Less(backend.opens.Load(), int32(20))
+
+	_, err := cas.Open(testdata.SRI(t, "missing"))
+	assert.Error(err)
+}
+
+func TestWriteAfterDelete(t *testing.T) {
+	assert := assert.New(t)
+	backend := newSlowCAS()
+	cas := singleflight.New(backend, singleflight.Options{})
+	sriString := testdata.SRI(t, "blob")
+	assert.NoError(cas.Write(sriString, strings.NewReader("blob")))
+	assert.NoError(cas.Delete(sriString))
+	assert.NoError(cas.Write(sriString, strings.NewReader("blob")))
+	assert.Equal(int32(2), backend.writes.Load())
+	assert.True(backend.Has(sriString))
+}
+
+// slowCAS is a memory CAS with slow writes and reads that counts backend calls.
+type slowCAS struct {
+	*memory.CAS
+	writes  atomic.Int32
+	opens   atomic.Int32
+	onWrite func()
+}
+
+func newSlowCAS() *slowCAS {
+	return &slowCAS{CAS: memory.New(0)}
+}
+
+func (s *slowCAS) Write(sri string, r io.Reader) error {
+	s.writes.Add(1)
+	if s.onWrite != nil {
+		s.onWrite()
+	}
+	time.Sleep(20 * time.Millisecond)
+	return s.CAS.Write(sri, r)
+}
+
+func (s *slowCAS) Open(sri string) (io.ReadCloser, error) {
+	s.opens.Add(1)
+	time.Sleep(20 * time.Millisecond)
+	return s.CAS.Open(sri)
+}
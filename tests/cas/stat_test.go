@@ -0,0 +1,87 @@
+package cas_test
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatHas(t *testing.T) {
+	dirCAS, err := dir.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, dirCAS.Write(testdata.SRI(t, "foo"), strings.NewReader("foo")))
+
+	testCases := map[string]struct {
+		cas      api.CASReader
+		sri      string
+		wantHas  bool
+		wantSize int64
+	}{
+		"stater present": {
+			cas:      dirCAS,
+			sri:      testdata.SRI(t, "foo"),
+			wantHas:  true,
+			wantSize: 3,
+		},
+		"stater missing": {
+			cas: dirCAS,
+			sri: testdata.SRI(t, "bar"),
+		},
+		"fallback present": {
+			cas:      openOnly{"foo"},
+			sri:      testdata.SRI(t, "foo"),
+			wantHas:  true,
+			wantSize: 3,
+		},
+		"fallback missing": {
+			cas: openOnly{"foo"},
+			sri: testdata.SRI(t, "bar"),
+		},
+		"empty": {
+			cas: &cas.EmptyCAS{},
+			sri: testdata.SRI(t, "foo"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			has, err := cas.Has(tc.cas, tc.sri)
+			assert.NoError(err)
+			assert.Equal(tc.wantHas, has)
+
+			size, err := cas.Stat(tc.cas, tc.sri)
+			if !tc.wantHas {
+				assert.ErrorIs(err, fs.ErrNotExist)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.wantSize, size)
+		})
+	}
+}
+
+// openOnly is a CAS reader that only implements Open.
+type openOnly []string
+
+func (o openOnly) Open(sriString string) (io.ReadCloser, error) {
+	for _, payload := range o {
+		integrity, err := sri.FromReader(sri.SHA256, strings.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if integrity.String() == sriString {
+			return io.NopCloser(strings.NewReader(payload)), nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
@@ -0,0 +1,173 @@
+package tiered_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/dir"
+	"github.com/malt3/abstractfs-core/cas/tiered"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenBackfill(t *testing.T) {
+	testCases := map[string]struct {
+		readAll      bool
+		wantBackfill bool
+	}{
+		"read completely": {
+			readAll:      true,
+			wantBackfill: true,
+		},
+		"closed early": {
+			readAll: false,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			fast, slow := newDir(t), newDir(t)
+			payload := strings.Repeat("abstractfs", 10000)
+			integrity := testdata.SRI(t, payload)
+			require.NoError(slow.Write(integrity, strings.NewReader(payload)))
+
+			cas, err := tiered.New([]api.CAS{fast, slow}, tiered.Options{})
+			require.NoError(err)
+			body, err := cas.Open(integrity)
+			require.NoError(err)
+			if tc.readAll {
+				got, err := io.ReadAll(body)
+				require.NoError(err)
+				assert.Equal(payload, string(got))
+			} else {
+				_, err := body.Read(make([]byte, 10))
+				require.NoError(err)
+			}
+			require.NoError(body.Close())
+
+			_, err = fast.Stat(integrity)
+			if tc.wantBackfill {
+				assert.NoError(err)
+			} else {
+				assert.ErrorIs(err, fs.ErrNotExist)
+			}
+		})
+	}
+}
+
+func TestOpenDegraded(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	slow := newDir(t)
+	integrity := testdata.SRI(t, "foo")
+	require.NoError(slow.Write(integrity, strings.NewReader("foo")))
+
+	var mux sync.Mutex
+	var layerErrs []int
+	cas, err := tiered.New([]api.CAS{brokenCAS{}, slow}, tiered.Options{
+		OnError: func(layer int, err error) {
+			mux.Lock()
+			defer mux.Unlock()
+			layerErrs = append(layerErrs, layer)
+		},
+	})
+	require.NoError(err)
+
+	body, err := cas.Open(integrity)
+	require.NoError(err)
+	got, err := io.ReadAll(body)
+	require.NoError(err)
+	require.NoError(body.Close())
+	assert.Equal("foo", string(got))
+	// the broken layer fails both the read and the back-fill
+	assert.Equal([]int{0, 0}, layerErrs)
+
+	// a blob that is missing everywhere cannot be reported as missing if a layer failed
+	_, err = cas.Open(testdata.SRI(t, "bar"))
+	assert.Error(err)
+	assert.False(errors.Is(err, fs.ErrNotExist))
+}
+
+func TestWrite(t *testing.T) {
+	testCases := map[string]struct {
+		opts        tiered.Options
+		wantPresent []bool
+	}{
+		"write-through all layers": {
+			opts:        tiered.Options{WriteMode: tiered.WriteThrough},
+			wantPresent: []bool{true, true, true},
+		},
+		"write-through selected layers": {
+			opts:        tiered.Options{WriteMode: tiered.WriteThrough, WriteLayers: []int{0, 2}},
+			wantPresent: []bool{true, false, true},
+		},
+		"write-back": {
+			opts:        tiered.Options{WriteMode: tiered.WriteBack},
+			wantPresent: []bool{true, true, true},
+		},
+		"write-back selected layers": {
+			opts:        tiered.Options{WriteMode: tiered.WriteBack, WriteLayers: []int{1, 2}},
+			wantPresent: []bool{false, true, true},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			layers := []*dir.CAS{newDir(t), newDir(t), newDir(t)}
+			cas, err := tiered.New([]api.CAS{layers[0], layers[1], layers[2]}, tc.opts)
+			require.NoError(err)
+
+			integrity := testdata.SRI(t, "foo")
+			require.NoError(cas.Write(integrity, strings.NewReader("foo")))
+			require.NoError(cas.Flush())
+
+			for i, layer := range layers {
+				_, err := layer.Stat(integrity)
+				assert.Equal(tc.wantPresent[i], err == nil, "layer %d", i)
+			}
+		})
+	}
+}
+
+func TestWriteHashMismatch(t *testing.T) {
+	require := require.New(t)
+	layers := []*dir.CAS{newDir(t), newDir(t)}
+	cas, err := tiered.New([]api.CAS{layers[0], layers[1]}, tiered.Options{})
+	require.NoError(err)
+
+	err = cas.Write(testdata.SRI(t, "foo"), strings.NewReader("bar"))
+	require.ErrorIs(err, sri.ErrHashMismatch)
+	for _, layer := range layers {
+		_, err := layer.Stat(testdata.SRI(t, "foo"))
+		require.ErrorIs(err, fs.ErrNotExist)
+	}
+}
+
+// brokenCAS fails every operation.
+type brokenCAS struct{}
+
+func (brokenCAS) Open(string) (io.ReadCloser, error) {
+	return nil, errors.New("broken")
+}
+
+func (brokenCAS) Write(string, io.Reader) error {
+	return errors.New("broken")
+}
+
+func newDir(t *testing.T) *dir.CAS {
+	t.Helper()
+	cas, err := dir.New(t.TempDir())
+	require.NoError(t, err)
+	return cas
+}
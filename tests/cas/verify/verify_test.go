@@ -0,0 +1,127 @@
+package verify_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/cas/verify"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/malt3/abstractfs-core/tests/internal/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	foo := testdata.SRI(t, "foo")
+
+	testCases := map[string]struct {
+		stored   string
+		statSize int64
+		wantErr  error
+	}{
+		"valid": {
+			stored:   "foo",
+			statSize: -1,
+		},
+		"valid with size": {
+			stored:   "foo",
+			statSize: 3,
+		},
+		"modified": {
+			stored:   "bar",
+			statSize: -1,
+			wantErr:  sri.ErrHashMismatch,
+		},
+		"truncated": {
+			stored:   "fo",
+			statSize: 3,
+			wantErr:  sri.ErrSizeMismatch,
+		},
+		"extended": {
+			stored:   "foooooo",
+			statSize: 3,
+			wantErr:  sri.ErrSizeMismatch,
+		},
+		"wrong size reported": {
+			stored:   "foo",
+			statSize: 4,
+			wantErr:  sri.ErrSizeMismatch,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			backend := &fakeCAS{blobs: map[string]string{foo: tc.stored}, size: tc.statSize}
+			if tc.statSize < 0 {
+				backend.size = int64(len(tc.stored))
+			}
+			var reader api.CASReader = verify.New(backend)
+			if tc.statSize < 0 {
+				reader = verify.New(openOnly{backend})
+			}
+
+			body, err := reader.Open(foo)
+			require.NoError(err)
+			defer body.Close()
+			got, err := io.ReadAll(body)
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				var integrityErr *sri.IntegrityError
+				require.True(errors.As(err, &integrityErr))
+				assert.Equal(foo, integrityErr.Expected.String())
+				return
+			}
+			require.NoError(err)
+			assert.Equal(tc.stored, string(got))
+		})
+	}
+}
+
+func TestOpenNotExist(t *testing.T) {
+	reader := verify.New(&fakeCAS{blobs: map[string]string{}})
+	_, err := reader.Open(testdata.SRI(t, "foo"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.ErrorIs(t, reader.Check(testdata.SRI(t, "foo")), fs.ErrNotExist)
+}
+
+func TestCheck(t *testing.T) {
+	foo := testdata.SRI(t, "foo")
+	assert.NoError(t, verify.New(&fakeCAS{blobs: map[string]string{foo: "foo"}, size: 3}).Check(foo))
+	assert.ErrorIs(t, verify.New(&fakeCAS{blobs: map[string]string{foo: "bar"}, size: 3}).Check(foo), sri.ErrHashMismatch)
+}
+
+// fakeCAS returns stored blobs unverified and reports a fixed size.
+type fakeCAS struct {
+	blobs map[string]string
+	size  int64
+}
+
+func (f *fakeCAS) Open(sri string) (io.ReadCloser, error) {
+	blob, ok := f.blobs[sri]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader([]byte(blob))), nil
+}
+
+func (f *fakeCAS) Stat(sri string) (int64, error) {
+	if _, ok := f.blobs[sri]; !ok {
+		return 0, fs.ErrNotExist
+	}
+	return f.size, nil
+}
+
+// openOnly hides the Stat method of a CAS.
+type openOnly struct {
+	cas *fakeCAS
+}
+
+func (o openOnly) Open(sri string) (io.ReadCloser, error) {
+	return o.cas.Open(sri)
+}
@@ -0,0 +1,23 @@
+package testdata
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/stretchr/testify/require"
+)
+
+// SRI returns the SHA-256 SRI of payload.
+func SRI[T string | []byte](t testing.TB, payload T) string {
+	t.Helper()
+	return Integrity(t, payload).String()
+}
+
+// Integrity returns the SHA-256 integrity of payload.
+func Integrity[T string | []byte](t testing.TB, payload T) sri.Integrity {
+	t.Helper()
+	integrity, err := sri.FromReader(sri.SHA256, strings.NewReader(string(payload)))
+	require.NoError(t, err)
+	return integrity
+}
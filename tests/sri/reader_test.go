@@ -0,0 +1,69 @@
+package sri_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/malt3/abstractfs-core/api"
+	"github.com/malt3/abstractfs-core/sri"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	foo, err := sri.FromReader(sri.SHA256, strings.NewReader("foo"))
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		payload string
+		size    int64
+		wantErr error
+	}{
+		"valid": {
+			payload: "foo",
+			size:    -1,
+		},
+		"valid with size": {
+			payload: "foo",
+			size:    3,
+		},
+		"hash mismatch": {
+			payload: "bar",
+			size:    -1,
+			wantErr: sri.ErrHashMismatch,
+		},
+		"too short": {
+			payload: "fo",
+			size:    3,
+			wantErr: sri.ErrSizeMismatch,
+		},
+		"too long": {
+			payload: "fooo",
+			size:    3,
+			wantErr: sri.ErrSizeMismatch,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			r, err := sri.NewVerifyingReader(foo, tc.size, strings.NewReader(tc.payload))
+			require.NoError(t, err)
+			got, err := io.ReadAll(r)
+			if tc.wantErr != nil {
+				assert.ErrorIs(err, tc.wantErr)
+				assert.ErrorIs(err, api.ErrIntegrityMismatch)
+				var integrityErr *sri.IntegrityError
+				require.ErrorAs(t, err, &integrityErr)
+				assert.Equal(foo, integrityErr.Expected)
+				// errors are sticky
+				_, err = r.Read(make([]byte, 1))
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tc.payload, string(got))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/malt3/abstractfs-core/api"
 	"github.com/malt3/abstractfs-core/sri"
 	"github.com/stretchr/testify/assert"
 )
@@ -79,6 +80,9 @@ func TestFromToString(t *testing.T) {
 			got, err := sri.FromString(tc.input)
 			assert.Equal(tc.wantErr, err != nil)
 			assert.Equal(tc.want, got)
+			if err != nil {
+				assert.ErrorIs(err, api.ErrInvalidSRI)
+			}
 			if err == nil {
 				assert.Equal(tc.input, got.String())
 			}
@@ -51,8 +51,11 @@ func (t *TreeFS) ReadDir(name string) ([]fs.DirEntry, error) {
 
 // Record records all file contents of the tree to a io.Writer.
 // The format is compatible with the recorder protocol.
+// Every record is protected by a checksum and the stream ends with a trailer,
+// so that recorders detect truncated streams.
 func (t *TreeFS) Record(w io.Writer) error {
-	return fs.WalkDir(t, ".", func(path string, d fs.DirEntry, err error) error {
+	encoder := recorder.NewEncoder(w, recorder.EncoderOptions{Checksum: true})
+	err := fs.WalkDir(t, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -68,8 +71,8 @@ func (t *TreeFS) Record(w io.Writer) error {
 		if !ok {
 			return &fs.PathError{Op: "record", Path: path, Err: fs.ErrInvalid}
 		}
-		sri, error := sri.FromString(stat.Payload)
-		if error != nil {
+		integrity, err := sri.FromString(stat.Payload)
+		if err != nil {
 			return err
 		}
 
@@ -79,8 +82,12 @@ func (t *TreeFS) Record(w io.Writer) error {
 		}
 		defer file.Close()
 
-		return recorder.Encode(w, sri, stat.Size, file)
+		return encoder.Encode(integrity, stat.Size, file)
 	})
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
 }
 
 // file implements fs.File for a node.